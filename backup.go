@@ -0,0 +1,522 @@
+package phash
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A backup is a single stream:
+//
+//   - Magic (4 bytes): backupMagic
+//   - Version (4 bytes): backupVersion
+//   - Kind (1 byte): backupImage or backupCompact
+//   - Body, by kind (below)
+//   - Checksum (32 bytes): SHA-256 of everything before it
+//
+// An image body is a list of sections, each a kind byte, an 8-byte length
+// and that many bytes: the table file (header plus slots), then the value
+// log and the overflow key file if the table has them, ended by a zero
+// kind. The files are restored byte for byte.
+//
+// A compact body holds only the live entries, each a 4-byte key length,
+// a 4-byte value length, the key, the value and, for TTL tables, the
+// 8-byte expiry. They follow the shape of the table: key size, value size,
+// layout, hash function, feature flags, key prefix and cache capacity
+// (4 bytes each) and the entry count (8 bytes). Restoring it builds a
+// fresh table without tombstones, overwritten values or spare slots. A
+// table that had a Bloom filter gets one at defaultBloomFP unless the
+// Options passed to Restore set another rate.
+const (
+	backupMagic   uint32 = 0x5048424B // "PHBK"
+	backupVersion uint32 = 1
+
+	backupImage   byte = 0
+	backupCompact byte = 1
+
+	sectionEnd   byte = 0
+	sectionTable byte = 1
+	sectionVlog  byte = 2
+	sectionKlog  byte = 3
+)
+
+// BackupOptions controls what Backup writes.
+type BackupOptions struct {
+	// Compact writes only the live entries instead of an image of the
+	// files. The backup is smaller when the table has spare slots or
+	// garbage in its value log, and Restore rebuilds the table.
+	Compact bool
+}
+
+// Backup writes a consistent image of the hash to w. It works from a
+// Snapshot, so writers are only held up while that is taken, not while w
+// is written.
+func (ph *PersistentHash) Backup(w io.Writer) error {
+	return ph.BackupWithOptions(w, nil)
+}
+
+// BackupTo writes a backup to the file at path. The file only appears once
+// the backup is complete and synced.
+func (ph *PersistentHash) BackupTo(path string) error {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create backup file: %w", err)
+	}
+
+	err = ph.Backup(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// BackupWithOptions is like Backup but lets the caller choose the format.
+// A nil opts is equivalent to Backup.
+func (ph *PersistentHash) BackupWithOptions(w io.Writer, opts *BackupOptions) error {
+	snap, err := ph.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	sum := sha256.New()
+	bw := bufio.NewWriter(w)
+	out := io.MultiWriter(bw, sum)
+
+	head := binary.BigEndian.AppendUint32(nil, backupMagic)
+	head = binary.BigEndian.AppendUint32(head, backupVersion)
+	if opts != nil && opts.Compact {
+		head = append(head, backupCompact)
+		if _, err := out.Write(head); err != nil {
+			return err
+		}
+		err = snap.view.writeEntries(out)
+	} else {
+		head = append(head, backupImage)
+		if _, err := out.Write(head); err != nil {
+			return err
+		}
+		err = snap.view.writeImage(out)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := bw.Write(sum.Sum(nil)); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// writeImage writes the sections of an image backup of ph, a snapshot view.
+func (ph *PersistentHash) writeImage(out io.Writer) error {
+	if err := writeSection(out, sectionTable, bytes.NewReader(ph.data), int64(len(ph.data))); err != nil {
+		return err
+	}
+	if l := ph.vlog; l != nil {
+		if err := writeSection(out, sectionVlog, io.NewSectionReader(l.file, 0, l.size), l.size); err != nil {
+			return err
+		}
+	}
+	if l := ph.klog; l != nil {
+		if err := writeSection(out, sectionKlog, io.NewSectionReader(l.file, 0, l.size), l.size); err != nil {
+			return err
+		}
+	}
+	_, err := out.Write([]byte{sectionEnd, 0, 0, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func writeSection(out io.Writer, kind byte, r io.Reader, n int64) error {
+	head := append([]byte{kind}, binary.BigEndian.AppendUint64(nil, uint64(n))...)
+	if _, err := out.Write(head); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(out, r, n); err != nil {
+		return fmt.Errorf("failed to copy backup section: %w", err)
+	}
+	return nil
+}
+
+// writeEntries writes the body of a compact backup of ph, a snapshot view.
+func (ph *PersistentHash) writeEntries(out io.Writer) error {
+	if ph.crypt != nil {
+		return errors.New("a compact backup of an encrypted table would hold plaintext; use an image backup")
+	}
+	keySize, valueSize := ph.keySize, ph.userValueSize()
+	if ph.flags&flagVarKeys != 0 {
+		keySize = 0
+	}
+	if ph.flags&flagValueLog != 0 {
+		valueSize = 0
+	}
+
+	var meta []byte
+	for _, v := range []uint32{keySize, valueSize, uint32(ph.layout), uint32(ph.hashFunc), ph.flags, ph.keyPrefix, ph.capacity} {
+		meta = binary.BigEndian.AppendUint32(meta, v)
+	}
+
+	// Count first, against the same clock, so expiring entries agree
+	now := time.Now().UnixNano()
+	var count uint64
+	if err := ph.walkLocked(now, func(_, _ []byte, _ int64) bool {
+		count++
+		return true
+	}); err != nil {
+		return err
+	}
+	meta = binary.BigEndian.AppendUint64(meta, count)
+	if _, err := out.Write(meta); err != nil {
+		return err
+	}
+
+	var err error
+	ferr := ph.walkLocked(now, func(key, value []byte, expiry int64) bool {
+		var lens [8]byte
+		binary.BigEndian.PutUint32(lens[0:4], uint32(len(key)))
+		binary.BigEndian.PutUint32(lens[4:8], uint32(len(value)))
+		if _, err = out.Write(lens[:]); err != nil {
+			return false
+		}
+		if _, err = out.Write(key); err != nil {
+			return false
+		}
+		if _, err = out.Write(value); err != nil {
+			return false
+		}
+		if ph.flags&flagTTL != 0 {
+			_, err = out.Write(binary.BigEndian.AppendUint64(nil, uint64(expiry)))
+		}
+		return err == nil
+	})
+	if ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// Restore creates a hash at path from a backup read from r and opens it.
+// The checksum is verified before the hash is opened; if it does not match,
+// or anything else fails, the files created are removed again. path must
+// not exist yet. opts is used to open the result and must carry the Hasher
+// if the backed up table used a custom one; the format options come from
+// the backup.
+func Restore(r io.Reader, path string, opts *Options) (*PersistentHash, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("restore target %s already exists", path)
+	}
+
+	ph, err := restore(r, path, opts)
+	if err != nil {
+		removeHashFiles(path)
+		return nil, err
+	}
+	return ph, nil
+}
+
+// VerifyBackup reads a backup from r and checks its structure and
+// checksum without restoring it.
+func VerifyBackup(r io.Reader) error {
+	br, err := newBackupReader(r)
+	if err != nil {
+		return err
+	}
+	if br.kind == backupImage {
+		for {
+			kind, n, err := br.section()
+			if err != nil {
+				return err
+			}
+			if kind == sectionEnd {
+				break
+			}
+			if _, err := io.CopyN(io.Discard, br, n); err != nil {
+				return fmt.Errorf("truncated backup: %w", err)
+			}
+		}
+	} else {
+		meta, err := br.compactMeta()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < meta.count; i++ {
+			if _, _, _, err := br.entry(meta); err != nil {
+				return err
+			}
+		}
+	}
+	return br.verify()
+}
+
+func restore(r io.Reader, path string, opts *Options) (*PersistentHash, error) {
+	br, err := newBackupReader(r)
+	if err != nil {
+		return nil, err
+	}
+	if br.kind == backupCompact {
+		return restoreEntries(br, path, opts)
+	}
+
+	var gen uint32
+	for {
+		kind, n, err := br.section()
+		if err != nil {
+			return nil, err
+		}
+		var target string
+		switch kind {
+		case sectionEnd:
+		case sectionTable:
+			target = path
+		case sectionVlog:
+			target = fmt.Sprintf("%s.vlog.%d", path, gen)
+		case sectionKlog:
+			target = path + ".klog"
+		default:
+			return nil, fmt.Errorf("unknown backup section %d", kind)
+		}
+		if kind == sectionEnd {
+			break
+		}
+
+		file, err := os.OpenFile(target, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s: %w", target, err)
+		}
+		_, err = io.CopyN(file, br, n)
+		if err == nil && kind == sectionTable {
+			gen, err = tableLogGen(file)
+		}
+		if err == nil {
+			err = file.Sync()
+		}
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %w", target, err)
+		}
+	}
+	if err := br.verify(); err != nil {
+		return nil, err
+	}
+	return OpenWithOptions(path, 0, 0, opts)
+}
+
+// tableLogGen reads the value log generation from a restored table file.
+// The value log section follows the table, so its name is known in time.
+func tableLogGen(file *os.File) (uint32, error) {
+	var hdr [60]byte
+	if _, err := file.ReadAt(hdr[:], 0); err != nil {
+		// A version 1 header is shorter and has no value log
+		return 0, nil
+	}
+	if binary.BigEndian.Uint32(hdr[4:8]) != version2 {
+		return 0, nil
+	}
+	return binary.BigEndian.Uint32(hdr[56:60]), nil
+}
+
+// restoreEntries rebuilds a table from the body of a compact backup.
+func restoreEntries(br *backupReader, path string, opts *Options) (*PersistentHash, error) {
+	meta, err := br.compactMeta()
+	if err != nil {
+		return nil, err
+	}
+
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	o.Layout = Layout(meta.layout)
+	o.VarKeys = meta.flags&flagVarKeys != 0
+	o.KeyPrefix = int(meta.keyPrefix)
+	o.ValueLog = meta.flags&flagValueLog != 0
+	o.TTL = meta.flags&flagTTL != 0
+	o.Compress = meta.flags&flagCompressed != 0
+	o.CacheCapacity = int(meta.capacity)
+	if meta.flags&flagBloom != 0 && o.BloomFalsePositive == 0 {
+		o.BloomFalsePositive = defaultBloomFP
+	}
+	if meta.hashFunc != HashCustom {
+		o.HashFunc = meta.hashFunc
+	} else if o.Hasher == nil {
+		return nil, errors.New("backup was made with a custom hasher; pass it in Options.Hasher")
+	}
+
+	ph, err := OpenWithOptions(path, meta.keySize, meta.valueSize, &o)
+	if err != nil {
+		return nil, err
+	}
+	err = func() error {
+		ph.mu.Lock()
+		defer ph.mu.Unlock()
+
+		if err := ph.reserve(int(meta.count)); err != nil {
+			return err
+		}
+		for i := uint64(0); i < meta.count; i++ {
+			key, value, expiry, err := br.entry(meta)
+			if err != nil {
+				return err
+			}
+			if err := ph.putLocked(key, value, expiry); err != nil {
+				return err
+			}
+		}
+		if err := br.verify(); err != nil {
+			return err
+		}
+		return ph.syncLocked()
+	}()
+	if err != nil {
+		ph.Close()
+		return nil, err
+	}
+	return ph, nil
+}
+
+// removeHashFiles deletes a hash file and its companions.
+func removeHashFiles(path string) {
+	os.Remove(path)
+	removeCompanions(path)
+}
+
+// removeCompanions deletes the files kept alongside a hash at path.
+func removeCompanions(path string) {
+	os.Remove(path + ".tmp")
+	os.Remove(path + ".klog")
+	os.Remove(path + ".wal")
+	os.Remove(path + ".grow")
+	os.Remove(path + ".bloom")
+	os.Remove(path + ".bloom.tmp")
+	logs, _ := filepath.Glob(path + ".vlog.*")
+	for _, l := range logs {
+		os.Remove(l)
+	}
+}
+
+// backupReader reads a backup while hashing everything up to the checksum.
+type backupReader struct {
+	r    *bufio.Reader
+	sum  hash.Hash
+	body io.Reader
+	kind byte
+}
+
+func newBackupReader(r io.Reader) (*backupReader, error) {
+	br := &backupReader{r: bufio.NewReader(r), sum: sha256.New()}
+	br.body = io.TeeReader(br.r, br.sum)
+
+	var head [9]byte
+	if _, err := io.ReadFull(br.body, head[:]); err != nil {
+		return nil, fmt.Errorf("failed to read backup header: %w", err)
+	}
+	if binary.BigEndian.Uint32(head[0:4]) != backupMagic {
+		return nil, errors.New("not a phash backup")
+	}
+	if v := binary.BigEndian.Uint32(head[4:8]); v != backupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", v)
+	}
+	br.kind = head[8]
+	if br.kind != backupImage && br.kind != backupCompact {
+		return nil, fmt.Errorf("unknown backup kind %d", br.kind)
+	}
+	return br, nil
+}
+
+func (br *backupReader) Read(p []byte) (int, error) {
+	return br.body.Read(p)
+}
+
+// section reads the kind and length of the next image section.
+func (br *backupReader) section() (byte, int64, error) {
+	var head [9]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return 0, 0, fmt.Errorf("truncated backup: %w", err)
+	}
+	return head[0], int64(binary.BigEndian.Uint64(head[1:9])), nil
+}
+
+type compactMeta struct {
+	keySize, valueSize uint32
+	layout             uint32
+	hashFunc           HashFunc
+	flags, keyPrefix   uint32
+	capacity           uint32
+	count              uint64
+}
+
+func (br *backupReader) compactMeta() (compactMeta, error) {
+	var buf [36]byte
+	if _, err := io.ReadFull(br, buf[:]); err != nil {
+		return compactMeta{}, fmt.Errorf("truncated backup: %w", err)
+	}
+	return compactMeta{
+		keySize:   binary.BigEndian.Uint32(buf[0:4]),
+		valueSize: binary.BigEndian.Uint32(buf[4:8]),
+		layout:    binary.BigEndian.Uint32(buf[8:12]),
+		hashFunc:  HashFunc(binary.BigEndian.Uint32(buf[12:16])),
+		flags:     binary.BigEndian.Uint32(buf[16:20]),
+		keyPrefix: binary.BigEndian.Uint32(buf[20:24]),
+		capacity:  binary.BigEndian.Uint32(buf[24:28]),
+		count:     binary.BigEndian.Uint64(buf[28:36]),
+	}, nil
+}
+
+// entry reads the next entry of a compact backup, and its expiry if the
+// table has them.
+func (br *backupReader) entry(meta compactMeta) ([]byte, []byte, int64, error) {
+	var lens [8]byte
+	if _, err := io.ReadFull(br, lens[:]); err != nil {
+		return nil, nil, 0, fmt.Errorf("truncated backup: %w", err)
+	}
+	keyLen := int64(binary.BigEndian.Uint32(lens[0:4]))
+	valueLen := int64(binary.BigEndian.Uint32(lens[4:8]))
+	n := keyLen + valueLen
+	if meta.flags&flagTTL != 0 {
+		n += expirySize
+	}
+
+	// Grow as data arrives rather than trusting the lengths up front
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, br, n); err != nil {
+		return nil, nil, 0, fmt.Errorf("truncated backup: %w", err)
+	}
+	b := buf.Bytes()
+	var expiry int64
+	if meta.flags&flagTTL != 0 {
+		expiry = int64(binary.BigEndian.Uint64(b[n-expirySize:]))
+	}
+	return b[:keyLen], b[keyLen : keyLen+valueLen], expiry, nil
+}
+
+// verify compares the checksum at the end of the backup with the data read.
+func (br *backupReader) verify() error {
+	var want [sha256.Size]byte
+	if _, err := io.ReadFull(br.r, want[:]); err != nil {
+		return fmt.Errorf("truncated backup: %w", err)
+	}
+	if !bytes.Equal(br.sum.Sum(nil), want[:]) {
+		return errors.New("backup checksum mismatch")
+	}
+	return nil
+}
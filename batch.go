@@ -0,0 +1,326 @@
+package phash
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+)
+
+// Batch collects Puts and Deletes to be applied together by Write. The
+// zero value is an empty batch ready to use. A Batch is not safe for
+// concurrent use.
+type Batch struct {
+	ops  []batchOp
+	puts int
+}
+
+type batchOp struct {
+	key, value []byte
+	delete     bool
+}
+
+// Put queues an insert or update of key. The key and value are copied.
+func (b *Batch) Put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{
+		key:   append([]byte(nil), key...),
+		value: append([]byte(nil), value...),
+	})
+	b.puts++
+}
+
+// Delete queues the removal of key. The key is copied.
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{key: append([]byte(nil), key...), delete: true})
+}
+
+// Len returns the number of queued operations.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Reset empties the batch so it can be reused.
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+	b.puts = 0
+}
+
+// Write applies every operation in b, in order, under a single
+// acquisition of the write lock. The table is grown up front so the batch
+// causes at most one resize; only a cuckoo table that cannot place a key
+// may need another.
+//
+// The batch is all-or-nothing across crashes. It is first written and
+// synced to filePath + ".wal" and only then applied; the log is removed
+// once the table is synced. If the process dies in between, the batch is
+// completed the next time the file is opened. A batch with an invalid key
+// or value size is rejected before anything is changed. If Write fails
+// once it has begun applying the batch, the log is discarded so nothing is
+// replayed over later writes, and the error says how much was applied.
+func (ph *PersistentHash) Write(b *Batch) error {
+	if b == nil || len(b.ops) == 0 {
+		return nil
+	}
+
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	for _, op := range b.ops {
+		if err := ph.checkBatchOp(op); err != nil {
+			return err
+		}
+	}
+	if err := ph.logBatch(b); err != nil {
+		return err
+	}
+	return ph.applyBatch(b)
+}
+
+// checkBatchOp reports an operation Put or Delete would refuse.
+func (ph *PersistentHash) checkBatchOp(op batchOp) error {
+	if _, ok := ph.encodeKey(op.key); !ok {
+		return errors.New("invalid key/value size")
+	}
+	if op.delete {
+		return nil
+	}
+	return ph.checkValue(op.value)
+}
+
+// applyBatch applies b and retires its log record. The log is retired on
+// failure too, so it is not replayed over later writes; the error says how
+// far the batch got.
+func (ph *PersistentHash) applyBatch(b *Batch) error {
+	err := ph.applyOps(b)
+	if derr := ph.discardBatch(); err == nil && derr != nil {
+		err = fmt.Errorf("batch applied, but %w", derr)
+	}
+	return err
+}
+
+// applyOps makes room for b, applies it and syncs the table.
+func (ph *PersistentHash) applyOps(b *Batch) error {
+	if err := ph.reserve(b.puts); err != nil {
+		return fmt.Errorf("batch not applied: %w", err)
+	}
+	for i, op := range b.ops {
+		if op.delete {
+			ph.removeLocked(op.key)
+			continue
+		}
+		if err := ph.putLocked(op.key, op.value, 0); err != nil {
+			return fmt.Errorf("batch applied only up to operation %d: %w", i, err)
+		}
+	}
+	// A failed sync leaves the batch in the mapping, like any other write
+	if err := ph.syncLocked(); err != nil {
+		return fmt.Errorf("batch applied but not synced: %w", err)
+	}
+	return nil
+}
+
+// discardBatch empties and removes the batch log. An empty log reads as
+// torn, so one that cannot be removed is never replayed.
+func (ph *PersistentHash) discardBatch() error {
+	if ph.inMemory {
+		return nil
+	}
+	walPath := ph.filePath + ".wal"
+	if err := os.Truncate(walPath, 0); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to clear batch log: %w", err)
+	}
+	os.Remove(walPath)
+	return nil
+}
+
+// reserve makes room for n more keys, finishing any resize in flight and
+// then growing the table once if needed so none of them triggers another.
+func (ph *PersistentHash) reserve(n int) error {
+	if ph.capacity > 0 {
+		return nil // caches evict rather than grow
+	}
+	if ph.grow != nil {
+		if err := ph.migrate(ph.numSlots); err != nil {
+			return err
+		}
+	}
+
+	// Stay under the point where a background resize would kick in
+	limit := ph.maxLoad
+	if ph.opts.BackgroundResize && ph.opts.ResizeThreshold < limit {
+		limit = ph.opts.ResizeThreshold
+	}
+
+	need := uint64(ph.usedSlots) + uint64(n)
+	size := uint64(ph.numSlots)
+	for float32(need)/float32(size) > limit {
+		size *= 2
+	}
+	if size == uint64(ph.numSlots) {
+		return nil
+	}
+	if size > math.MaxUint32 {
+		return errors.New("batch too large")
+	}
+
+	if err := ph.beginResize(uint32(size)); err != nil {
+		return fmt.Errorf("resize failed: %w", err)
+	}
+	return ph.migrate(ph.numSlots)
+}
+
+// syncLocked flushes the table and its companion logs to disk.
+func (ph *PersistentHash) syncLocked() error {
+	if ph.inMemory {
+		return nil
+	}
+	files := []*os.File{ph.file}
+	for _, l := range []*valueLog{ph.vlog, ph.klog} {
+		if l != nil {
+			files = append(files, l.file)
+		}
+	}
+	for _, f := range files {
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("failed to sync: %w", err)
+		}
+	}
+	return nil
+}
+
+// The batch log holds a single batch:
+//
+//   - Magic (4 bytes): batchMagic
+//   - Count (4 bytes): Number of operations
+//   - Operations, each:
+//   - Kind (1 byte): 0 for Put, 1 for Delete
+//   - Key Length (4 bytes), Value Length (4 bytes)
+//   - Key and Value bytes
+//   - Checksum (4 bytes): CRC-32 (IEEE) of everything before it
+//
+// An encrypted table logs each key as its slot key and each value as the
+// key and value sealed together, as in a slot; a Delete seals the key
+// alone. Nothing is written in the clear.
+//
+// A log that is short or fails its checksum was torn while being written,
+// before any of the batch was applied, and is discarded.
+const batchMagic uint32 = 0x50484257 // "PHBW"
+
+// logBatch writes b to the batch log and syncs it.
+func (ph *PersistentHash) logBatch(b *Batch) error {
+	if ph.inMemory {
+		return nil // nothing survives a crash to replay
+	}
+	ops := b.ops
+	if ph.crypt != nil {
+		var err error
+		if ops, err = ph.sealBatch(ops); err != nil {
+			return err
+		}
+	}
+
+	size := 12
+	for _, op := range ops {
+		size += 9 + len(op.key) + len(op.value)
+	}
+
+	buf := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(buf[0:4], batchMagic)
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(ops)))
+	for _, op := range ops {
+		var rec [9]byte
+		if op.delete {
+			rec[0] = 1
+		}
+		binary.BigEndian.PutUint32(rec[1:5], uint32(len(op.key)))
+		binary.BigEndian.PutUint32(rec[5:9], uint32(len(op.value)))
+		buf = append(buf, rec[:]...)
+		buf = append(buf, op.key...)
+		buf = append(buf, op.value...)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+
+	file, err := os.OpenFile(ph.filePath+".wal", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create batch log: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(buf); err != nil {
+		return fmt.Errorf("failed to write batch log: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync batch log: %w", err)
+	}
+	return nil
+}
+
+// replayBatch completes a batch left behind by an interrupted Write.
+func (ph *PersistentHash) replayBatch() error {
+	if ph.inMemory {
+		return nil
+	}
+	walPath := ph.filePath + ".wal"
+	buf, err := os.ReadFile(walPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read batch log: %w", err)
+	}
+
+	b, ok := decodeBatch(buf)
+	if !ok {
+		return os.Remove(walPath)
+	}
+	if ph.crypt != nil {
+		if err := ph.openBatch(b); err != nil {
+			return fmt.Errorf("failed to read batch log: %w", err)
+		}
+	}
+	// Nothing has been written since, so a batch that fails here is kept
+	// to be tried again at the next Open
+	if err := ph.applyOps(b); err != nil {
+		return err
+	}
+	return ph.discardBatch()
+}
+
+// decodeBatch parses a batch log, reporting false if it is incomplete.
+func decodeBatch(buf []byte) (*Batch, bool) {
+	if len(buf) < 12 || binary.BigEndian.Uint32(buf[0:4]) != batchMagic {
+		return nil, false
+	}
+	body := buf[:len(buf)-4]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(buf[len(buf)-4:]) {
+		return nil, false
+	}
+
+	b := &Batch{}
+	count := binary.BigEndian.Uint32(body[4:8])
+	pos := uint64(8)
+	for i := uint32(0); i < count; i++ {
+		if pos+9 > uint64(len(body)) {
+			return nil, false
+		}
+		del := body[pos] == 1
+		keyLen := uint64(binary.BigEndian.Uint32(body[pos+1 : pos+5]))
+		valueLen := uint64(binary.BigEndian.Uint32(body[pos+5 : pos+9]))
+		pos += 9
+		if pos+keyLen+valueLen > uint64(len(body)) {
+			return nil, false
+		}
+		// A Delete keeps its value: a sealed one holds the key
+		b.ops = append(b.ops, batchOp{
+			key:    body[pos : pos+keyLen],
+			value:  body[pos+keyLen : pos+keyLen+valueLen],
+			delete: del,
+		})
+		if !del {
+			b.puts++
+		}
+		pos += keyLen + valueLen
+	}
+	return b, pos == uint64(len(body))
+}
@@ -0,0 +1,123 @@
+// Package phash_test provides scale testing for the persistent hash implementation.
+//
+// This file compares the collision strategies selectable with
+// phash.Options.Layout on the same workload.
+// It measures:
+//   - Insertion performance, including resizes
+//   - Lookup performance for present keys
+//   - Lookup performance for absent keys
+//   - Storage efficiency (bytes per key-value pair)
+package phash_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/theflywheel/phash"
+)
+
+// BenchmarkLayouts evaluates each layout with two hundred thousand numeric
+// keys and xxHash64, so every layout sees the same key placement.
+//
+// Metrics collected:
+// - Insertion rate: Keys inserted per second
+// - Hit lookup rate: Lookups per second for keys that exist
+// - Miss lookup rate: Lookups per second for keys that do not exist
+// - Bytes per key: File size divided by the number of keys
+func BenchmarkLayouts(b *testing.B) {
+	fmt.Printf("BenchmarkLayouts started execution, b.N = %d\n", b.N)
+
+	// Force benchmark to run only once regardless of -benchtime flag
+	b.N = 1
+
+	layouts := []struct {
+		name string
+		opts phash.Options
+	}{
+		{"Linear", phash.Options{Layout: phash.LayoutLinear, HashFunc: phash.HashXXH64}},
+		{"RobinHood", phash.Options{Layout: phash.LayoutRobinHood, HashFunc: phash.HashXXH64}},
+		{"RobinHood_0.85", phash.Options{Layout: phash.LayoutRobinHood, HashFunc: phash.HashXXH64, MaxLoadFactor: 0.85}},
+		{"Swiss", phash.Options{Layout: phash.LayoutSwiss, HashFunc: phash.HashXXH64}},
+		{"Cuckoo", phash.Options{Layout: phash.LayoutCuckoo, HashFunc: phash.HashXXH64}},
+	}
+
+	for _, l := range layouts {
+		runLayoutBenchmark(b, l.name, &l.opts)
+	}
+}
+
+// runLayoutBenchmark runs the layout workload once and records its metrics.
+func runLayoutBenchmark(b *testing.B, name string, opts *phash.Options) {
+	tempFile := "layout_" + name + ".phash"
+	defer os.Remove(tempFile)
+
+	keySize := uint32(8)
+	valueSize := uint32(8)
+	numKeys := 200_000
+
+	ph, err := phash.OpenWithOptions(tempFile, keySize, valueSize, opts)
+	if err != nil {
+		b.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+
+	metrics := BenchmarkMetrics{
+		Name:       "Layout_" + name,
+		Category:   "layout",
+		Operations: numKeys * 3,
+		Metrics:    make(map[string]float64),
+	}
+
+	key := make([]byte, keySize)
+	value := make([]byte, valueSize)
+
+	writeStart := time.Now()
+	for i := 0; i < numKeys; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		binary.BigEndian.PutUint64(value, uint64(i))
+		if err := ph.Put(key, value); err != nil {
+			b.Fatalf("Failed to insert key %d: %v", i, err)
+		}
+	}
+	writeTime := time.Since(writeStart)
+	metrics.Metrics["insertion_rate"] = float64(numKeys) / writeTime.Seconds()
+
+	hitStart := time.Now()
+	for i := 0; i < numKeys; i++ {
+		binary.BigEndian.PutUint64(key, uint64((i*31+17)%numKeys))
+		if _, found := ph.Get(key); !found {
+			b.Fatalf("Key %d not found", (i*31+17)%numKeys)
+		}
+	}
+	hitTime := time.Since(hitStart)
+	metrics.Metrics["hit_lookup_rate"] = float64(numKeys) / hitTime.Seconds()
+
+	missStart := time.Now()
+	for i := 0; i < numKeys; i++ {
+		binary.BigEndian.PutUint64(key, uint64(numKeys+i))
+		if _, found := ph.Get(key); found {
+			b.Fatalf("Absent key %d found", numKeys+i)
+		}
+	}
+	missTime := time.Since(missStart)
+	metrics.Metrics["miss_lookup_rate"] = float64(numKeys) / missTime.Seconds()
+
+	fileInfo, err := os.Stat(tempFile)
+	if err != nil {
+		b.Fatalf("Failed to get file stats: %v", err)
+	}
+	metrics.Metrics["bytes_per_key"] = float64(fileInfo.Size()) / float64(numKeys)
+	metrics.NsPerOp = float64(writeTime.Nanoseconds()+hitTime.Nanoseconds()+missTime.Nanoseconds()) / float64(metrics.Operations)
+	metrics.BytesPerOp = int(fileInfo.Size())
+
+	b.Logf("%s: insert %.0f keys/sec, hit %.0f lookups/sec, miss %.0f lookups/sec, %.2f bytes/key",
+		name, metrics.Metrics["insertion_rate"], metrics.Metrics["hit_lookup_rate"],
+		metrics.Metrics["miss_lookup_rate"], metrics.Metrics["bytes_per_key"])
+
+	if err := saveBenchmarkResult(metrics, "latest.json"); err != nil {
+		b.Logf("Failed to save benchmark result to latest.json: %v", err)
+	}
+}
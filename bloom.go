@@ -0,0 +1,298 @@
+package phash
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"syscall"
+)
+
+// With Options.BloomFalsePositive the table keeps a blocked Bloom filter
+// of its keys in filePath + ".bloom", and Get consults it before probing:
+// a key the filter has never seen is a miss without touching the table.
+// Each key sets k bits inside a single 64-byte block, so a check costs one
+// cache line.
+//
+// The filter file is a 64-byte header followed by the blocks:
+//
+//   - Magic (4 bytes): bloomMagic
+//   - Bits Per Key (4 bytes): k
+//   - Blocks (8 bytes): Number of 64-byte blocks
+//   - Table Slots (4 bytes): numSlots of the table the filter was built for
+//   - Dirty (4 bytes): Nonzero while the filter is open for writing
+//
+// The filter is sized for a full table and rebuilt by every resize, so it
+// also sheds the bits of deleted keys then. A table that removes many keys
+// without resizing, such as a cache, rebuilds it in place once removals
+// exceed its size. A filter left dirty by a crash may have lost bits that
+// the table kept and is rebuilt on the next Open.
+const (
+	bloomMagic      uint32 = 0x50484246 // "PHBF"
+	bloomHeaderSize        = 64
+	bloomBlockSize         = 64
+
+	// defaultBloomFP is the rate a compact restore uses for a table that
+	// had a filter, since the backup does not record one.
+	defaultBloomFP = 0.01
+)
+
+// bloomFilter is an open, mapped filter file.
+type bloomFilter struct {
+	file   *os.File
+	data   []byte
+	k      uint32
+	blocks uint64
+}
+
+// BloomStats counts what the Bloom filter did for Gets since the table was
+// opened.
+type BloomStats struct {
+	Checks         uint64 // Gets that consulted the filter
+	Skipped        uint64 // Gets answered by the filter without a probe
+	FalsePositives uint64 // Gets the filter let through that still missed
+}
+
+// BloomStats returns the Bloom filter counters.
+func (ph *PersistentHash) BloomStats() BloomStats {
+	return BloomStats{
+		Checks:         ph.bloomChecks.Load(),
+		Skipped:        ph.bloomSkipped.Load(),
+		FalsePositives: ph.bloomFalse.Load(),
+	}
+}
+
+// bloomGeometry returns the bits per key and block count for a filter of
+// keys entries with false positive rate fp.
+func bloomGeometry(keys uint64, fp float64) (uint32, uint64) {
+	// Blocking costs some accuracy; a tenth more bits makes up for it
+	bitsPerKey := -math.Log(fp) / (math.Ln2 * math.Ln2) * 1.1
+	k := uint32(math.Round(bitsPerKey * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	if k > 16 {
+		k = 16
+	}
+	blocks := uint64(math.Ceil(float64(keys) * bitsPerKey / (bloomBlockSize * 8)))
+	if blocks == 0 {
+		blocks = 1
+	}
+	return k, blocks
+}
+
+// bloomKeys returns how many keys a table of numSlots can hold, which is
+// what its filter is sized for.
+func (ph *PersistentHash) bloomKeys(numSlots uint32) uint32 {
+	if ph.capacity > 0 {
+		return ph.capacity
+	}
+	return uint32(float64(numSlots)*float64(ph.maxLoad)) + 1
+}
+
+// bloomPath returns the name of the filter file.
+func (ph *PersistentHash) bloomPath() string {
+	return ph.filePath + ".bloom"
+}
+
+// bloomFor creates an empty filter at path sized for a table of numSlots.
+func (ph *PersistentHash) bloomFor(path string, numSlots uint32) (*bloomFilter, error) {
+	k, blocks := bloomGeometry(uint64(ph.bloomKeys(numSlots)), float64(ph.bloomFP))
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bloom filter: %w", err)
+	}
+	size := bloomHeaderSize + int64(blocks)*bloomBlockSize
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to size bloom filter: %w", err)
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to mmap bloom filter: %w", err)
+	}
+
+	binary.BigEndian.PutUint32(data[0:4], bloomMagic)
+	binary.BigEndian.PutUint32(data[4:8], k)
+	binary.BigEndian.PutUint64(data[8:16], blocks)
+	binary.BigEndian.PutUint32(data[16:20], numSlots)
+	binary.BigEndian.PutUint32(data[20:24], 1)
+	return &bloomFilter{file: file, data: data, k: k, blocks: blocks}, nil
+}
+
+// openBloom opens the table's filter, rebuilding it if it is missing, was
+// built for another table size, or was not closed cleanly.
+func (ph *PersistentHash) openBloom() error {
+	if b, err := openBloomFile(ph.bloomPath(), ph.numSlots); err == nil {
+		ph.bloom = b
+		return b.markDirty()
+	}
+	return ph.rebuildBloom()
+}
+
+// openBloomFile maps an existing filter, failing unless it was closed
+// cleanly after being built for a table of numSlots.
+func openBloomFile(path string, numSlots uint32) (*bloomFilter, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil || fi.Size() < bloomHeaderSize {
+		file.Close()
+		return nil, errors.New("bad bloom filter")
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(fi.Size()), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	b := &bloomFilter{
+		file:   file,
+		data:   data,
+		k:      binary.BigEndian.Uint32(data[4:8]),
+		blocks: binary.BigEndian.Uint64(data[8:16]),
+	}
+	if binary.BigEndian.Uint32(data[0:4]) != bloomMagic ||
+		binary.BigEndian.Uint32(data[16:20]) != numSlots ||
+		binary.BigEndian.Uint32(data[20:24]) != 0 ||
+		b.k == 0 || b.blocks == 0 ||
+		fi.Size() != bloomHeaderSize+int64(b.blocks)*bloomBlockSize {
+		b.close(false)
+		return nil, errors.New("bad bloom filter")
+	}
+	return b, nil
+}
+
+// rebuildBloom builds a fresh filter from the table's keys and swaps it in.
+func (ph *PersistentHash) rebuildBloom() error {
+	tmpPath := ph.bloomPath() + ".tmp"
+	b, err := ph.bloomFor(tmpPath, ph.numSlots)
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < ph.numSlots; i++ {
+		if ph.occupied(&ph.table, i) {
+			slotStart := ph.base + i*ph.slotSize
+			b.add(ph.hash(ph.data[slotStart+1 : slotStart+1+ph.keySize]))
+		}
+	}
+	if err := os.Rename(tmpPath, ph.bloomPath()); err != nil {
+		b.close(false)
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rename bloom filter: %w", err)
+	}
+	if ph.bloom != nil {
+		ph.bloom.close(false)
+	}
+	ph.bloom = b
+	ph.bloomRemoved = 0
+	return b.file.Sync()
+}
+
+// bloomAdd records a key inserted into t in the live filter and, during a
+// resize, in the filter being built for the new table.
+func (ph *PersistentHash) bloomAdd(t *table, key []byte) {
+	h := ph.hash(key)
+	ph.bloom.add(h)
+	if g := ph.grow; g != nil && t == &g.next {
+		g.bloom.add(h)
+	}
+}
+
+// bloomRemove notes a removal, rebuilding the filter once enough keys have
+// gone that their stale bits hurt it.
+func (ph *PersistentHash) bloomRemove() {
+	ph.bloomRemoved++
+	if ph.grow == nil && ph.bloomRemoved > ph.bloomKeys(ph.numSlots) {
+		// On failure the old filter is still correct, just less sharp
+		ph.rebuildBloom()
+	}
+}
+
+// bloomMiss reports whether the filter rules key out.
+func (ph *PersistentHash) bloomMiss(key []byte) bool {
+	ph.bloomChecks.Add(1)
+	if !ph.bloom.mayContain(ph.hash(key)) {
+		ph.bloomSkipped.Add(1)
+		return true
+	}
+	return false
+}
+
+// locate derives a block and bit positions from a key hash. The hash is
+// remixed so the filter does not correlate with the key's slot.
+func (b *bloomFilter) locate(h uint64) (block []byte, bits uint64) {
+	h = fmix64(h)
+	idx := (h >> 32) * b.blocks >> 32
+	if b.blocks > math.MaxUint32 {
+		idx = h % b.blocks
+	}
+	start := bloomHeaderSize + idx*bloomBlockSize
+	return b.data[start : start+bloomBlockSize], fmix64(h ^ 0x9E3779B97F4A7C15)
+}
+
+func (b *bloomFilter) add(h uint64) {
+	block, bits := b.locate(h)
+	for i := uint32(0); i < b.k; i++ {
+		if i > 0 && i%7 == 0 {
+			bits = fmix64(bits)
+		}
+		pos := bits & 511
+		block[pos>>3] |= 1 << (pos & 7)
+		bits >>= 9
+	}
+}
+
+func (b *bloomFilter) mayContain(h uint64) bool {
+	block, bits := b.locate(h)
+	for i := uint32(0); i < b.k; i++ {
+		if i > 0 && i%7 == 0 {
+			bits = fmix64(bits)
+		}
+		pos := bits & 511
+		if block[pos>>3]&(1<<(pos&7)) == 0 {
+			return false
+		}
+		bits >>= 9
+	}
+	return true
+}
+
+// markDirty flags the filter as open for writing, durably, before the
+// table can change.
+func (b *bloomFilter) markDirty() error {
+	binary.BigEndian.PutUint32(b.data[20:24], 1)
+	return b.file.Sync()
+}
+
+// close unmaps the filter, first marking it clean if it is up to date.
+func (b *bloomFilter) close(clean bool) error {
+	if clean {
+		if err := b.file.Sync(); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint32(b.data[20:24], 0)
+		if err := b.file.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Munmap(b.data); err != nil {
+		return err
+	}
+	return b.file.Close()
+}
+
+// fmix64 is the MurmurHash3 finalizer.
+func fmix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb93fe53a87e5
+	h ^= h >> 33
+	return h
+}
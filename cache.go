@@ -0,0 +1,94 @@
+package phash
+
+import (
+	"errors"
+	"math"
+)
+
+// In cache mode the table never grows. It is created with room for
+// Options.CacheCapacity entries at the load limit, and an insert into a
+// full cache first evicts an entry chosen by CLOCK: a hand sweeps the
+// slots, clearing the reference bit of recently used entries and evicting
+// the first one whose bit is already clear. The reference bit is the top
+// bit of the status byte and is set by every read or update of the entry.
+// The capacity is stored in the header; the hand and the counters are not.
+const refBit byte = 0x80
+
+// CacheStats counts cache activity since the table was opened.
+type CacheStats struct {
+	Hits      uint64 // Gets that found their key
+	Misses    uint64 // Gets that did not
+	Evictions uint64 // entries evicted to make room
+}
+
+// CacheStats returns the hit, miss and eviction counts of a cache table.
+func (ph *PersistentHash) CacheStats() CacheStats {
+	return CacheStats{
+		Hits:      ph.hits.Load(),
+		Misses:    ph.misses.Load(),
+		Evictions: ph.evictions.Load(),
+	}
+}
+
+// cacheSlots returns the number of slots for a new cache table: enough to
+// hold the capacity under the load limit, and always one more so probes
+// for absent keys end.
+func (ph *PersistentHash) cacheSlots() (uint32, error) {
+	maxLoad := ph.opts.MaxLoadFactor
+	if maxLoad <= 0 {
+		maxLoad = ph.layout.defaultMaxLoad()
+	}
+	slots := math.Ceil(float64(ph.capacity)/float64(maxLoad)) + 1
+	if slots > math.MaxUint32 {
+		return 0, errors.New("cache capacity too large")
+	}
+	return uint32(slots), nil
+}
+
+// touch sets the reference bit of the entry in slot idx of t. Gets do this
+// under the read lock; racing readers only ever set the bit, so the worst
+// case is a redundant store.
+func (ph *PersistentHash) touch(t *table, idx uint32) {
+	if ph.capacity == 0 {
+		return
+	}
+	if status := &t.data[t.base+idx*ph.slotSize]; *status&refBit == 0 {
+		*status |= refBit
+	}
+}
+
+// evict advances the CLOCK hand to the next entry without its reference
+// bit and removes it, reporting it to OnEvict.
+func (ph *PersistentHash) evict() error {
+	// Two sweeps clear every reference bit, so a victim is found by then
+	for i := uint32(0); i <= 2*ph.numSlots; i++ {
+		idx := ph.clockHand
+		ph.clockHand = (ph.clockHand + 1) % ph.numSlots
+
+		slotStart := ph.base + idx*ph.slotSize
+		status := ph.data[slotStart]
+		if status&^refBit != 1 {
+			continue
+		}
+		if status&refBit != 0 {
+			ph.data[slotStart] = 1
+			continue
+		}
+
+		field := ph.valueField(ph.data, slotStart)
+		if ph.opts.OnEvict != nil {
+			key, value, err := ph.entryAt(&ph.table, idx)
+			if err != nil {
+				return err
+			}
+			ph.opts.OnEvict(key, value)
+		}
+		if ph.vlog != nil {
+			ph.setLogLive(ph.vlog.live - ph.loggedBytes(field))
+		}
+		ph.removeAt(&ph.table, idx)
+		ph.evictions.Add(1)
+		return nil
+	}
+	return errors.New("no cache entry to evict")
+}
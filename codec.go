@@ -0,0 +1,180 @@
+package phash
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math"
+	"reflect"
+	"unsafe"
+)
+
+// Codec converts values of type T to and from the fixed-size byte slices a
+// PersistentHash stores.
+type Codec[T any] interface {
+	// Size returns the encoded length in bytes, or -1 if T has no
+	// fixed-size encoding.
+	Size() int
+	// Encode writes v into dst, which is exactly Size bytes long.
+	Encode(dst []byte, v T)
+	// Decode reads a value from src, which is exactly Size bytes long.
+	Decode(src []byte) T
+}
+
+// Integer is the set of fixed-width integer types.
+type Integer interface {
+	~int8 | ~int16 | ~int32 | ~int64 | ~uint8 | ~uint16 | ~uint32 | ~uint64
+}
+
+// IntCodec encodes integers big-endian in their natural width.
+type IntCodec[T Integer] struct{}
+
+// Size implements Codec.
+func (IntCodec[T]) Size() int { return int(unsafe.Sizeof(T(0))) }
+
+// Encode implements Codec.
+func (c IntCodec[T]) Encode(dst []byte, v T) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(v))
+	copy(dst, buf[8-c.Size():])
+}
+
+// Decode implements Codec. Conversion from uint64 truncates, which also
+// restores the sign of signed types.
+func (IntCodec[T]) Decode(src []byte) T {
+	var u uint64
+	for _, b := range src {
+		u = u<<8 | uint64(b)
+	}
+	return T(u)
+}
+
+// Float is the set of floating point types.
+type Float interface {
+	~float32 | ~float64
+}
+
+// FloatCodec encodes floats as their IEEE 754 bits, big-endian.
+type FloatCodec[T Float] struct{}
+
+// Size implements Codec.
+func (FloatCodec[T]) Size() int { return int(unsafe.Sizeof(T(0))) }
+
+// Encode implements Codec.
+func (c FloatCodec[T]) Encode(dst []byte, v T) {
+	if c.Size() == 4 {
+		binary.BigEndian.PutUint32(dst, math.Float32bits(float32(v)))
+		return
+	}
+	binary.BigEndian.PutUint64(dst, math.Float64bits(float64(v)))
+}
+
+// Decode implements Codec.
+func (c FloatCodec[T]) Decode(src []byte) T {
+	if c.Size() == 4 {
+		return T(math.Float32frombits(binary.BigEndian.Uint32(src)))
+	}
+	return T(math.Float64frombits(binary.BigEndian.Uint64(src)))
+}
+
+// ArrayCodec stores byte arrays such as [32]byte as is. T must be an array
+// type with byte elements; for any other type Size reports -1.
+type ArrayCodec[T any] struct{}
+
+// Size implements Codec.
+func (ArrayCodec[T]) Size() int {
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	if typ.Kind() != reflect.Array || typ.Elem().Kind() != reflect.Uint8 {
+		return -1
+	}
+	return typ.Len()
+}
+
+// Encode implements Codec.
+func (ArrayCodec[T]) Encode(dst []byte, v T) {
+	reflect.Copy(reflect.ValueOf(dst), reflect.ValueOf(v))
+}
+
+// Decode implements Codec.
+func (ArrayCodec[T]) Decode(src []byte) T {
+	var v T
+	reflect.Copy(reflect.ValueOf(&v).Elem(), reflect.ValueOf(src))
+	return v
+}
+
+// UUID is a 16-byte universally unique identifier.
+type UUID [16]byte
+
+// ParseUUID parses the canonical 8-4-4-4-12 hex form of a UUID.
+func ParseUUID(s string) (UUID, error) {
+	var u UUID
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return u, errors.New("invalid UUID format")
+	}
+	digits := s[0:8] + s[9:13] + s[14:18] + s[19:23] + s[24:36]
+	if _, err := hex.Decode(u[:], []byte(digits)); err != nil {
+		return u, errors.New("invalid UUID format")
+	}
+	return u, nil
+}
+
+// String returns the canonical 8-4-4-4-12 hex form of u.
+func (u UUID) String() string {
+	s := hex.EncodeToString(u[:])
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:32]
+}
+
+// UUIDCodec stores UUIDs as their 16 raw bytes.
+type UUIDCodec struct{}
+
+// Size implements Codec.
+func (UUIDCodec) Size() int { return 16 }
+
+// Encode implements Codec.
+func (UUIDCodec) Encode(dst []byte, v UUID) { copy(dst, v[:]) }
+
+// Decode implements Codec.
+func (UUIDCodec) Decode(src []byte) (v UUID) {
+	copy(v[:], src)
+	return v
+}
+
+// StructCodec stores structs (or any other type) that encoding/binary can
+// encode at a fixed size: numbers, bools, arrays and structs of those, with
+// no slices, strings, maps or pointers. Fields are big-endian. For other
+// types Size reports -1.
+type StructCodec[T any] struct{}
+
+// Size implements Codec.
+func (StructCodec[T]) Size() int {
+	var v T
+	return binary.Size(&v)
+}
+
+// Encode implements Codec. Like the other codecs it panics if dst is too
+// short, and it panics if T cannot be encoded.
+func (StructCodec[T]) Encode(dst []byte, v T) {
+	n := binary.Size(&v)
+	if n < 0 {
+		panic("phash: StructCodec cannot encode " + reflect.TypeOf(&v).Elem().String())
+	}
+	if len(dst) < n {
+		panic("phash: StructCodec.Encode: destination too short")
+	}
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, &v); err != nil {
+		panic("phash: StructCodec.Encode: " + err.Error())
+	}
+	copy(dst, buf.Bytes())
+}
+
+// Decode implements Codec. It panics if src is too short or T cannot be
+// decoded.
+func (StructCodec[T]) Decode(src []byte) T {
+	var v T
+	if err := binary.Read(bytes.NewReader(src), binary.BigEndian, &v); err != nil {
+		panic("phash: StructCodec.Decode: " + err.Error())
+	}
+	return v
+}
@@ -0,0 +1,289 @@
+package phash
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// With Options.Compress every record in the value log starts with a codec
+// byte saying how the value was stored:
+//
+//   - codecRaw: the value as is
+//   - codecTrimmed: its length (4 bytes), then the value without its
+//     trailing zero bytes
+//   - codecFlate: its length (4 bytes), then the value without its
+//     trailing zeros, deflated with the table's dictionary if it has one
+//
+// Values shorter than the threshold are stored raw; longer ones take the
+// smallest of the three. The slot pointer's length is the record's, so
+// ValueLogSize counts stored bytes. The header holds a CRC-32 of the
+// dictionary, so a file is never read with the wrong one.
+//
+// Without ValueLog the records go in the slots, whose value field shrinks
+// to Options.CompressSlotSize and holds:
+//
+//   - Length (4 bytes): Length of the record, or spilledValue
+//   - Record: The record, zero padded to the end of the field; for a
+//     spilled value, a value log pointer to a record that did not fit
+//
+// The header keeps the caller's value size next to the field's.
+const (
+	codecRaw byte = iota
+	codecTrimmed
+	codecFlate
+)
+
+// spilledValue is the length of a slot record stored in the value log.
+const spilledValue = math.MaxUint32
+
+// CompressionStats counts the values written to a compressed table since
+// it was opened.
+type CompressionStats struct {
+	Values      uint64 // values written
+	Compressed  uint64 // values stored trimmed or deflated
+	Spilled     uint64 // values too large for their slot, stored in the value log
+	RawBytes    uint64 // total length of the values written
+	StoredBytes uint64 // total length of their records, or of their slot fields and spilled records
+}
+
+// Ratio returns RawBytes / StoredBytes, or 1 before anything is written.
+func (s CompressionStats) Ratio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+	return float64(s.RawBytes) / float64(s.StoredBytes)
+}
+
+// CompressionStats returns the compression counters. They are zero for a
+// table without Options.Compress.
+func (ph *PersistentHash) CompressionStats() CompressionStats {
+	ph.mu.RLock()
+	defer ph.mu.RUnlock()
+
+	if ph.vlog == nil || ph.vlog.codec == nil {
+		return CompressionStats{}
+	}
+	c := ph.vlog.codec
+	return CompressionStats{
+		Values:      c.values.Load(),
+		Compressed:  c.compressed.Load(),
+		Spilled:     c.spilled.Load(),
+		RawBytes:    c.raw.Load(),
+		StoredBytes: c.stored.Load(),
+	}
+}
+
+// compressor encodes and decodes value log records.
+type compressor struct {
+	threshold int
+	dict      []byte
+
+	// w and buf are only used by encode, which runs under the write lock
+	w   *flate.Writer
+	buf bytes.Buffer
+
+	readers sync.Pool // of io.ReadCloser from flate.NewReaderDict
+
+	values, compressed, spilled, raw, stored atomic.Uint64
+}
+
+// dictChecksum is what the header records for dict.
+func dictChecksum(dict []byte) uint32 {
+	return crc32.ChecksumIEEE(dict)
+}
+
+// newCompressor returns the compressor of a table with the given options.
+func newCompressor(opts *Options) (*compressor, error) {
+	c := &compressor{threshold: opts.CompressThreshold, dict: opts.CompressDict}
+	// Values are small, and below BestCompression deflate finds few of
+	// the dictionary's matches in them
+	w, err := flate.NewWriterDict(&c.buf, flate.BestCompression, c.dict)
+	if err != nil {
+		return nil, err
+	}
+	c.w = w
+	return c, nil
+}
+
+// encode returns the record for value.
+func (c *compressor) encode(value []byte) ([]byte, error) {
+	rec := append([]byte{codecRaw}, value...)
+	if len(value) >= c.threshold {
+		if uint64(len(value)) > math.MaxUint32 {
+			return nil, errors.New("value too large for value log")
+		}
+		trimmed := bytes.TrimRight(value, "\x00")
+
+		c.buf.Reset()
+		c.w.Reset(&c.buf)
+		if _, err := c.w.Write(trimmed); err != nil {
+			return nil, err
+		}
+		if err := c.w.Close(); err != nil {
+			return nil, err
+		}
+
+		codec, body := codecTrimmed, trimmed
+		if c.buf.Len() < len(trimmed) {
+			codec, body = codecFlate, c.buf.Bytes()
+		}
+		if 5+len(body) < len(rec) {
+			rec = make([]byte, 5, 5+len(body))
+			rec[0] = codec
+			binary.BigEndian.PutUint32(rec[1:5], uint32(len(value)))
+			rec = append(rec, body...)
+		}
+	}
+	return rec, nil
+}
+
+// count adds a value written to the stats, taking stored bytes for its
+// record rec.
+func (c *compressor) count(value, rec []byte, stored int) {
+	c.values.Add(1)
+	if rec[0] != codecRaw {
+		c.compressed.Add(1)
+	}
+	c.raw.Add(uint64(len(value)))
+	c.stored.Add(uint64(stored))
+}
+
+// decode returns the value stored in rec.
+func (c *compressor) decode(rec []byte) ([]byte, error) {
+	if len(rec) == 0 {
+		return nil, errors.New("empty value log record")
+	}
+	if rec[0] == codecRaw {
+		return rec[1:], nil
+	}
+	if len(rec) < 5 {
+		return nil, errors.New("truncated value log record")
+	}
+	value := make([]byte, binary.BigEndian.Uint32(rec[1:5]))
+	body := rec[5:]
+
+	switch rec[0] {
+	case codecTrimmed:
+		if len(body) > len(value) {
+			return nil, errors.New("corrupt value log record")
+		}
+		copy(value, body)
+	case codecFlate:
+		r, _ := c.readers.Get().(io.ReadCloser)
+		if r == nil {
+			r = flate.NewReaderDict(bytes.NewReader(body), c.dict)
+		} else if err := r.(flate.Resetter).Reset(bytes.NewReader(body), c.dict); err != nil {
+			return nil, err
+		}
+		_, err := io.ReadFull(r, value)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = nil // the rest was trailing zeros
+		}
+		c.readers.Put(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inflate value: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown value codec %d", rec[0])
+	}
+	return value, nil
+}
+
+// initSlotCompression sizes the value field of a new table that compresses
+// values into its slots.
+func (ph *PersistentHash) initSlotCompression() error {
+	if int(ph.valueSize) < ph.opts.CompressThreshold {
+		return fmt.Errorf("%d-byte values are below CompressThreshold", ph.valueSize)
+	}
+	size := ph.opts.CompressSlotSize
+	if size <= 0 {
+		size = int(ph.valueSize) / 4
+	}
+	if size < 4+valuePointerSize {
+		size = 4 + valuePointerSize
+	}
+	// A raw record always fits
+	if max := int(ph.valueSize) + 5; size > max {
+		size = max
+	}
+	ph.plainValueSize = ph.valueSize
+	ph.valueSize = uint32(size)
+	return nil
+}
+
+// compressValue returns the slot field for value, spilling its record to
+// the value log if it does not fit.
+func (ph *PersistentHash) compressValue(value []byte) ([]byte, error) {
+	c := ph.vlog.codec
+	rec, err := c.encode(value)
+	if err != nil {
+		return nil, err
+	}
+	size := ph.valueSize
+	if ph.flags&flagTTL != 0 {
+		size -= expirySize
+	}
+	field := make([]byte, size)
+	if 4+len(rec) <= len(field) {
+		binary.BigEndian.PutUint32(field[0:4], uint32(len(rec)))
+		copy(field[4:], rec)
+		c.count(value, rec, len(field))
+		return field, nil
+	}
+
+	ptr, err := ph.vlog.appendRecord(rec)
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(field[0:4], spilledValue)
+	copy(field[4:], ptr)
+	c.count(value, rec, len(field)+len(rec))
+	c.spilled.Add(1)
+	return field, nil
+}
+
+// decompressValue returns a copy of the value in a slot field.
+func (ph *PersistentHash) decompressValue(field []byte) ([]byte, error) {
+	n := binary.BigEndian.Uint32(field[0:4])
+	if n == spilledValue {
+		return ph.vlog.read(field[4:])
+	}
+	if int64(n) > int64(len(field)-4) {
+		return nil, errors.New("corrupt compressed slot")
+	}
+	// A raw record decodes in place, and field is the mapping
+	return ph.vlog.codec.decode(append([]byte(nil), field[4:4+n]...))
+}
+
+// moveValue returns a slot's value field with the record it refers to, if
+// any, copied from old to the table's value log. Records are copied as
+// they are, without recompressing.
+func (ph *PersistentHash) moveValue(old *valueLog, field []byte) ([]byte, error) {
+	ptr := field
+	if ph.flags&flagValueLog == 0 {
+		if binary.BigEndian.Uint32(field[0:4]) != spilledValue {
+			return field, nil
+		}
+		ptr = field[4:]
+	}
+	rec, err := old.readRecord(ptr)
+	if err != nil {
+		return nil, err
+	}
+	moved, err := ph.vlog.appendRecord(rec)
+	if err != nil {
+		return nil, err
+	}
+	// Keep the rest of the field, such as an expiry
+	out := append([]byte(nil), field...)
+	copy(out[len(field)-len(ptr):], moved)
+	return out, nil
+}
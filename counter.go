@@ -0,0 +1,108 @@
+package phash
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Add adds delta to the counter stored under key and returns the new
+// value. Counters are 8-byte big-endian two's complement values, so the
+// table must have been opened with a valueSize of 8 and without ValueLog.
+// A missing key counts from zero. The counter is updated in place in the
+// mapping with a single probe and no allocation; it wraps on overflow.
+func (ph *PersistentHash) Add(key []byte, delta int64) (int64, error) {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	n, err := ph.addLocked(key, uint64(delta))
+	return int64(n), err
+}
+
+// AddUint64 is Add for unsigned counters.
+func (ph *PersistentHash) AddUint64(key []byte, delta uint64) (uint64, error) {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	return ph.addLocked(key, delta)
+}
+
+// AddMany adds deltas[i] to the counter under keys[i] for every i, under a
+// single acquisition of the write lock. The table is grown up front so the
+// call resizes at most once. Keys are checked before any counter changes,
+// but unlike Write the updates are not atomic across a crash.
+func (ph *PersistentHash) AddMany(keys [][]byte, deltas []int64) error {
+	if len(keys) != len(deltas) {
+		return errors.New("keys and deltas differ in length")
+	}
+
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	if err := ph.checkCounters(); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, ok := ph.encodeKey(key); !ok {
+			return errors.New("invalid key/value size")
+		}
+	}
+	if err := ph.reserve(len(keys)); err != nil {
+		return err
+	}
+	for i, key := range keys {
+		if _, err := ph.addLocked(key, uint64(deltas[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCounters reports whether the table's values can hold counters.
+func (ph *PersistentHash) checkCounters() error {
+	if ph.vlog != nil || ph.crypt != nil || ph.userValueSize() != 8 {
+		return errors.New("counters need 8-byte unencrypted values stored in the table")
+	}
+	return nil
+}
+
+// addLocked adds delta to the counter under key.
+func (ph *PersistentHash) addLocked(key []byte, delta uint64) (uint64, error) {
+	if err := ph.checkCounters(); err != nil {
+		return 0, err
+	}
+	enc, ok := ph.encodeKey(key)
+	if !ok {
+		return 0, errors.New("invalid key/value size")
+	}
+
+	t, idx, found := ph.lookup(enc)
+	n := delta
+	var expiry int64
+	if found {
+		slotStart := t.base + idx*ph.slotSize
+		field := ph.valueField(t.data, slotStart)
+		counter, exp := ph.splitExpiry(field)
+
+		// An expired counter restarts from zero, without the expiry
+		if !expired(exp) {
+			n += binary.BigEndian.Uint64(counter)
+			expiry = exp
+		}
+
+		// During a resize every write goes through growPut, which logs it
+		if ph.grow == nil {
+			binary.BigEndian.PutUint64(counter, n)
+			if expiry != exp {
+				binary.BigEndian.PutUint64(field[8:], 0)
+			}
+			ph.touch(t, idx)
+			return n, nil
+		}
+	}
+
+	value := ph.appendExpiry(binary.BigEndian.AppendUint64(nil, n), expiry)
+	if err := ph.storeUpdate(t, idx, found, key, enc, value); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,131 @@
+package phash
+
+// Bucketized cuckoo hashing - https://www.cs.princeton.edu/~mfreed/docs/cuckoo-eurosys14.pdf
+// A key may live in any of the 4 slots of its two buckets. When both are
+// full, a breadth-first search looks for the shortest chain of entries that
+// can each move to their other bucket, ending at a bucket with a free slot.
+// Nothing is moved unless such a chain is found.
+//
+// Slots are padded to a multiple of cuSlotAlign bytes, so with the slots
+// starting on a 64-byte boundary every bucket starts on a cache line and
+// spans as few lines as its slots allow.
+const (
+	cuWays      = 4
+	cuSlotAlign = 64 / cuWays
+
+	// cuMaxSearch caps the buckets visited by the search before giving up
+	// and resizing instead.
+	cuMaxSearch = 512
+)
+
+// cuBuckets returns the two candidate buckets for a hash. The second is
+// derived by remixing the hash, so it works for 32-bit hash functions too.
+func cuBuckets(h uint64, numBuckets uint32) (uint32, uint32) {
+	b1 := uint32(h % uint64(numBuckets))
+
+	m := (h ^ (h >> 31)) * 0x9e3779b97f4a7c15
+	m ^= m >> 29
+	b2 := uint32(m % uint64(numBuckets))
+	if b2 == b1 {
+		b2 = (b1 + 1) % numBuckets
+	}
+	return b1, b2
+}
+
+// cuFind checks both buckets for key. On a miss the hint is the first free
+// slot among them, or the first slot of the first bucket when both are full.
+func (ph *PersistentHash) cuFind(t *table, key []byte) (uint32, bool) {
+	b1, b2 := cuBuckets(ph.hash(key), t.numSlots/cuWays)
+	free := t.numSlots
+
+	for _, b := range [2]uint32{b1, b2} {
+		for idx := b * cuWays; idx < (b+1)*cuWays; idx++ {
+			slotStart := t.base + idx*ph.slotSize
+			if t.data[slotStart] != 1 {
+				if free == t.numSlots {
+					free = idx
+				}
+				continue
+			}
+			if ph.keyEqual(t.data[slotStart+1:slotStart+1+ph.keySize], key) {
+				return idx, true
+			}
+		}
+	}
+
+	if free == t.numSlots {
+		free = b1 * cuWays
+	}
+	return free, false
+}
+
+// cuNode is a bucket visited by the displacement search. The entry in
+// slot from of the parent bucket would move into it.
+type cuNode struct {
+	bucket uint32
+	parent int
+	from   uint32
+}
+
+// cuInsert stores key in the free slot hint, or makes room by moving
+// entries along the shortest displacement path.
+func (ph *PersistentHash) cuInsert(t *table, hint uint32, key, value []byte) error {
+	if t.data[t.base+hint*ph.slotSize] != 1 {
+		ph.insertAt(t, hint, key, value)
+		return nil
+	}
+
+	numBuckets := t.numSlots / cuWays
+	b1, b2 := cuBuckets(ph.hash(key), numBuckets)
+	queue := []cuNode{{bucket: b1, parent: -1}, {bucket: b2, parent: -1}}
+
+	for head := 0; head < len(queue); head++ {
+		node := queue[head]
+
+		for idx := node.bucket * cuWays; idx < (node.bucket+1)*cuWays; idx++ {
+			if t.data[t.base+idx*ph.slotSize] == 1 {
+				continue
+			}
+
+			// Found room: shift entries down the path, freeing a slot in
+			// one of the key's own buckets.
+			for n := node; n.parent >= 0; n = queue[n.parent] {
+				dst := t.base + idx*ph.slotSize
+				src := t.base + n.from*ph.slotSize
+				copy(t.data[dst:dst+ph.slotSize], t.data[src:src+ph.slotSize])
+				idx = n.from
+			}
+			t.data[t.base+idx*ph.slotSize] = 0
+			ph.insertAt(t, idx, key, value)
+			return nil
+		}
+
+		if len(queue) >= cuMaxSearch {
+			continue
+		}
+		for idx := node.bucket * cuWays; idx < (node.bucket+1)*cuWays; idx++ {
+			slotStart := t.base + idx*ph.slotSize
+			a1, a2 := cuBuckets(ph.hash(t.data[slotStart+1:slotStart+1+ph.keySize]), numBuckets)
+			alt := a1
+			if alt == node.bucket {
+				alt = a2
+			}
+			if !cuOnPath(queue, head, alt) {
+				queue = append(queue, cuNode{bucket: alt, parent: head, from: idx})
+			}
+		}
+	}
+
+	return errProbeTooLong
+}
+
+// cuOnPath reports whether bucket already appears on the path ending at
+// queue[i], which would make an entry move twice.
+func cuOnPath(queue []cuNode, i int, bucket uint32) bool {
+	for ; i >= 0; i = queue[i].parent {
+		if queue[i].bucket == bucket {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,496 @@
+package phash
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// A DB file holds several named tables, each with its own key size, value
+// size and options, behind one descriptor. It starts with a directory:
+//
+//   - Magic (4 bytes): dbMagic
+//   - Version (4 bytes): Format version, currently 1
+//   - Reserved (120 bytes)
+//   - Entries (63 × 128 bytes): One per table, unused ones all zero
+//
+// Each entry is the table's region offset (8 bytes) and length (8 bytes)
+// followed by its name, zero padded to 112 bytes. An entry fits in one
+// sector, so it changes atomically.
+//
+// A region holds an ordinary table, header and slots, at a page aligned
+// offset. A table resizes independently: the new table is built in a free
+// region, and rewriting the directory entry takes the place of the rename
+// a standalone file does, so a crash leaves either the old or the new
+// region in the directory. Space not named by any entry is free and is
+// reused by later regions.
+//
+// Companion files, such as a value log or a Bloom filter, are kept next
+// to the DB file under path + "." + name.
+const (
+	dbMagic      uint32 = 0x50484442 // "PHDB"
+	dbVersion    uint32 = 1
+	dbHeaderSize        = 128
+	dbEntrySize         = 128
+	dbMaxTables         = 63
+	dbDirSize           = dbHeaderSize + dbMaxTables*dbEntrySize
+
+	// MaxTableName is the longest table name a DB accepts.
+	MaxTableName = dbEntrySize - 16
+)
+
+// DB is a file of named tables. Tables are opened with Table or
+// CreateTable and stay open until they or the DB are closed.
+type DB struct {
+	// openMu serializes opening, creating, dropping and closing tables.
+	// It is taken before any table's lock, and mu after.
+	openMu sync.Mutex
+	mu     sync.Mutex
+
+	path string
+	file *os.File
+	opts *Options
+	size int64 // file size
+
+	entries  [dbMaxTables]dbEntry
+	reserved map[int64]int64 // regions allocated but not yet in the directory
+	tables   map[string]*PersistentHash
+}
+
+// dbEntry is a directory entry; an empty name marks it unused.
+type dbEntry struct {
+	name           string
+	offset, length int64
+}
+
+// OpenDB creates or opens a DB file. opts is used to open existing tables
+// by name unless Table is given options of its own.
+func OpenDB(path string, opts *Options) (*DB, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	db := &DB{
+		path:     path,
+		file:     file,
+		opts:     opts,
+		size:     fi.Size(),
+		reserved: make(map[int64]int64),
+		tables:   make(map[string]*PersistentHash),
+	}
+
+	if db.size == 0 {
+		dir := make([]byte, dbDirSize)
+		binary.BigEndian.PutUint32(dir[0:4], dbMagic)
+		binary.BigEndian.PutUint32(dir[4:8], dbVersion)
+		if _, err := file.WriteAt(dir, 0); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to write directory: %w", err)
+		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to sync directory: %w", err)
+		}
+		db.size = dbDirSize
+		return db, nil
+	}
+
+	if err := db.readDir(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// readDir loads the directory of an existing DB file.
+func (db *DB) readDir() error {
+	dir := make([]byte, dbDirSize)
+	if _, err := db.file.ReadAt(dir, 0); err != nil {
+		return fmt.Errorf("failed to read directory: %w", err)
+	}
+	if binary.BigEndian.Uint32(dir[0:4]) != dbMagic {
+		return errors.New("invalid magic number")
+	}
+	if v := binary.BigEndian.Uint32(dir[4:8]); v != dbVersion {
+		return fmt.Errorf("unsupported DB version %d", v)
+	}
+
+	for i := range db.entries {
+		raw := dir[dbHeaderSize+i*dbEntrySize : dbHeaderSize+(i+1)*dbEntrySize]
+		e := dbEntry{
+			offset: int64(binary.BigEndian.Uint64(raw[0:8])),
+			length: int64(binary.BigEndian.Uint64(raw[8:16])),
+		}
+		if n := bytes.IndexByte(raw[16:], 0); n != 0 {
+			if n < 0 {
+				n = MaxTableName
+			}
+			e.name = string(raw[16 : 16+n])
+			if e.offset < dbDirSize || e.offset+e.length > db.size {
+				return fmt.Errorf("table %q lies outside the file", e.name)
+			}
+		}
+		db.entries[i] = e
+	}
+	return nil
+}
+
+// writeEntry stores directory entry i and syncs it to disk.
+func (db *DB) writeEntry(i int, e dbEntry) error {
+	raw := make([]byte, dbEntrySize)
+	binary.BigEndian.PutUint64(raw[0:8], uint64(e.offset))
+	binary.BigEndian.PutUint64(raw[8:16], uint64(e.length))
+	copy(raw[16:], e.name)
+	if _, err := db.file.WriteAt(raw, int64(dbHeaderSize+i*dbEntrySize)); err != nil {
+		return fmt.Errorf("failed to write directory: %w", err)
+	}
+	if err := db.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	db.entries[i] = e
+	return nil
+}
+
+// find returns the index of the entry named name, or -1.
+func (db *DB) find(name string) int {
+	for i, e := range db.entries {
+		if e.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Tables returns the names of the tables in the DB, sorted.
+func (db *DB) Tables() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var names []string
+	for _, e := range db.entries {
+		if e.name != "" {
+			names = append(names, e.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Table opens the table called name with opts, or with the DB's options if
+// opts is nil. A table created with a Hasher or Encryption needs them
+// again, so a DB mixing such tables with others opens each with its own.
+// Opening a table that is already open returns the same PersistentHash.
+func (db *DB) Table(name string, opts *Options) (*PersistentHash, error) {
+	db.openMu.Lock()
+	defer db.openMu.Unlock()
+
+	db.mu.Lock()
+	if db.file == nil {
+		db.mu.Unlock()
+		return nil, errors.New("DB is closed")
+	}
+	if ph, ok := db.tables[name]; ok {
+		db.mu.Unlock()
+		return ph, nil
+	}
+	i := db.find(name)
+	if name == "" || i < 0 {
+		db.mu.Unlock()
+		return nil, fmt.Errorf("no table %q", name)
+	}
+	e := db.entries[i]
+	db.mu.Unlock()
+
+	data, err := syscall.Mmap(int(db.file.Fd()), e.offset, int(e.length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("mmap failed: %w", err)
+	}
+	if opts == nil {
+		opts = db.opts
+	}
+	ph := db.newTable(name, opts)
+	if err := ph.attach(db.file, data); err != nil {
+		syscall.Munmap(data)
+		return nil, err
+	}
+	ph.offset = e.offset
+	return db.register(ph), nil
+}
+
+// CreateTable adds a table called name with the given geometry and
+// options, as OpenWithOptions would for a new file, and opens it.
+func (db *DB) CreateTable(name string, keySize, valueSize uint32, opts *Options) (*PersistentHash, error) {
+	if name == "" || len(name) > MaxTableName || strings.ContainsAny(name, "/\x00") {
+		return nil, fmt.Errorf("invalid table name %q", name)
+	}
+
+	db.openMu.Lock()
+	defer db.openMu.Unlock()
+
+	db.mu.Lock()
+	if db.file == nil {
+		db.mu.Unlock()
+		return nil, errors.New("DB is closed")
+	}
+	if db.find(name) >= 0 {
+		db.mu.Unlock()
+		return nil, fmt.Errorf("table %q already exists", name)
+	}
+	slot := db.find("")
+	db.mu.Unlock()
+	if slot < 0 {
+		return nil, fmt.Errorf("DB already holds %d tables", dbMaxTables)
+	}
+
+	ph := db.newTable(name, opts)
+	ph.keySize = keySize
+	ph.valueSize = valueSize
+	if err := ph.initFormat(); err != nil {
+		return nil, err
+	}
+	numSlots, err := ph.initialSlots()
+	if err != nil {
+		return nil, err
+	}
+	t, err := db.newRegion(ph, numSlots)
+	if err != nil {
+		return nil, err
+	}
+
+	// Companion files left by an earlier table of the same name are stale
+	removeCompanions(ph.filePath)
+	if err := ph.attach(db.file, t.data); err != nil {
+		ph.dropTable(&t)
+		return nil, err
+	}
+	ph.offset = t.offset
+
+	db.mu.Lock()
+	err = db.writeEntry(slot, dbEntry{name: name, offset: t.offset, length: int64(len(t.data))})
+	if err == nil {
+		delete(db.reserved, t.offset)
+	}
+	db.mu.Unlock()
+	if err != nil {
+		if ph.bloom != nil {
+			ph.bloom.close(false)
+		}
+		ph.closeLogs()
+		ph.dropTable(&t)
+		return nil, err
+	}
+	return db.register(ph), nil
+}
+
+// DropTable deletes the table called name and its companion files. The
+// table must not be open.
+func (db *DB) DropTable(name string) error {
+	db.openMu.Lock()
+	defer db.openMu.Unlock()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.tables[name]; ok {
+		return fmt.Errorf("table %q is open", name)
+	}
+	i := db.find(name)
+	if name == "" || i < 0 {
+		return fmt.Errorf("no table %q", name)
+	}
+	if err := db.writeEntry(i, dbEntry{}); err != nil {
+		return err
+	}
+	removeCompanions(db.path + "." + name)
+	db.trim()
+	return nil
+}
+
+// Close closes every open table and then the DB file.
+func (db *DB) Close() error {
+	db.openMu.Lock()
+	defer db.openMu.Unlock()
+
+	db.mu.Lock()
+	open := make([]*PersistentHash, 0, len(db.tables))
+	for _, ph := range db.tables {
+		open = append(open, ph)
+	}
+	db.mu.Unlock()
+
+	var err error
+	for _, ph := range open {
+		if cerr := ph.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.file == nil {
+		return err
+	}
+	if cerr := db.file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	db.file = nil
+	return err
+}
+
+// newTable returns an unopened table of the DB.
+func (db *DB) newTable(name string, opts *Options) *PersistentHash {
+	return &PersistentHash{
+		id:       lastID.Add(1),
+		filePath: db.path + "." + name,
+		opts:     opts.withDefaults(),
+		db:       db,
+		name:     name,
+	}
+}
+
+// register records an attached table as open and starts its reaper.
+func (db *DB) register(ph *PersistentHash) *PersistentHash {
+	db.mu.Lock()
+	db.tables[ph.name] = ph
+	db.mu.Unlock()
+	ph.startReaper()
+	return ph
+}
+
+// detach forgets a table that has been closed.
+func (db *DB) detach(ph *PersistentHash) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.tables, ph.name)
+}
+
+// newRegion allocates and maps an empty table of numSlots for ph. The
+// region stays reserved until moveRegion or freeRegion.
+func (db *DB) newRegion(ph *PersistentHash, numSlots uint32) (table, error) {
+	size := int64(ph.slotsBase(numSlots) + numSlots*ph.slotSize)
+	offset, err := db.alloc(size)
+	if err != nil {
+		return table{}, err
+	}
+
+	data, err := syscall.Mmap(int(db.file.Fd()), offset, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		db.freeRegion(offset)
+		return table{}, fmt.Errorf("mmap failed: %w", err)
+	}
+	// A reused region still holds an old table
+	for i := range data {
+		data[i] = 0
+	}
+	copy(data, ph.headerBytes(numSlots))
+
+	return table{
+		base:     ph.slotsBase(numSlots),
+		offset:   offset,
+		file:     db.file,
+		data:     data,
+		numSlots: numSlots,
+	}, nil
+}
+
+// moveRegion points ph's directory entry at its current table after a
+// resize. The old region needs no bookkeeping: once no entry names it, it
+// is free.
+func (db *DB) moveRegion(ph *PersistentHash) error {
+	// The new table must be on disk before the directory names it
+	if err := db.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync: %w", err)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	i := db.find(ph.name)
+	if i < 0 {
+		return fmt.Errorf("no table %q", ph.name)
+	}
+	e := dbEntry{name: ph.name, offset: ph.offset, length: int64(len(ph.data))}
+	if err := db.writeEntry(i, e); err != nil {
+		return err
+	}
+	delete(db.reserved, ph.offset)
+	db.trim()
+	return nil
+}
+
+// freeRegion gives back a reserved region that was never used.
+func (db *DB) freeRegion(offset int64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.reserved, offset)
+	db.trim()
+}
+
+// alloc reserves a page aligned region of at least size bytes, reusing
+// the first gap between regions that is large enough.
+func (db *DB) alloc(size int64) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	page := int64(os.Getpagesize())
+	size = (size + page - 1) / page * page
+
+	offset := (int64(dbDirSize) + page - 1) / page * page
+	for _, r := range db.regions() {
+		if r.offset-offset >= size {
+			break
+		}
+		if end := (r.offset + r.length + page - 1) / page * page; end > offset {
+			offset = end
+		}
+	}
+
+	if offset+size > db.size {
+		if err := db.file.Truncate(offset + size); err != nil {
+			return 0, fmt.Errorf("failed to grow DB file: %w", err)
+		}
+		db.size = offset + size
+	}
+	db.reserved[offset] = size
+	return offset, nil
+}
+
+// regions returns every region in use, in file order.
+func (db *DB) regions() []dbEntry {
+	var rs []dbEntry
+	for _, e := range db.entries {
+		if e.name != "" {
+			rs = append(rs, e)
+		}
+	}
+	for offset, length := range db.reserved {
+		rs = append(rs, dbEntry{offset: offset, length: length})
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].offset < rs[j].offset })
+	return rs
+}
+
+// trim shrinks the file to end with the last region in use.
+func (db *DB) trim() {
+	end := int64(dbDirSize)
+	for _, r := range db.regions() {
+		if r.offset+r.length > end {
+			end = r.offset + r.length
+		}
+	}
+	if end < db.size && db.file.Truncate(end) == nil {
+		db.size = end
+	}
+}
@@ -30,14 +30,60 @@ Basic usage:
 		fmt.Println("Value:", val)
 	}
 
+TypedMap does the encoding through a pair of codecs, which also fix the key
+and value sizes:
+
+	m, err := phash.OpenTyped[uint64, float64]("prices.phash",
+		phash.IntCodec[uint64]{}, phash.FloatCodec[float64]{}, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer m.Close()
+
+	err = m.Put(12345, 678.9)
+	price, ok := m.Get(12345)
+
 Features:
 
-  - Fixed-size keys and values for optimal performance
+  - Fixed-size keys and values for optimal performance, or variable-length
+    values kept in an append-only value log
+  - Optional variable-length keys, stored inline up to a prefix length and
+    in an overflow file beyond it
+  - Iteration over all entries with ForEach
+  - PutIfAbsent, CompareAndSwap, GetOrPut and Update for read-modify-write
+    under one lock acquisition and one probe
+  - In-place 8-byte counters with Add, AddUint64 and AddMany
+  - Atomic batches of Puts and Deletes, made crash safe by a write-ahead
+    log and applied with at most one resize
+  - Optimistic transactions with read-your-writes, spanning one or more
+    hashes
+  - Per-key TTLs with a background reaper that frees expired slots
+  - Fixed-capacity cache mode with CLOCK eviction and hit/miss counters
+  - An optional on-disk Bloom filter that lets Get skip the probe for
+    most absent keys
+  - Several named tables, each with its own geometry, in one DB file
+  - In-memory tables on an anonymous mapping, saved to a file with SaveTo
+  - madvise hints, huge pages, prefaulting, mlock and a background Warmup
+  - At-rest encryption: HMAC slot keys, AES-GCM sealed entries, key rotation
+  - Value log compression: zero-suffix trimming or deflate with a dictionary
+  - Point-in-time snapshots for long scans that do not block writers
+  - Online, checksummed backups (full image or compacted) and Restore
+  - PersistentSet: bitmap-indexed key-only files with Union and Intersect
+  - MultiMap: several values per key with Append, GetAll and RemoveValue
+  - Generic TypedMap with codecs for integers, floats, byte arrays, UUIDs
+    and fixed-size structs
   - Memory-mapped file storage for persistence and fast access
   - Thread-safe with read/write mutex
   - Automatic resizing when load factor exceeds 0.7
-  - Uses FNV-1a hashing algorithm for good distribution
-  - Open addressing with linear probing for collision resolution
+  - Optional incremental or background resizing so no single Put pays for the rehash
+  - FNV-1a hashing by default, with seeded xxHash64, wyhash and SipHash-2-4
+    options for keys an attacker can choose
+  - Open addressing with linear probing for collision resolution, or Robin
+    Hood probing for tables run at higher load
+  - Optional Swiss table style control bytes so lookups only touch slots
+    whose hash fingerprint matches
+  - Optional bucketized cuckoo layout where every lookup touches at most two
+    4-slot buckets
 
 Implementation Details:
 
@@ -0,0 +1,281 @@
+package phash
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// With Options.Encryption no key or value is stored in the clear. The
+// master key from the KeyProvider is stretched with HKDF-SHA256, salted
+// with the file's random seed, into two keys of its own for every file:
+//
+//   - Each slot key is the HMAC-SHA256 of the caller's key, cut to
+//     sealedKeySize bytes, so lookups still probe by key without the key
+//     being readable.
+//   - Each slot value is a random 12-byte nonce followed by the caller's
+//     key and value sealed with AES-256-GCM, with the slot key as
+//     additional data so a value cannot be moved to another key. The key
+//     is sealed along with the value so ForEach can give it back.
+//
+// The header holds the caller's key size and a check value derived from
+// the keys, so a wrong master key is caught at Open. In TTL mode the
+// expiry follows the sealed value unencrypted. Random nonces are safe for
+// about 2^32 writes per file; RotateKeys starts a file afresh.
+const (
+	sealedKeySize = 16
+	nonceSize     = 12
+	sealOverhead  = nonceSize + 16 // nonce and GCM tag
+)
+
+// KeyProvider supplies the master key of an encrypted table. It is asked
+// once each time the table is opened.
+type KeyProvider interface {
+	MasterKey() ([]byte, error)
+}
+
+// StaticKey is a KeyProvider for a key held in memory.
+type StaticKey []byte
+
+// MasterKey returns k.
+func (k StaticKey) MasterKey() ([]byte, error) {
+	if len(k) == 0 {
+		return nil, errors.New("empty master key")
+	}
+	return k, nil
+}
+
+// sealer holds the per-file keys of an encrypted table.
+type sealer struct {
+	aead    cipher.AEAD
+	mac     []byte
+	keySize uint32 // the caller's key size
+	check   [8]byte
+}
+
+// newSealer derives the keys for a file with the given seed.
+func newSealer(p KeyProvider, seed [16]byte, keySize uint32) (*sealer, error) {
+	master, err := p.MasterKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get master key: %w", err)
+	}
+
+	keys := hkdf(master, seed[:], []byte("phash table keys"), 64)
+	block, err := aes.NewCipher(keys[:32])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &sealer{aead: aead, mac: keys[32:], keySize: keySize}
+	m := hmac.New(sha256.New, s.mac)
+	m.Write([]byte("phash key check"))
+	copy(s.check[:], m.Sum(nil))
+	return s, nil
+}
+
+// hkdf is HKDF-SHA256 (RFC 5869) for outputs of up to 255 blocks.
+func hkdf(secret, salt, info []byte, n int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var out, prev []byte
+	for i := byte(1); len(out) < n; i++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(prev)
+		expand.Write(info)
+		expand.Write([]byte{i})
+		prev = expand.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:n]
+}
+
+// slotKey returns the slot key for a caller's key.
+func (s *sealer) slotKey(key []byte) []byte {
+	m := hmac.New(sha256.New, s.mac)
+	m.Write(key)
+	return m.Sum(nil)[:sealedKeySize]
+}
+
+// seal returns the slot value for key and value, stored under slot key enc.
+func (s *sealer) seal(enc, key, value []byte) ([]byte, error) {
+	plain := make([]byte, 0, len(key)+len(value))
+	plain = append(append(plain, key...), value...)
+
+	box := make([]byte, nonceSize, sealOverhead+len(plain))
+	if _, err := rand.Read(box); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return s.aead.Seal(box, box, plain, enc), nil
+}
+
+// open returns the key and value sealed in the slot value box under
+// slot key enc.
+func (s *sealer) open(enc, box []byte) ([]byte, []byte, error) {
+	plain, err := s.aead.Open(nil, box[:nonceSize], box[nonceSize:], enc)
+	if err != nil {
+		return nil, nil, errors.New("failed to decrypt entry")
+	}
+	return plain[:s.keySize], plain[s.keySize:], nil
+}
+
+// sealBatch returns ops in the form an encrypted table's batch log holds
+// them: each key replaced by its slot key and each value by the key and
+// value sealed under it. A Delete has no value, so its key is sealed alone.
+func (ph *PersistentHash) sealBatch(ops []batchOp) ([]batchOp, error) {
+	sealed := make([]batchOp, len(ops))
+	for i, op := range ops {
+		enc := ph.crypt.slotKey(op.key)
+		box, err := ph.crypt.seal(enc, op.key, op.value)
+		if err != nil {
+			return nil, err
+		}
+		sealed[i] = batchOp{key: enc, value: box, delete: op.delete}
+	}
+	return sealed, nil
+}
+
+// openBatch turns a batch read back from the log of an encrypted table
+// into the caller's keys and values again.
+func (ph *PersistentHash) openBatch(b *Batch) error {
+	for i, op := range b.ops {
+		if uint32(len(op.key)) != sealedKeySize || len(op.value) < sealOverhead+int(ph.crypt.keySize) {
+			return errors.New("malformed sealed operation")
+		}
+		key, value, err := ph.crypt.open(op.key, op.value)
+		if err != nil {
+			return err
+		}
+		b.ops[i].key, b.ops[i].value = key, value
+	}
+	return nil
+}
+
+// userKeySize returns the length of the keys callers use. It is
+// meaningless in VarKeys mode.
+func (ph *PersistentHash) userKeySize() uint32 {
+	if ph.crypt != nil {
+		return ph.crypt.keySize
+	}
+	return ph.keySize
+}
+
+// openSealer derives the keys of an encrypted table and, for an existing
+// file, checks them against the header.
+func (ph *PersistentHash) openSealer(keySize uint32, check []byte) error {
+	if ph.opts.Encryption == nil {
+		return errors.New("file is encrypted; pass its key in Options.Encryption")
+	}
+	s, err := newSealer(ph.opts.Encryption, ph.seed, keySize)
+	if err != nil {
+		return err
+	}
+	if check != nil && !hmac.Equal(check, s.check[:]) {
+		return errors.New("wrong encryption key")
+	}
+	ph.crypt = s
+	return nil
+}
+
+// RotateKeys re-encrypts the table at path under the master key from next,
+// which current must be able to open. Every live entry is copied into a
+// new file, with a fresh seed and so fresh derived keys, that then
+// replaces the old one with an atomic rename. opts supplies anything else
+// needed to open the table, such as a custom Hasher. The table must not
+// be open elsewhere, and must be a standalone file rather than a DB table.
+func RotateKeys(path string, current, next KeyProvider, opts *Options) error {
+	// Open would create a missing file
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	if fi.Size() == 0 {
+		return fmt.Errorf("%s is empty", path)
+	}
+
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	o.Encryption = current
+	o.ReapInterval = -1
+	src, err := OpenWithOptions(path, 0, 0, &o)
+	if err != nil {
+		return err
+	}
+	if src.crypt == nil {
+		src.Close()
+		return errors.New("table is not encrypted")
+	}
+
+	// The new file takes its format from the old one
+	o.Encryption = next
+	o.Layout = src.layout
+	o.TTL = src.flags&flagTTL != 0
+	o.CacheCapacity = int(src.capacity)
+	o.BloomFalsePositive = float64(src.bloomFP)
+	if src.hashFunc != HashCustom {
+		o.HashFunc = src.hashFunc
+	}
+
+	tmpPath := path + ".rotate"
+	removeHashFiles(tmpPath)
+	dst, err := OpenWithOptions(tmpPath, src.userKeySize(), src.userValueSize(), &o)
+	if err != nil {
+		src.Close()
+		return err
+	}
+
+	src.mu.Lock()
+	dst.mu.Lock()
+	err = dst.reserve(int(src.usedSlots))
+	if err == nil {
+		var perr error
+		err = src.walkLocked(time.Now().UnixNano(), func(key, value []byte, expiry int64) bool {
+			perr = dst.putLocked(key, value, expiry)
+			return perr == nil
+		})
+		if err == nil {
+			err = perr
+		}
+	}
+	if err == nil {
+		err = dst.syncLocked()
+	}
+	dst.mu.Unlock()
+	src.mu.Unlock()
+
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := src.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		removeHashFiles(tmpPath)
+		return err
+	}
+
+	// The old filter must not outlive the old table: it would hide every
+	// key under the new ones
+	os.Remove(path + ".bloom")
+	if err := os.Rename(tmpPath, path); err != nil {
+		removeHashFiles(tmpPath)
+		return fmt.Errorf("failed to rename rotated table: %w", err)
+	}
+	if o.BloomFalsePositive != 0 {
+		os.Rename(tmpPath+".bloom", path+".bloom")
+	}
+	return nil
+}
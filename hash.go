@@ -0,0 +1,279 @@
+package phash
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// Hasher maps a key to a 64-bit hash. The slot index is the hash modulo
+// the number of slots, so the low bits must be well distributed.
+type Hasher interface {
+	Hash(key []byte) uint64
+}
+
+// HashFunc identifies the hash function a file was created with. It is
+// stored in the header so a reopened table places keys the same way.
+type HashFunc uint32
+
+const (
+	// HashFNV1a is the original unseeded 32-bit FNV-1a. It is the default
+	// and the fastest for short keys, but trivial to flood with collisions.
+	HashFNV1a HashFunc = iota
+	// HashXXH64 is xxHash64 seeded from the file's random seed.
+	HashXXH64
+	// HashWyhash is wyhash (final version 4) seeded from the file's seed.
+	HashWyhash
+	// HashSipHash is SipHash-2-4 keyed with the file's 128-bit seed. It is
+	// the slowest option and the one to pick for attacker-controlled keys.
+	HashSipHash
+
+	// HashCustom marks a file created with Options.Hasher. The same Hasher
+	// must be passed again every time the file is opened.
+	HashCustom HashFunc = 255
+)
+
+// hash returns the 64-bit hash of a slot key. In VarKeys mode that is the
+// hash of the full key, stored in the slot key itself.
+func (ph *PersistentHash) hash(key []byte) uint64 {
+	if ph.flags&flagVarKeys != 0 {
+		return binary.BigEndian.Uint64(key[4:12])
+	}
+	return ph.hashRaw(key)
+}
+
+// hashRaw returns the 64-bit hash of key under the table's hash function.
+func (ph *PersistentHash) hashRaw(key []byte) uint64 {
+	if ph.hasher == nil {
+		return uint64(hashKey(key))
+	}
+	return ph.hasher.Hash(key)
+}
+
+// newHasher returns the Hasher for fn. The built-in FNV-1a is returned as
+// nil so that hash can call it directly.
+func newHasher(fn HashFunc, seed [16]byte, custom Hasher) (Hasher, error) {
+	if custom != nil && fn != HashCustom {
+		return nil, errors.New("custom hasher given for a file that does not use one")
+	}
+
+	switch fn {
+	case HashFNV1a:
+		return nil, nil
+	case HashXXH64:
+		return xxh64Hasher(binary.LittleEndian.Uint64(seed[0:8])), nil
+	case HashWyhash:
+		return wyHasher(binary.LittleEndian.Uint64(seed[0:8])), nil
+	case HashSipHash:
+		return sipHasher{
+			k0: binary.LittleEndian.Uint64(seed[0:8]),
+			k1: binary.LittleEndian.Uint64(seed[8:16]),
+		}, nil
+	case HashCustom:
+		if custom == nil {
+			return nil, errors.New("file was created with a custom hasher; pass it in Options.Hasher")
+		}
+		return custom, nil
+	}
+	return nil, fmt.Errorf("unknown hash function %d", fn)
+}
+
+// xxHash64 - https://github.com/Cyan4973/xxHash/blob/dev/doc/xxhash_spec.md
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+type xxh64Hasher uint64
+
+func (seed xxh64Hasher) Hash(key []byte) uint64 {
+	return xxh64(key, uint64(seed))
+}
+
+func xxh64(b []byte, seed uint64) uint64 {
+	n := len(b)
+	var h uint64
+
+	if n >= 32 {
+		v1 := seed + xxPrime1 + xxPrime2
+		v2 := seed + xxPrime2
+		v3 := seed
+		v4 := seed - xxPrime1
+		for len(b) >= 32 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(b[0:8]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(b[8:16]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(b[16:24]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(b[24:32]))
+			b = b[32:]
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) +
+			bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = seed + xxPrime5
+	}
+
+	h += uint64(n)
+
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
+
+// wyhash final version 4 - https://github.com/wangyi-fudan/wyhash
+var wyp = [4]uint64{0x2d358dccaa6c78a5, 0x8bb84b93962eacc9, 0x4b33a62ed433d4a3, 0x4d5a2da51de1aa47}
+
+type wyHasher uint64
+
+func (seed wyHasher) Hash(key []byte) uint64 {
+	return wyhash(key, uint64(seed))
+}
+
+func wymix(a, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	return hi ^ lo
+}
+
+func wyr3(p []byte, k int) uint64 {
+	return uint64(p[0])<<16 | uint64(p[k>>1])<<8 | uint64(p[k-1])
+}
+
+func wyr4(p []byte) uint64 { return uint64(binary.LittleEndian.Uint32(p)) }
+
+func wyr8(p []byte) uint64 { return binary.LittleEndian.Uint64(p) }
+
+func wyhash(p []byte, seed uint64) uint64 {
+	n := len(p)
+	seed ^= wymix(seed^wyp[0], wyp[1])
+
+	var a, b uint64
+	switch {
+	case n <= 16:
+		if n >= 4 {
+			a = wyr4(p)<<32 | wyr4(p[(n>>3)<<2:])
+			b = wyr4(p[n-4:])<<32 | wyr4(p[n-4-((n>>3)<<2):])
+		} else if n > 0 {
+			a = wyr3(p, n)
+		}
+	default:
+		// off tracks the C pointer arithmetic; the final reads may reach
+		// back into bytes already consumed.
+		i, off := n, 0
+		if i >= 48 {
+			see1, see2 := seed, seed
+			for i >= 48 {
+				seed = wymix(wyr8(p[off:])^wyp[1], wyr8(p[off+8:])^seed)
+				see1 = wymix(wyr8(p[off+16:])^wyp[2], wyr8(p[off+24:])^see1)
+				see2 = wymix(wyr8(p[off+32:])^wyp[3], wyr8(p[off+40:])^see2)
+				off += 48
+				i -= 48
+			}
+			seed ^= see1 ^ see2
+		}
+		for i > 16 {
+			seed = wymix(wyr8(p[off:])^wyp[1], wyr8(p[off+8:])^seed)
+			off += 16
+			i -= 16
+		}
+		a = wyr8(p[off+i-16:])
+		b = wyr8(p[off+i-8:])
+	}
+
+	a ^= wyp[1]
+	b ^= seed
+	b, a = bits.Mul64(a, b)
+	return wymix(a^wyp[0]^uint64(n), b^wyp[1])
+}
+
+// SipHash-2-4 - https://www.aumasson.jp/siphash/siphash.pdf
+type sipHasher struct {
+	k0, k1 uint64
+}
+
+func (s sipHasher) Hash(key []byte) uint64 {
+	return siphash24(s.k0, s.k1, key)
+}
+
+func siphash24(k0, k1 uint64, p []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	n := len(p)
+	for ; len(p) >= 8; p = p[8:] {
+		m := binary.LittleEndian.Uint64(p)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+
+	m := uint64(n) << 56
+	for i, c := range p {
+		m |= uint64(c) << (8 * uint(i))
+	}
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
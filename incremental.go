@@ -0,0 +1,393 @@
+package phash
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"time"
+)
+
+// growState tracks an incremental resize. Writes go to next; the old table
+// is only read, and is migrated into next slot by slot in index order.
+type growState struct {
+	next table
+
+	// log records the writes made to next, see logGrow. It is opened by
+	// the first one.
+	log     *os.File
+	logSize int64
+
+	// bloom is the Bloom filter for next, if the hash has one.
+	bloom *bloomFilter
+
+	// cursor is the first old slot not yet migrated.
+	cursor uint32
+
+	// pending counts live old entries at or above cursor that have not been
+	// shadowed, so next.usedSlots+pending is the number of keys in the hash.
+	pending uint32
+
+	// shadowed holds the indexes of unmigrated old slots whose entry is
+	// stale, because the key has since been written to next or deleted.
+	// The old table never changes during a resize, so indexes are stable.
+	// The migration skips them.
+	shadowed map[uint32]struct{}
+
+	info    ResizeInfo
+	started time.Time
+}
+
+// growPut is putWithRetry while an incremental resize is in progress.
+func (ph *PersistentHash) growPut(key, value []byte, retryCount int) error {
+	// The background resizer does the migrating when there is one
+	if !ph.opts.BackgroundResize {
+		if err := ph.migrate(uint32(ph.opts.ResizeStep)); err != nil {
+			return err
+		}
+	}
+	g := ph.grow
+	if g == nil {
+		// That step finished the resize
+		return ph.putWithRetry(key, value, retryCount)
+	}
+
+	mark, err := ph.logGrow(false, key, value)
+	if err != nil {
+		// Without the log the write is only durable in the finished table
+		if err := ph.migrate(ph.numSlots); err != nil {
+			return err
+		}
+		return ph.putWithRetry(key, value, retryCount)
+	}
+	if err := ph.growStore(key, value, retryCount); err != nil {
+		if ph.grow == g {
+			ph.unlogGrow(mark)
+		}
+		return err
+	}
+	return nil
+}
+
+// growStore writes key to the resize target, or finishes the resize and
+// writes it to the new table if there is no room for it yet.
+func (ph *PersistentHash) growStore(key, value []byte, retryCount int) error {
+	g := ph.grow
+	idx, found := ph.findSlot(&g.next, key)
+	if found {
+		slotStart := g.next.base + idx*ph.slotSize
+		copy(g.next.data[slotStart+1+ph.keySize:], value)
+		return nil
+	}
+	if idx == g.next.numSlots {
+		return errors.New("hash table full")
+	}
+
+	// Writes outpaced the migration. Finish it now so the regular path can
+	// start the next resize.
+	loadFactor := float32(g.next.usedSlots+g.pending+1) / float32(g.next.numSlots)
+	if loadFactor <= ph.maxLoad {
+		err := ph.insert(&g.next, idx, key, value)
+		if err == nil {
+			ph.shadow(key)
+			return nil
+		}
+		if err != errProbeTooLong {
+			return err
+		}
+	}
+
+	if err := ph.migrate(ph.numSlots); err != nil {
+		return err
+	}
+	return ph.putWithRetry(key, value, retryCount)
+}
+
+// growDelete removes key, known to be present, while an incremental resize
+// is in progress.
+func (ph *PersistentHash) growDelete(key []byte) bool {
+	if _, err := ph.logGrow(true, key, nil); err != nil {
+		// As in growPut. A Delete cannot fail, so if finishing the resize
+		// does, the key is still removed from memory.
+		if ph.migrate(ph.numSlots) == nil {
+			return ph.deleteLocked(key)
+		}
+	}
+
+	g := ph.grow
+	removed := false
+	if idx, found := ph.findSlot(&g.next, key); found {
+		ph.removeAt(&g.next, idx)
+		removed = true
+	}
+	if ph.shadow(key) {
+		removed = true
+	}
+	return removed
+}
+
+// shadow records that the old copy of key, if it has not been migrated yet,
+// must no longer be served or copied. It reports whether there was such a
+// live copy.
+func (ph *PersistentHash) shadow(key []byte) bool {
+	g := ph.grow
+	idx, found := ph.findSlot(&ph.table, key)
+	if !found || idx < g.cursor {
+		return false
+	}
+	if _, ok := g.shadowed[idx]; ok {
+		return false
+	}
+	g.shadowed[idx] = struct{}{}
+	g.pending--
+	return true
+}
+
+// migrate copies up to n old slots into the new table, finishing the
+// resize once the cursor reaches the end.
+func (ph *PersistentHash) migrate(n uint32) error {
+	g := ph.grow
+	end := g.cursor + n
+	if end > ph.numSlots || end < g.cursor {
+		end = ph.numSlots
+	}
+
+	for ; g.cursor < end; g.cursor++ {
+		slotStart := ph.base + g.cursor*ph.slotSize
+		if !ph.occupied(&ph.table, g.cursor) {
+			continue
+		}
+
+		if _, ok := g.shadowed[g.cursor]; ok {
+			delete(g.shadowed, g.cursor)
+			continue
+		}
+
+		key := ph.data[slotStart+1 : slotStart+1+ph.keySize]
+		idx, found := ph.findSlot(&g.next, key)
+		if found || idx == g.next.numSlots {
+			return fmt.Errorf("failed to find slot for key during resize")
+		}
+		if err := ph.insert(&g.next, idx, key, ph.valueField(ph.data, slotStart)); err != nil {
+			return fmt.Errorf("failed to place key during resize: %w", err)
+		}
+		g.pending--
+	}
+
+	if g.cursor < ph.numSlots {
+		return nil
+	}
+	return ph.finishResize()
+}
+
+// backgroundMigrate drives the resize g to completion, taking the write
+// lock for one ResizeStep at a time. It returns early if the resize is
+// finished by someone else, e.g. Close or a Put that hit the hard limit.
+func (ph *PersistentHash) backgroundMigrate(g *growState) {
+	step := uint32(ph.opts.ResizeStep)
+	var copied int64
+
+	for {
+		ph.mu.Lock()
+		if ph.grow != g {
+			ph.mu.Unlock()
+			return
+		}
+		if err := ph.migrate(step); err != nil {
+			ph.resizeFinished(g, err)
+			ph.mu.Unlock()
+			return
+		}
+		done := ph.grow != g
+		slotSize := ph.slotSize
+		ph.mu.Unlock()
+
+		if done {
+			return
+		}
+
+		// Sleep off whatever we are ahead of the bandwidth budget
+		if rate := ph.opts.ResizeBytesPerSec; rate > 0 {
+			copied += int64(step) * int64(slotSize)
+			budget := time.Duration(float64(copied) / float64(rate) * float64(time.Second))
+			if ahead := budget - time.Since(g.started); ahead > 0 {
+				time.Sleep(ahead)
+			}
+		}
+	}
+}
+
+// While an incremental resize is in flight, writes land in the new table
+// only; the old file stays as it was when the resize started until the
+// new one is renamed over it. So that they survive the process dying, each
+// write is first appended to filePath + ".grow", one record per Put or
+// Delete:
+//
+//   - Kind (1 byte): 0 for a Put, 1 for a Delete
+//   - Key Length (4 bytes), Value Length (4 bytes)
+//   - Key and Value bytes, as probed for and stored in the slot
+//   - Checksum (4 bytes): CRC-32 (IEEE) of the record before it
+//
+// Keys and values are logged in slot form, so an encrypted table logs
+// nothing in the clear. The log goes away with the rename, and Open
+// replays one it finds into the old table. A torn last record was never
+// acknowledged and is dropped. As with the mapping itself, records are
+// not synced: they survive a crash of the process, not of the machine.
+
+// logGrow appends the record of a write about to be made to the resize
+// target. It returns the previous end of the log, for unlogGrow.
+func (ph *PersistentHash) logGrow(del bool, key, value []byte) (int64, error) {
+	g := ph.grow
+	if ph.inMemory {
+		return 0, nil // nothing survives a crash to replay
+	}
+	if g.log == nil {
+		file, err := os.OpenFile(ph.filePath+".grow", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create resize log: %w", err)
+		}
+		g.log = file
+	}
+
+	rec := make([]byte, 9, 13+len(key)+len(value))
+	if del {
+		rec[0] = 1
+	}
+	binary.BigEndian.PutUint32(rec[1:5], uint32(len(key)))
+	binary.BigEndian.PutUint32(rec[5:9], uint32(len(value)))
+	rec = append(append(rec, key...), value...)
+	rec = binary.BigEndian.AppendUint32(rec, crc32.ChecksumIEEE(rec))
+
+	mark := g.logSize
+	if _, err := g.log.WriteAt(rec, mark); err != nil {
+		ph.unlogGrow(mark)
+		return 0, fmt.Errorf("failed to write resize log: %w", err)
+	}
+	g.logSize += int64(len(rec))
+	return mark, nil
+}
+
+// unlogGrow cuts the resize log back to mark, dropping the records of
+// writes that failed.
+func (ph *PersistentHash) unlogGrow(mark int64) {
+	g := ph.grow
+	if g.log == nil {
+		return
+	}
+	// A record left behind by a failed truncate is overwritten by the
+	// next one, or replayed as a write that did no harm
+	g.log.Truncate(mark)
+	g.logSize = mark
+}
+
+// closeGrowLog closes the log of resize g, removing it once the writes it
+// holds are in the table on disk.
+func (ph *PersistentHash) closeGrowLog(g *growState, remove bool) error {
+	if g.log == nil {
+		return nil
+	}
+	defer g.log.Close()
+	if !remove {
+		return nil
+	}
+	// Emptied first, so a log that cannot be removed is never replayed
+	// over writes made after the resize
+	if err := g.log.Truncate(0); err != nil {
+		return fmt.Errorf("failed to clear resize log: %w", err)
+	}
+	os.Remove(ph.filePath + ".grow")
+	return nil
+}
+
+// replayGrow applies the writes logged by a resize that never finished to
+// the table, which is still as it was when the resize started.
+func (ph *PersistentHash) replayGrow() error {
+	if ph.inMemory {
+		return nil
+	}
+	logPath := ph.filePath + ".grow"
+	buf, err := os.ReadFile(logPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read resize log: %w", err)
+	}
+
+	// Resize in place while replaying, so no new log replaces this one
+	// before it has been applied
+	saved := ph.opts
+	ph.opts.IncrementalResize, ph.opts.BackgroundResize = false, false
+	defer func() {
+		ph.opts.IncrementalResize = saved.IncrementalResize
+		ph.opts.BackgroundResize = saved.BackgroundResize
+	}()
+
+	valueSize := int(ph.valueSize)
+	for {
+		del, key, value, n := decodeGrowRecord(buf)
+		if n == 0 {
+			break
+		}
+		buf = buf[n:]
+		if len(key) < int(ph.keySize) || (!del && len(value) != valueSize) {
+			return errors.New("corrupt resize log")
+		}
+
+		if del {
+			if ph.vlog != nil {
+				ph.releaseLogged(key)
+			}
+			ph.deleteLocked(key)
+			continue
+		}
+		var oldLen int64
+		if ph.vlog != nil {
+			oldLen = ph.loggedLen(key)
+		}
+		if err := ph.putWithRetry(key, value, 0); err != nil {
+			return fmt.Errorf("failed to replay resize log: %w", err)
+		}
+		if ph.vlog != nil {
+			ph.setLogLive(ph.vlog.live + ph.loggedBytes(value) - oldLen)
+		}
+	}
+
+	if err := ph.syncLocked(); err != nil {
+		return err
+	}
+	if err := os.Remove(logPath); err != nil {
+		return fmt.Errorf("failed to remove resize log: %w", err)
+	}
+	return nil
+}
+
+// decodeGrowRecord parses the resize log record at the start of buf and
+// returns its length, or 0 if there is no complete record.
+func decodeGrowRecord(buf []byte) (del bool, key, value []byte, n int) {
+	if len(buf) < 13 {
+		return false, nil, nil, 0
+	}
+	keyLen := uint64(binary.BigEndian.Uint32(buf[1:5]))
+	valueLen := uint64(binary.BigEndian.Uint32(buf[5:9]))
+	end := 9 + keyLen + valueLen
+	if end+4 > uint64(len(buf)) {
+		return false, nil, nil, 0
+	}
+	if crc32.ChecksumIEEE(buf[:end]) != binary.BigEndian.Uint32(buf[end:end+4]) {
+		return false, nil, nil, 0
+	}
+	return buf[0] == 1, buf[9 : 9+keyLen], buf[9+keyLen : end], int(end + 4)
+}
+
+// resizeFinished reports the end of resize g to the OnResizeFinish hook.
+func (ph *PersistentHash) resizeFinished(g *growState, err error) {
+	if ph.opts.OnResizeFinish == nil {
+		return
+	}
+	info := g.info
+	info.Duration = time.Since(g.started)
+	info.Err = err
+	ph.opts.OnResizeFinish(info)
+}
@@ -0,0 +1,101 @@
+package phash
+
+import "time"
+
+// Len returns the number of keys in the hash table. In TTL mode it counts
+// expired entries until their slots are freed.
+func (ph *PersistentHash) Len() int {
+	ph.mu.RLock()
+	defer ph.mu.RUnlock()
+
+	return ph.lenLocked()
+}
+
+func (ph *PersistentHash) lenLocked() int {
+	if g := ph.grow; g != nil {
+		return int(g.next.usedSlots + g.pending)
+	}
+	return int(ph.usedSlots)
+}
+
+// ForEach calls fn for every key-value pair in the table, in no particular
+// order, until fn returns false. The slices may point straight into the
+// mapped file: fn must not modify them or keep them after it returns, and
+// must not call back into the hash. Writers wait until ForEach returns.
+func (ph *PersistentHash) ForEach(fn func(key, value []byte) bool) error {
+	ph.mu.RLock()
+	defer ph.mu.RUnlock()
+
+	return ph.forEachLocked(fn)
+}
+
+// forEachLocked is ForEach for callers that already hold the lock.
+func (ph *PersistentHash) forEachLocked(fn func(key, value []byte) bool) error {
+	return ph.walkLocked(time.Now().UnixNano(), func(key, value []byte, _ int64) bool {
+		return fn(key, value)
+	})
+}
+
+// walkLocked visits every entry that has not expired by now, in both
+// tables during a resize, passing its expiry along.
+func (ph *PersistentHash) walkLocked(now int64, fn func(key, value []byte, expiry int64) bool) error {
+	if g := ph.grow; g != nil {
+		more, err := ph.walkTable(&g.next, 0, nil, now, fn)
+		if err != nil || !more {
+			return err
+		}
+		_, err = ph.walkTable(&ph.table, g.cursor, g.shadowed, now, fn)
+		return err
+	}
+	_, err := ph.walkTable(&ph.table, 0, nil, now, fn)
+	return err
+}
+
+// walkTable visits the live entries of t from slot from onwards, skipping
+// the slots in skip. It reports whether fn asked to keep going.
+func (ph *PersistentHash) walkTable(t *table, from uint32, skip map[uint32]struct{}, now int64, fn func(key, value []byte, expiry int64) bool) (bool, error) {
+	for i := from; i < t.numSlots; i++ {
+		if !ph.occupied(t, i) {
+			continue
+		}
+		if _, ok := skip[i]; ok {
+			continue
+		}
+
+		slotStart := t.base + i*ph.slotSize
+		_, expiry := ph.splitExpiry(ph.valueField(t.data, slotStart))
+		if expiry != 0 && expiry <= now {
+			continue
+		}
+
+		key, value, err := ph.entryAt(t, i)
+		if err != nil {
+			return false, err
+		}
+		if !fn(key, value, expiry) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// entryAt decodes the caller's key and value stored in slot idx of t.
+func (ph *PersistentHash) entryAt(t *table, idx uint32) ([]byte, []byte, error) {
+	slotStart := t.base + idx*ph.slotSize
+	if ph.crypt != nil {
+		box, _ := ph.splitExpiry(ph.valueField(t.data, slotStart))
+		return ph.crypt.open(t.data[slotStart+1:slotStart+1+ph.keySize], box)
+	}
+	key, err := ph.decodeKey(t.data[slotStart+1 : slotStart+1+ph.keySize])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	value, _ := ph.splitExpiry(ph.valueField(t.data, slotStart))
+	if ph.vlog != nil {
+		if value, err = ph.loadValue(value); err != nil {
+			return nil, nil, err
+		}
+	}
+	return key, value, nil
+}
@@ -0,0 +1,125 @@
+package phash
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Layout is the collision strategy of a table, fixed when the file is
+// created and stored in its header.
+type Layout uint32
+
+const (
+	// LayoutLinear is plain linear probing. Deletes shift the rest of the
+	// probe run back rather than leaving tombstones.
+	LayoutLinear Layout = iota
+	// LayoutRobinHood is linear probing with Robin Hood insertion and
+	// backward-shift deletion. Each slot's status byte holds its distance
+	// from the home slot, which bounds probe lengths and lets misses stop
+	// early, so tables can run at 0.85-0.9 load.
+	LayoutRobinHood
+	// LayoutSwiss keeps a separate array of 1-byte control words (empty,
+	// deleted or a 7-bit hash fingerprint) ahead of the slots. Lookups scan
+	// eight control bytes per word-sized compare and only touch a slot when
+	// its fingerprint matches, which pays off with large values.
+	LayoutSwiss
+	// LayoutCuckoo is bucketized cuckoo hashing: every key lives in one of
+	// two 4-slot buckets, so a lookup touches at most eight slots whatever
+	// the load. Inserts move entries to their other bucket to make room and
+	// resize when no short path exists.
+	LayoutCuckoo
+)
+
+// errProbeTooLong is returned by insert when an entry would end up further
+// from its home slot than the layout can record. The caller resizes.
+var errProbeTooLong = errors.New("probe sequence too long")
+
+// defaultMaxLoad is the resize threshold used when Options.MaxLoadFactor is unset.
+func (l Layout) defaultMaxLoad() float32 {
+	switch l {
+	case LayoutRobinHood, LayoutCuckoo:
+		return 0.9
+	}
+	return 0.7
+}
+
+// findSlot looks key up in t. On a hit it returns the slot index and true.
+// On a miss it returns a slot hint for insert, or t.numSlots if the table
+// has no room at all.
+func (ph *PersistentHash) findSlot(t *table, key []byte) (uint32, bool) {
+	switch ph.layout {
+	case LayoutRobinHood:
+		return ph.rhFind(t, key)
+	case LayoutSwiss:
+		return ph.swFind(t, key)
+	case LayoutCuckoo:
+		return ph.cuFind(t, key)
+	}
+	return ph.linearFind(t, key)
+}
+
+// insert adds key, known to be absent from t, using the hint from findSlot.
+func (ph *PersistentHash) insert(t *table, idx uint32, key, value []byte) error {
+	var err error
+	switch ph.layout {
+	case LayoutRobinHood:
+		err = ph.rhInsert(t, key, value)
+	case LayoutSwiss:
+		t.data[ph.hdrSize+idx] = swFingerprint(ph.hash(key))
+		ph.insertAt(t, idx, key, value)
+	case LayoutCuckoo:
+		err = ph.cuInsert(t, idx, key, value)
+	default:
+		ph.insertAt(t, idx, key, value)
+	}
+	if err == nil && ph.bloom != nil {
+		ph.bloomAdd(t, key)
+	}
+	return err
+}
+
+// removeAt deletes the entry in slot idx of t.
+func (ph *PersistentHash) removeAt(t *table, idx uint32) {
+	switch ph.layout {
+	case LayoutRobinHood:
+		ph.rhRemove(t, idx)
+	case LayoutSwiss:
+		t.data[ph.hdrSize+idx] = swDeleted
+		t.data[t.base+idx*ph.slotSize] = 2
+	case LayoutCuckoo:
+		// A key is only ever looked for in its two buckets, so there is
+		// no probe chain to keep intact.
+		t.data[t.base+idx*ph.slotSize] = 0
+	default:
+		ph.linearRemove(t, idx)
+	}
+	t.usedSlots--
+	binary.BigEndian.PutUint32(t.data[12:16], t.usedSlots)
+	if ph.bloom != nil {
+		ph.bloomRemove()
+	}
+}
+
+// occupied reports whether slot idx of t holds a live entry.
+func (ph *PersistentHash) occupied(t *table, idx uint32) bool {
+	status := t.data[t.base+idx*ph.slotSize]
+	if ph.layout == LayoutRobinHood {
+		return status != 0
+	}
+	return status&^refBit == 1
+}
+
+// valueField returns the value field of the slot at slotStart in data. It
+// stops short of any padding at the end of the slot.
+func (ph *PersistentHash) valueField(data []byte, slotStart uint32) []byte {
+	start := slotStart + 1 + ph.keySize
+	return data[start : start+ph.valueSize]
+}
+
+// slotsBase returns the offset of slot 0 in a table of numSlots slots.
+func (ph *PersistentHash) slotsBase(numSlots uint32) uint32 {
+	if ph.layout == LayoutSwiss {
+		return ph.hdrSize + numSlots // control bytes
+	}
+	return ph.hdrSize
+}
@@ -0,0 +1,114 @@
+package phash
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// An in-memory table keeps its slots in an anonymous mapping instead of a
+// file. It shares every code path with a file-backed table, including
+// resizes, which build the new table in a fresh mapping. Nothing is
+// written to disk until SaveTo, and the contents are gone once it is
+// closed.
+
+// OpenMemory creates an empty in-memory table.
+func OpenMemory(keySize, valueSize uint32) (*PersistentHash, error) {
+	return OpenMemoryWithOptions(keySize, valueSize, nil)
+}
+
+// OpenMemoryWithOptions is like OpenMemory but lets the caller tune the
+// table. Options that need companion files (ValueLog, VarKeys, Compress
+// and BloomFalsePositive) are not supported, and Write skips its log since
+// there is no file to recover.
+func OpenMemoryWithOptions(keySize, valueSize uint32, opts *Options) (*PersistentHash, error) {
+	ph := &PersistentHash{
+		id:        lastID.Add(1),
+		keySize:   keySize,
+		valueSize: valueSize,
+		opts:      opts.withDefaults(),
+		inMemory:  true,
+	}
+	if ph.opts.ValueLog || ph.opts.VarKeys || ph.opts.Compress || ph.opts.BloomFalsePositive != 0 {
+		return nil, errors.New("in-memory tables do not support ValueLog, VarKeys, Compress or BloomFalsePositive")
+	}
+	if err := ph.initFormat(); err != nil {
+		return nil, err
+	}
+	numSlots, err := ph.initialSlots()
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := ph.anonTable(numSlots)
+	if err != nil {
+		return nil, err
+	}
+	if err := ph.attach(nil, t.data); err != nil {
+		syscall.Munmap(t.data)
+		return nil, err
+	}
+	ph.startReaper()
+	return ph, nil
+}
+
+// anonTable maps an empty table of numSlots in anonymous memory.
+func (ph *PersistentHash) anonTable(numSlots uint32) (table, error) {
+	size := int(ph.slotsBase(numSlots) + numSlots*ph.slotSize)
+	data, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return table{}, fmt.Errorf("mmap failed: %w", err)
+	}
+	copy(data, ph.headerBytes(numSlots))
+	return table{
+		base:     ph.slotsBase(numSlots),
+		data:     data,
+		numSlots: numSlots,
+	}, nil
+}
+
+// SaveTo writes the table to path as an ordinary phash file, which Open
+// can then use like any other. It works on file-backed tables too, as long
+// as they keep no companion logs; BackupTo covers those. The file is
+// written under a temporary name and renamed into place once synced.
+func (ph *PersistentHash) SaveTo(path string) error {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	if ph.vlog != nil || ph.klog != nil {
+		return errors.New("SaveTo cannot copy companion logs; use BackupTo")
+	}
+	if ph.grow != nil {
+		if err := ph.migrate(ph.numSlots); err != nil {
+			return err
+		}
+	}
+
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	fail := func(err error) error {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if _, err := file.Write(ph.data); err != nil {
+		return fail(fmt.Errorf("failed to write file: %w", err))
+	}
+	if err := file.Sync(); err != nil {
+		return fail(fmt.Errorf("failed to sync file: %w", err))
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rename file: %w", err)
+	}
+	return nil
+}
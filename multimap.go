@@ -0,0 +1,269 @@
+package phash
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// A MultiMap keeps any number of values per key in an ordinary table. Each
+// value gets a slot of its own under the key followed by a 4-byte
+// big-endian sequence number, 1 up to the key's count, and sequence 0 is a
+// head record whose value starts with that count. Append writes the value
+// before the head, so a crash between the two leaves at most an
+// unreferenced value past the count, which the next Append overwrites.
+// RemoveValue moves the last value into the hole, shrinks the head and
+// removes the last slot as one batch, through the same log as Write, so a
+// crash leaves all three done or none.
+const seqSize = 4
+
+// MultiMap is a persistent map from a key to a list of values. It is safe
+// for concurrent use.
+type MultiMap struct {
+	ph        *PersistentHash
+	keySize   uint32
+	valueSize uint32 // 0 with ValueLog
+}
+
+// MultiIter walks the values of one key in a MultiMap. Each call to Next
+// reads the next value under the map's read lock, so values appended or
+// removed while iterating may or may not be seen.
+type MultiIter struct {
+	m     *MultiMap
+	key   []byte
+	seq   uint32
+	count uint32
+	value []byte
+	err   error
+}
+
+// OpenMultiMap opens or creates a multimap at filePath. With ValueLog in
+// opts values may have any length and valueSize must be 0; otherwise each
+// value is valueSize bytes. An existing file must be opened with the same
+// sizes; values shorter than 4 bytes are padded to 4 in their slots, so
+// the file cannot tell those sizes apart. VarKeys, TTL and CacheCapacity
+// are not supported, since a slot that came and went on its own would
+// break the count.
+func OpenMultiMap(filePath string, keySize, valueSize uint32, opts *Options) (*MultiMap, error) {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.VarKeys || o.TTL || o.CacheCapacity > 0 {
+		return nil, errors.New("multimaps do not support VarKeys, TTL or CacheCapacity")
+	}
+	if keySize == 0 || keySize > math.MaxUint32-seqSize {
+		return nil, errors.New("invalid key size")
+	}
+	if o.ValueLog != (valueSize == 0) {
+		return nil, errors.New("valueSize must be 0 with ValueLog and positive without")
+	}
+
+	// The head's count needs seqSize bytes whatever the value size
+	slotValue := valueSize
+	if !o.ValueLog && slotValue < seqSize {
+		slotValue = seqSize
+	}
+	ph, err := OpenWithOptions(filePath, keySize+seqSize, slotValue, &o)
+	if err != nil {
+		return nil, err
+	}
+	if ph.flags&(flagVarKeys|flagTTL|flagCache) != 0 ||
+		(ph.flags&flagValueLog != 0) != o.ValueLog ||
+		ph.userKeySize() != keySize+seqSize || (!o.ValueLog && ph.userValueSize() != slotValue) {
+		ph.Close()
+		return nil, fmt.Errorf("file does not hold a multimap of %d-byte keys and %d-byte values", keySize, valueSize)
+	}
+
+	return &MultiMap{ph: ph, keySize: keySize, valueSize: valueSize}, nil
+}
+
+// Hash returns the underlying PersistentHash.
+func (m *MultiMap) Hash() *PersistentHash {
+	return m.ph
+}
+
+// Close closes the underlying hash.
+func (m *MultiMap) Close() error {
+	return m.ph.Close()
+}
+
+// Append adds value to the end of key's values.
+func (m *MultiMap) Append(key, value []byte) error {
+	if err := m.check(key, value); err != nil {
+		return err
+	}
+	m.ph.mu.Lock()
+	defer m.ph.mu.Unlock()
+
+	n := m.countLocked(key)
+	if n == math.MaxUint32 {
+		return errors.New("too many values for key")
+	}
+	if err := m.ph.putLocked(m.slotKey(key, n+1), m.slotValue(value), 0); err != nil {
+		return err
+	}
+	return m.setCount(key, n+1)
+}
+
+// Count returns the number of values stored under key.
+func (m *MultiMap) Count(key []byte) int {
+	if uint32(len(key)) != m.keySize {
+		return 0
+	}
+	m.ph.mu.RLock()
+	defer m.ph.mu.RUnlock()
+
+	return int(m.countLocked(key))
+}
+
+// GetAll returns an iterator over key's values, in the order they were
+// appended as long as none has been removed.
+func (m *MultiMap) GetAll(key []byte) *MultiIter {
+	it := &MultiIter{m: m, key: append([]byte(nil), key...)}
+	if uint32(len(key)) != m.keySize {
+		it.err = errors.New("invalid key size")
+		return it
+	}
+	m.ph.mu.RLock()
+	it.count = m.countLocked(key)
+	m.ph.mu.RUnlock()
+	return it
+}
+
+// RemoveValue removes the first of key's values equal to value and
+// reports whether there was one. The last value takes its place, so the
+// order of the rest is not kept.
+func (m *MultiMap) RemoveValue(key, value []byte) (bool, error) {
+	if err := m.check(key, value); err != nil {
+		return false, err
+	}
+	m.ph.mu.Lock()
+	defer m.ph.mu.Unlock()
+
+	n := m.countLocked(key)
+	for seq := uint32(1); seq <= n; seq++ {
+		got, found := m.ph.getLocked(m.slotKey(key, seq))
+		if !found {
+			return false, fmt.Errorf("value %d of key missing", seq)
+		}
+		if !bytes.Equal(m.userValue(got), value) {
+			continue
+		}
+
+		var b Batch
+		if seq != n {
+			last, found := m.ph.getLocked(m.slotKey(key, n))
+			if !found {
+				return false, fmt.Errorf("value %d of key missing", n)
+			}
+			b.Put(m.slotKey(key, seq), last)
+		}
+		if n == 1 {
+			b.Delete(m.slotKey(key, 0))
+		} else {
+			b.Put(m.slotKey(key, 0), m.headValue(n-1))
+		}
+		b.Delete(m.slotKey(key, n))
+
+		if err := m.ph.logBatch(&b); err != nil {
+			return false, err
+		}
+		if err := m.ph.applyBatch(&b); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// Next advances to the next value and reports whether there is one.
+func (it *MultiIter) Next() bool {
+	if it.err != nil || it.seq >= it.count {
+		return false
+	}
+	it.seq++
+
+	m := it.m
+	m.ph.mu.RLock()
+	got, found := m.ph.getLocked(m.slotKey(it.key, it.seq))
+	m.ph.mu.RUnlock()
+	if !found {
+		// Removed since the iterator started
+		it.count = it.seq
+		return false
+	}
+	it.value = m.userValue(got)
+	return true
+}
+
+// Value returns the current value. It stays valid after the next call to
+// Next.
+func (it *MultiIter) Value() []byte {
+	return it.value
+}
+
+// Err returns the error, if any, that stopped the iteration.
+func (it *MultiIter) Err() error {
+	return it.err
+}
+
+// check validates the sizes of a key and value.
+func (m *MultiMap) check(key, value []byte) error {
+	if uint32(len(key)) != m.keySize {
+		return errors.New("invalid key size")
+	}
+	if m.valueSize != 0 && uint32(len(value)) != m.valueSize {
+		return errors.New("invalid value size")
+	}
+	return nil
+}
+
+// countLocked returns the count in key's head record, 0 if it has none.
+func (m *MultiMap) countLocked(key []byte) uint32 {
+	head, found := m.ph.getLocked(m.slotKey(key, 0))
+	if !found || len(head) < seqSize {
+		return 0
+	}
+	return binary.BigEndian.Uint32(head)
+}
+
+// setCount stores n in key's head record.
+func (m *MultiMap) setCount(key []byte, n uint32) error {
+	return m.ph.putLocked(m.slotKey(key, 0), m.headValue(n), 0)
+}
+
+// headValue returns the value of a head record holding count n.
+func (m *MultiMap) headValue(n uint32) []byte {
+	head := make([]byte, seqSize)
+	binary.BigEndian.PutUint32(head, n)
+	return m.slotValue(head)
+}
+
+// slotKey returns the slot key of key's value seq, or of its head for 0.
+func (m *MultiMap) slotKey(key []byte, seq uint32) []byte {
+	k := make([]byte, len(key)+seqSize)
+	copy(k, key)
+	binary.BigEndian.PutUint32(k[len(key):], seq)
+	return k
+}
+
+// slotValue pads value to the slot's value size.
+func (m *MultiMap) slotValue(value []byte) []byte {
+	if m.valueSize == 0 || uint32(len(value)) == m.ph.userValueSize() {
+		return value
+	}
+	v := make([]byte, m.ph.userValueSize())
+	copy(v, value)
+	return v
+}
+
+// userValue strips the padding slotValue added.
+func (m *MultiMap) userValue(v []byte) []byte {
+	if m.valueSize == 0 {
+		return v
+	}
+	return v[:m.valueSize]
+}
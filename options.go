@@ -0,0 +1,202 @@
+package phash
+
+import "time"
+
+// Options tunes a PersistentHash. The zero value gives the same behaviour
+// as Open.
+type Options struct {
+	// IncrementalResize spreads the rehash that follows a resize across the
+	// writes that come after it, instead of copying every slot inside the
+	// Put that crossed the load factor. While a resize is in flight Gets are
+	// served from whichever table holds the key.
+	//
+	// The old file stays untouched until the last slot has been migrated and
+	// the new file is renamed over it. Writes made in the meantime are also
+	// appended to filePath + ".grow", which Open replays into the old file
+	// if the process died mid-resize, so they survive it just as writes to
+	// the mapping do.
+	IncrementalResize bool
+
+	// ResizeStep is the number of old slots migrated by each write while an
+	// incremental resize is in progress, or per lock acquisition by the
+	// background resizer. Defaults to 128.
+	ResizeStep int
+
+	// BackgroundResize starts a resize as soon as the load factor crosses
+	// ResizeThreshold and migrates it from a separate goroutine, so no Put
+	// pays for the rehash. Writes made meanwhile land in the new table and
+	// in the resize log, so a throttled resize keeps them durable however
+	// long it runs; the log grows with them until the rename. It implies
+	// IncrementalResize.
+	BackgroundResize bool
+
+	// ResizeThreshold is the soft load factor at which a background resize
+	// is scheduled. Defaults to 0.6.
+	ResizeThreshold float32
+
+	// ResizeBytesPerSec caps how many bytes of slots the background resizer
+	// copies per second. Zero means no limit.
+	ResizeBytesPerSec int64
+
+	// OnResizeStart and OnResizeFinish are called around every resize.
+	// They run with the hash locked and must not call back into it.
+	OnResizeStart  func(ResizeInfo)
+	OnResizeFinish func(ResizeInfo)
+
+	// HashFunc selects the hash function for a new file. The seeded
+	// functions draw a random per-file seed that is stored in the header.
+	// Existing files always use the function they were created with.
+	HashFunc HashFunc
+
+	// Hasher supplies a custom hash function instead of HashFunc. A file
+	// created with one must be reopened with the same Hasher.
+	Hasher Hasher
+
+	// Layout selects the collision strategy for a new file. Existing files
+	// keep the layout they were created with.
+	Layout Layout
+
+	// MaxLoadFactor is the load factor above which the table is resized.
+	// Defaults to 0.9 for LayoutRobinHood and LayoutCuckoo and 0.7 otherwise.
+	MaxLoadFactor float32
+
+	// ValueLog stores values in an append-only companion file and keeps
+	// only a fixed (offset, length) pointer in each slot, so values may be
+	// any length and the valueSize passed to Open is ignored. Space from
+	// overwritten values is reclaimed by CompactValueLog. Set at creation.
+	ValueLog bool
+
+	// VarKeys accepts keys of any length; the keySize passed to Open is
+	// ignored. Each slot stores the key's length, its hash and its first
+	// KeyPrefix bytes, and longer keys are kept whole in an append-only
+	// overflow file, fetched only when hash and prefix already match.
+	// Set at creation.
+	VarKeys bool
+
+	// KeyPrefix is the number of key bytes stored inline in VarKeys mode.
+	// Keys no longer than this never touch the overflow file. Defaults to 16.
+	KeyPrefix int
+
+	// TTL adds an expiry time to every slot so entries can be written with
+	// PutWithTTL. Expired entries read as misses at once and a background
+	// reaper frees their slots. Set at creation.
+	TTL bool
+
+	// ReapInterval is how often the reaper of a TTL table scans it for
+	// expired entries. Defaults to one second; negative disables the
+	// reaper, leaving ReapExpired and overwrites to free slots.
+	ReapInterval time.Duration
+
+	// ReapBatch is the number of slots the reaper scans per acquisition of
+	// the write lock. Defaults to 4096.
+	ReapBatch int
+
+	// CacheCapacity, if positive, makes the table a cache of at most this
+	// many entries. The file is sized for it at creation and never grows;
+	// inserting into a full cache evicts an entry that has not been read
+	// or updated recently (CLOCK). Only LayoutLinear supports it. Set at
+	// creation.
+	CacheCapacity int
+
+	// OnEvict, if set, is called with each entry a cache evicts, under the
+	// write lock. It must not call back into the hash or keep the slices.
+	OnEvict func(key, value []byte)
+
+	// BloomFalsePositive, if positive, keeps a Bloom filter of the keys in
+	// a companion file, sized for this false positive rate, and has Get
+	// check it before probing so most misses cost one cache line.
+	// BloomStats reports how many probes it saved. Set at creation.
+	BloomFalsePositive float64
+
+	// Advice is passed to madvise for every mapping of the table, the
+	// first one at Open and each new one after a resize. Linux only;
+	// elsewhere it has no effect.
+	Advice Advice
+
+	// HugePages asks the kernel to back the mapping with transparent huge
+	// pages (MADV_HUGEPAGE). Linux only; elsewhere, or where the kernel
+	// cannot do it for the file, it has no effect.
+	HugePages bool
+
+	// Prefault reads the whole mapping in at Open and after each resize,
+	// so the first Gets on a large table do not take major page faults.
+	// Open takes as long as reading the file.
+	Prefault bool
+
+	// Lock mlocks the mapping so its pages are never swapped or evicted.
+	// The table must fit within RLIMIT_MEMLOCK. Linux only; elsewhere Open
+	// fails.
+	Lock bool
+
+	// Compress stores values compressed: trailing zero bytes are trimmed
+	// and the rest deflated, whichever is smallest. With ValueLog the log
+	// holds the compressed values. Without it they go in slots of
+	// CompressSlotSize bytes, and a value that does not fit spills to a
+	// value log; the value size must be at least CompressThreshold. Set at
+	// creation.
+	Compress bool
+
+	// CompressSlotSize is the size of the value field that Compress gives
+	// a table without ValueLog. Defaults to a quarter of the value size,
+	// and at least 16.
+	CompressSlotSize int
+
+	// CompressThreshold is the length below which values are stored as
+	// they are. Defaults to 64.
+	CompressThreshold int
+
+	// CompressDict is a preset dictionary for deflate, such as a sample of
+	// typical values. A file created with one must be opened with the
+	// same dictionary.
+	CompressDict []byte
+
+	// Encryption, if set, encrypts the table's keys and values with keys
+	// derived from the master key it provides. An encrypted file must be
+	// opened with the same master key. It cannot be combined with
+	// ValueLog or VarKeys, and counters are not available. Set at creation.
+	Encryption KeyProvider
+
+	// OnWarmupProgress, if set, is called by Warmup after each chunk it
+	// reads in.
+	OnWarmupProgress func(WarmupProgress)
+}
+
+// ResizeInfo describes a resize to the Options hooks.
+type ResizeInfo struct {
+	OldSlots   uint32
+	NewSlots   uint32
+	Entries    uint32        // keys in the table when the resize started
+	Background bool          // migrated by the background goroutine
+	Duration   time.Duration // set on finish
+	Err        error         // set on finish if the resize failed
+}
+
+// withDefaults returns a copy of opts with unset fields filled in.
+func (opts *Options) withDefaults() Options {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.ResizeStep <= 0 {
+		o.ResizeStep = 128
+	}
+	if o.ResizeThreshold <= 0 {
+		o.ResizeThreshold = 0.6
+	}
+	if o.BackgroundResize {
+		o.IncrementalResize = true
+	}
+	if o.KeyPrefix <= 0 {
+		o.KeyPrefix = 16
+	}
+	if o.ReapInterval == 0 {
+		o.ReapInterval = time.Second
+	}
+	if o.ReapBatch <= 0 {
+		o.ReapBatch = 4096
+	}
+	if o.CompressThreshold <= 0 {
+		o.CompressThreshold = 64
+	}
+	return o
+}
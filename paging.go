@@ -0,0 +1,106 @@
+package phash
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// Advice is an madvise hint for the pages of a table.
+type Advice int
+
+const (
+	// AdviceNormal leaves the kernel's default readahead in place.
+	AdviceNormal Advice = iota
+	// AdviceRandom turns readahead off, which suits point lookups on a
+	// table much larger than memory (MADV_RANDOM).
+	AdviceRandom
+	// AdviceSequential reads ahead aggressively (MADV_SEQUENTIAL).
+	AdviceSequential
+	// AdviceWillNeed starts reading the whole table in (MADV_WILLNEED).
+	AdviceWillNeed
+)
+
+// WarmupProgress reports how far Warmup has got.
+type WarmupProgress struct {
+	Done  int64 // bytes of the table read in so far
+	Total int64 // size of the table
+}
+
+// warmupChunk is how much Warmup reads per acquisition of the read lock.
+const warmupChunk = 4 << 20
+
+var pageSize = os.Getpagesize()
+
+// touchSink keeps the compiler from dropping the reads of a touch pass.
+var touchSink atomic.Uint32
+
+// prepareTable applies the paging options to a newly mapped table.
+func (ph *PersistentHash) prepareTable(t *table) error {
+	if ph.opts.Advice != AdviceNormal {
+		if err := advise(t.data, ph.opts.Advice); err != nil {
+			return fmt.Errorf("madvise failed: %w", err)
+		}
+	}
+	if ph.opts.HugePages {
+		if err := adviseHugePages(t.data); err != nil {
+			return fmt.Errorf("madvise failed: %w", err)
+		}
+	}
+	if ph.opts.Prefault {
+		if err := prefault(t.data); err != nil {
+			return fmt.Errorf("failed to prefault table: %w", err)
+		}
+	}
+	if ph.opts.Lock {
+		if err := mlock(t.data); err != nil {
+			return fmt.Errorf("failed to mlock table: %w", err)
+		}
+	}
+	return nil
+}
+
+// Warmup reads the whole table into memory so later Gets do not take major
+// page faults, reporting each step to Options.OnWarmupProgress. It takes
+// the read lock one chunk at a time, so it can run in its own goroutine
+// alongside other readers and writers; it returns ctx.Err() if ctx is
+// cancelled first. A resize in the meantime leaves the new table partly
+// cold.
+func (ph *PersistentHash) Warmup(ctx context.Context) error {
+	for done := int64(0); ; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		ph.mu.RLock()
+		total := int64(len(ph.data))
+		if done >= total {
+			ph.mu.RUnlock()
+			return nil
+		}
+		end := done + warmupChunk
+		if end > total {
+			end = total
+		}
+		chunk := ph.data[done:end]
+		// Ask for the chunk as a whole before faulting it page by page
+		advise(chunk, AdviceWillNeed)
+		touchPages(chunk)
+		ph.mu.RUnlock()
+
+		done = end
+		if ph.opts.OnWarmupProgress != nil {
+			ph.opts.OnWarmupProgress(WarmupProgress{Done: done, Total: total})
+		}
+	}
+}
+
+// touchPages faults in every page of b by reading a byte from each.
+func touchPages(b []byte) {
+	var sum byte
+	for i := 0; i < len(b); i += pageSize {
+		sum += b[i]
+	}
+	touchSink.Store(uint32(sum))
+}
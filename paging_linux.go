@@ -0,0 +1,47 @@
+package phash
+
+import "syscall"
+
+// madvPopulateRead is MADV_POPULATE_READ, new in Linux 5.14.
+const madvPopulateRead = 22
+
+// advise passes a to madvise for b.
+func advise(b []byte, a Advice) error {
+	advice := syscall.MADV_NORMAL
+	switch a {
+	case AdviceRandom:
+		advice = syscall.MADV_RANDOM
+	case AdviceSequential:
+		advice = syscall.MADV_SEQUENTIAL
+	case AdviceWillNeed:
+		advice = syscall.MADV_WILLNEED
+	}
+	return syscall.Madvise(b, advice)
+}
+
+// mlock locks the pages of b into memory.
+func mlock(b []byte) error {
+	return syscall.Mlock(b)
+}
+
+// adviseHugePages asks for transparent huge pages. Kernels and file
+// systems that cannot provide them for this mapping reject the advice
+// with EINVAL, which is not worth failing over.
+func adviseHugePages(b []byte) error {
+	if err := syscall.Madvise(b, syscall.MADV_HUGEPAGE); err != nil && err != syscall.EINVAL {
+		return err
+	}
+	return nil
+}
+
+// prefault reads every page of b in with a single MADV_POPULATE_READ,
+// falling back to a touch pass on kernels that predate it. Unlike
+// MAP_POPULATE it also works on a mapping that already exists.
+func prefault(b []byte) error {
+	err := syscall.Madvise(b, madvPopulateRead)
+	if err == syscall.EINVAL {
+		touchPages(b)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package phash
+
+import "errors"
+
+// advise does nothing: the syscall package only offers madvise on Linux.
+func advise(b []byte, a Advice) error {
+	return nil
+}
+
+// mlock fails: locking is only wired up on Linux.
+func mlock(b []byte) error {
+	return errors.New("Options.Lock is only supported on Linux")
+}
+
+// adviseHugePages does nothing: transparent huge pages are Linux only.
+func adviseHugePages(b []byte) error {
+	return nil
+}
+
+// prefault reads every page of b in with a touch pass.
+func prefault(b []byte) error {
+	touchPages(b)
+	return nil
+}
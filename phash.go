@@ -1,13 +1,16 @@
 package phash
 
 import (
-	"bytes"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 // This is a custom implementation designed for SPEED as the primary goal.
@@ -29,11 +32,36 @@ import (
 //   - Used Slots (4 bytes): Number of occupied slots (helps track load factor for resizing)
 //   - Key Size (4 bytes): Fixed size of each key in bytes
 //   - Value Size (4 bytes): Fixed size of each value in bytes
-//   - Slot Size (4 bytes): Total size of each slot (1 + keySize + valueSize)
+//   - Slot Size (4 bytes): Total size of each slot (1 + keySize + valueSize,
+//     padded to a multiple of 16 in LayoutCuckoo)
+//
+// - Version 2 extends the header to 128 bytes, zero-filled after these:
+//   - Hash Function (4 bytes): HashFunc used to place keys
+//   - Hash Seed (16 bytes): Random per-file seed for keyed hash functions
+//   - Layout (4 bytes): Collision strategy, see Layout
+//   - Flags (4 bytes): Optional features, see the flag* constants
+//   - Value Log Generation (4 bytes): Suffix of the live value log file
+//   - Value Log Live Bytes (8 bytes): Bytes of the log still referenced
+//   - Key Prefix (4 bytes): Inline key bytes per slot in VarKeys mode
+//   - Cache Capacity (4 bytes): Maximum number of entries in cache mode
+//   - Bloom False Positive Rate (4 bytes): float32 bits, see bloom.go
+//   - Plain Key Size (4 bytes): Caller's key size in an encrypted table
+//   - Key Check (8 bytes): Detects a wrong key, see encrypt.go
+//   - Dictionary Checksum (4 bytes): CRC-32 of the compression dictionary
+//   - Plain Value Size (4 bytes): Caller's value size when values are
+//     compressed into the slots, see compress.go
+//
+// - Control Bytes (LayoutSwiss only, 1 byte per slot): 0=empty, 1=deleted,
+//   0x80|7-bit hash fingerprint=occupied. Scanned 8 at a time by Get.
+//   Version 1 is still written whenever no extended feature is in use.
 //
 // - Data Section (variable size):
 //   - Array of slots, each containing:
-//     - Status byte (1 byte): 0=empty, 1=occupied, 2=deleted
+//     - Status byte (1 byte): 0=empty, 1=occupied, 2=deleted (LayoutSwiss)
+//       (cache mode: 0x80 set on occupied slots that were recently used)
+//       (LayoutRobinHood: 0=empty, otherwise probe distance + 1)
+//     LayoutCuckoo groups every 4 consecutive slots into a bucket that
+//     starts on a cache line
 //     - Key (keySize bytes): Fixed-size key data
 //     - Value (valueSize bytes): Fixed-size value data
 //
@@ -43,9 +71,24 @@ import (
 // - "Database Internals" by Alex Petrov (for persistent data structures)
 
 const (
-	magicNumber uint32 = 0x70687368 // ASCII for "phsh" (easter egg)
-	version     uint32 = 1
-	headerSize         = 7 * 4 // 7 uint32 fields
+	magicNumber  uint32 = 0x70687368 // ASCII for "phsh" (easter egg)
+	version      uint32 = 1
+	version2     uint32 = 2
+	headerSize          = 7 * 4 // 7 uint32 fields
+	headerSizeV2        = 128   // room for the extended fields below
+)
+
+// Feature flags stored in the version 2 header
+const (
+	flagValueLog   uint32 = 1 << iota // values live in a companion log file
+	flagVarKeys                       // slots hold encoded variable-length keys
+	flagTTL                           // slot values end with an expiry time
+	flagCache                         // fixed capacity with CLOCK eviction
+	flagBloom                         // keys are tracked in a Bloom filter
+	flagEncrypted                     // keys and values are encrypted
+	flagCompressed                    // values are compressed
+
+	knownFlags = flagValueLog | flagVarKeys | flagTTL | flagCache | flagBloom | flagEncrypted | flagCompressed
 )
 
 // persistent hash table implementation using memory-mapped files
@@ -54,19 +97,85 @@ const (
 // to resolve hash collisions. When load factor exceeds threshold, the
 // table is resized by creating a new file and rehashing all entries.
 type PersistentHash struct {
-	mu        sync.RWMutex
-	file      *os.File
-	data      []byte
+	mu sync.RWMutex
+	id uint64 // orders lock acquisition across hashes
+	table
 	filePath  string
 	keySize   uint32
 	valueSize uint32
 	slotSize  uint32
+	opts      Options
+
+	// Format details read from, or chosen for, the file header
+	formatVersion uint32
+	hdrSize       uint32
+	hashFunc      HashFunc
+	seed          [16]byte
+	hasher        Hasher // nil for the built-in FNV-1a fast path
+	layout        Layout
+	flags         uint32
+	keyPrefix     uint32 // VarKeys only
+	capacity      uint32 // cache mode only, 0 otherwise
+	bloomFP       float32
+
+	// plainValueSize is the caller's value size when values are compressed
+	// into the slots, 0 otherwise
+	plainValueSize uint32
+
+	vlog *valueLog // set in ValueLog mode and with Compress
+	klog *valueLog // overflow keys, set in VarKeys mode
+
+	crypt *sealer // set for an encrypted table
+
+	// db and name are set for a table stored in a DB file
+	db   *DB
+	name string
+
+	inMemory bool // no backing file, see OpenMemory
+
+	bloom        *bloomFilter // set when the file has a Bloom filter
+	bloomRemoved uint32       // removals since the filter was built
+
+	maxLoad float32 // load factor that triggers a resize
+
+	// carry and swap are scratch slots for Robin Hood displacement
+	carry, swap []byte
+
+	// grow is non-nil while an incremental resize is in progress.
+	grow *growState
+
+	// reapStop and reapDone stop and wait for the TTL reaper
+	reapStop, reapDone chan struct{}
+
+	// Cache mode state, not persisted
+	clockHand               uint32
+	hits, misses, evictions atomic.Uint64
+
+	bloomChecks, bloomSkipped, bloomFalse atomic.Uint64
+}
+
+// table is a memory-mapped slot array and the file backing it. A hash
+// normally has one; during an incremental resize it has two.
+type table struct {
+	base      uint32 // offset of slot 0
+	offset    int64  // start of the table in a DB file, 0 otherwise
+	file      *os.File
+	data      []byte
 	numSlots  uint32
 	usedSlots uint32
 }
 
+// lastID numbers open hashes so transactions lock them in a fixed order.
+var lastID atomic.Uint64
+
 // Open creates or opens a persistent hash table file
 func Open(filePath string, keySize, valueSize uint32) (*PersistentHash, error) {
+	return OpenWithOptions(filePath, keySize, valueSize, nil)
+}
+
+// OpenWithOptions is like Open but lets the caller tune the table's
+// behaviour. A nil opts is equivalent to Open.
+func OpenWithOptions(filePath string, keySize, valueSize uint32, opts *Options) (*PersistentHash, error) {
 	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file: %w", err)
@@ -78,19 +187,29 @@ func Open(filePath string, keySize, valueSize uint32) (*PersistentHash, error) {
 		return nil, fmt.Errorf("failed to stat file: %w", err)
 	}
 
+	ph := &PersistentHash{
+		id:        lastID.Add(1),
+		filePath:  filePath,
+		keySize:   keySize,
+		valueSize: valueSize,
+		slotSize:  1 + keySize + valueSize, // defined in spec above
+		opts:      opts.withDefaults(),
+	}
+
 	// Create a new file when the size is 0
 	if fi.Size() == 0 {
-		// TODO: Make this dynamic based on page size.
-		// via Go’s os.Getpagesize() or POSIX’s sysconf(_SC_PAGESIZE))
-		// Aligning to page boundaries avoids partial pages in your mmap()
-		// region (which can cause wasted space and extra page faults),
-		// ensures mmap length is valid, and often improves I/O throughput by matching the OS’s paging granularity.
-		// Benchmarking is needed to determine the optimal number of slots per page.
-		initialSlots := uint32(1024) // 1k slots.
+		if err := ph.initFormat(); err != nil {
+			file.Close()
+			return nil, err
+		}
 
-		slotSize := 1 + keySize + valueSize // defined in spec above
+		initialSlots, err := ph.initialSlots()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
 
-		fileSize := int64(headerSize + initialSlots*slotSize)
+		fileSize := int64(ph.slotsBase(initialSlots) + initialSlots*ph.slotSize)
 
 		// Truncation ensures that
 		// (1) our subsequent mmap() call can map the full region without error,
@@ -101,15 +220,7 @@ func Open(filePath string, keySize, valueSize uint32) (*PersistentHash, error) {
 			return nil, fmt.Errorf("failed to truncate file: %w", err)
 		}
 
-		header := make([]byte, headerSize) // A "slice" of bytes
-		binary.BigEndian.PutUint32(header[0:4], magicNumber)
-		binary.BigEndian.PutUint32(header[4:8], version)
-		binary.BigEndian.PutUint32(header[8:12], initialSlots)
-		binary.BigEndian.PutUint32(header[12:16], 0)
-		binary.BigEndian.PutUint32(header[16:20], slotSize)
-		binary.BigEndian.PutUint32(header[20:24], keySize)
-		binary.BigEndian.PutUint32(header[24:28], valueSize)
-
+		header := ph.headerBytes(initialSlots) // A "slice" of bytes
 		if _, err := file.WriteAt(header, 0); err != nil {
 			file.Close()
 			return nil, fmt.Errorf("failed to write header: %w", err)
@@ -140,37 +251,295 @@ func Open(filePath string, keySize, valueSize uint32) (*PersistentHash, error) {
 		return nil, fmt.Errorf("mmap failed: %w", err)
 	}
 
+	if err := ph.attach(file, data); err != nil {
+		syscall.Munmap(data)
+		file.Close()
+		return nil, err
+	}
+
+	ph.startReaper()
+	return ph, nil
+}
+
+// initialSlots returns the number of slots a new table starts with.
+func (ph *PersistentHash) initialSlots() (uint32, error) {
+	if ph.capacity > 0 {
+		return ph.cacheSlots()
+	}
+	// TODO: Make this dynamic based on page size.
+	// via Go’s os.Getpagesize() or POSIX’s sysconf(_SC_PAGESIZE))
+	// Aligning to page boundaries avoids partial pages in your mmap()
+	// region (which can cause wasted space and extra page faults),
+	// ensures mmap length is valid, and often improves I/O throughput by matching the OS’s paging granularity.
+	// Benchmarking is needed to determine the optimal number of slots per page.
+	return 1024, nil // 1k slots.
+}
+
+// attach validates the mapped table data, the file or region backing it,
+// and opens whatever companion files its format needs. On failure the
+// caller still owns file and data.
+func (ph *PersistentHash) attach(file *os.File, data []byte) error {
 	// Validate the magic number for when an existing file is opened.
 	// This is to ensure the file is a valid phash file.
 	magic := binary.BigEndian.Uint32(data[0:4])
 	if magic != magicNumber {
-		syscall.Munmap(data)
-		file.Close()
-		return nil, errors.New("invalid magic number")
+		return errors.New("invalid magic number")
 	}
 
-	ph := &PersistentHash{
+	if err := ph.loadHeader(data); err != nil {
+		return err
+	}
+	ph.table = table{
 		file:      file,
 		data:      data,
-		filePath:  filePath,
 		numSlots:  binary.BigEndian.Uint32(data[8:12]),
 		usedSlots: binary.BigEndian.Uint32(data[12:16]),
-		slotSize:  binary.BigEndian.Uint32(data[16:20]),
-		keySize:   binary.BigEndian.Uint32(data[20:24]),
-		valueSize: binary.BigEndian.Uint32(data[24:28]),
+	}
+	ph.base = ph.slotsBase(ph.numSlots)
+	if err := ph.prepareTable(&ph.table); err != nil {
+		return err
 	}
 
-	return ph, nil
+	if ph.flags&(flagValueLog|flagCompressed) != 0 {
+		if err := ph.openValueLog(); err != nil {
+			return err
+		}
+	}
+	if ph.flags&flagVarKeys != 0 {
+		if err := ph.openKeyLog(); err != nil {
+			ph.closeLogs()
+			return err
+		}
+	}
+	if ph.flags&flagBloom != 0 {
+		if err := ph.openBloom(); err != nil {
+			ph.closeLogs()
+			return err
+		}
+	}
+
+	// Write logs a batch before it finishes any resize in flight, so a
+	// resize log holds older writes than a batch log next to it
+	err := ph.replayGrow()
+	if err == nil {
+		err = ph.replayBatch()
+	}
+	if err != nil {
+		if ph.bloom != nil {
+			ph.bloom.close(false)
+		}
+		ph.closeLogs()
+		return err
+	}
+	return nil
+}
+
+// initFormat picks the on-disk format for a new file. Files that only use
+// the defaults keep the original version 1 header so that older releases
+// can still open them.
+func (ph *PersistentHash) initFormat() error {
+	ph.formatVersion = version
+	ph.hdrSize = headerSize
+
+	ph.hashFunc = ph.opts.HashFunc
+	if ph.opts.Hasher != nil {
+		ph.hashFunc = HashCustom
+	}
+	ph.layout = ph.opts.Layout
+
+	if ph.opts.ValueLog {
+		ph.flags |= flagValueLog
+		ph.valueSize = valuePointerSize
+	}
+	if ph.opts.Compress {
+		ph.flags |= flagCompressed
+		if !ph.opts.ValueLog {
+			if err := ph.initSlotCompression(); err != nil {
+				return err
+			}
+		}
+	}
+	if ph.opts.VarKeys {
+		ph.flags |= flagVarKeys
+		ph.keyPrefix = uint32(ph.opts.KeyPrefix)
+		ph.keySize = varKeyHeaderSize + ph.keyPrefix + 8
+	}
+	var plainKeySize uint32
+	if ph.opts.Encryption != nil {
+		if ph.opts.ValueLog || ph.opts.VarKeys || ph.opts.Compress {
+			return errors.New("encryption does not support ValueLog, VarKeys or Compress")
+		}
+		ph.flags |= flagEncrypted
+		plainKeySize = ph.keySize
+		ph.valueSize += sealOverhead + ph.keySize
+		ph.keySize = sealedKeySize
+	}
+	if ph.opts.TTL {
+		ph.flags |= flagTTL
+		ph.valueSize += expirySize
+	}
+	if ph.opts.CacheCapacity > 0 {
+		if ph.layout != LayoutLinear {
+			return errors.New("cache mode needs LayoutLinear")
+		}
+		if uint64(ph.opts.CacheCapacity) > math.MaxUint32 {
+			return errors.New("cache capacity too large")
+		}
+		ph.flags |= flagCache
+		ph.capacity = uint32(ph.opts.CacheCapacity)
+	}
+	if fp := ph.opts.BloomFalsePositive; fp != 0 {
+		if !(fp > 0 && fp < 1) {
+			return errors.New("bloom false positive rate must be between 0 and 1")
+		}
+		ph.flags |= flagBloom
+		ph.bloomFP = float32(fp)
+	}
+	ph.slotSize = 1 + ph.keySize + ph.valueSize
+	if ph.layout == LayoutCuckoo {
+		ph.slotSize = (ph.slotSize + cuSlotAlign - 1) / cuSlotAlign * cuSlotAlign
+	}
+
+	if ph.hashFunc != HashFNV1a || ph.layout != LayoutLinear || ph.flags != 0 {
+		ph.formatVersion = version2
+		ph.hdrSize = headerSizeV2
+		if _, err := rand.Read(ph.seed[:]); err != nil {
+			return fmt.Errorf("failed to generate hash seed: %w", err)
+		}
+	}
+	if ph.flags&flagEncrypted != 0 {
+		return ph.openSealer(plainKeySize, nil)
+	}
+	return nil
+}
+
+// headerBytes encodes the file header for a table of numSlots slots.
+func (ph *PersistentHash) headerBytes(numSlots uint32) []byte {
+	header := make([]byte, ph.hdrSize)
+	binary.BigEndian.PutUint32(header[0:4], magicNumber)
+	binary.BigEndian.PutUint32(header[4:8], ph.formatVersion)
+	binary.BigEndian.PutUint32(header[8:12], numSlots)
+	binary.BigEndian.PutUint32(header[12:16], 0)
+	binary.BigEndian.PutUint32(header[16:20], ph.slotSize)
+	binary.BigEndian.PutUint32(header[20:24], ph.keySize)
+	binary.BigEndian.PutUint32(header[24:28], ph.valueSize)
+
+	if ph.formatVersion >= version2 {
+		binary.BigEndian.PutUint32(header[28:32], uint32(ph.hashFunc))
+		copy(header[32:48], ph.seed[:])
+		binary.BigEndian.PutUint32(header[48:52], uint32(ph.layout))
+		binary.BigEndian.PutUint32(header[52:56], ph.flags)
+		if ph.vlog != nil {
+			binary.BigEndian.PutUint32(header[56:60], ph.vlog.gen)
+			binary.BigEndian.PutUint64(header[60:68], uint64(ph.vlog.live))
+		}
+		binary.BigEndian.PutUint32(header[68:72], ph.keyPrefix)
+		binary.BigEndian.PutUint32(header[72:76], ph.capacity)
+		binary.BigEndian.PutUint32(header[76:80], math.Float32bits(ph.bloomFP))
+		if ph.crypt != nil {
+			binary.BigEndian.PutUint32(header[80:84], ph.crypt.keySize)
+			copy(header[84:92], ph.crypt.check[:])
+		}
+		if ph.flags&flagCompressed != 0 {
+			binary.BigEndian.PutUint32(header[92:96], dictChecksum(ph.opts.CompressDict))
+		}
+		binary.BigEndian.PutUint32(header[96:100], ph.plainValueSize)
+	}
+	return header
+}
+
+// loadHeader reads the table geometry and format from a mapped header.
+// The file always wins over what the caller asked for in Open.
+func (ph *PersistentHash) loadHeader(data []byte) error {
+	ph.formatVersion = binary.BigEndian.Uint32(data[4:8])
+	switch ph.formatVersion {
+	case version:
+		ph.hdrSize = headerSize
+		ph.hashFunc = HashFNV1a
+		ph.layout = LayoutLinear
+	case version2:
+		if len(data) < headerSizeV2 {
+			return errors.New("truncated header")
+		}
+		ph.hdrSize = headerSizeV2
+		ph.hashFunc = HashFunc(binary.BigEndian.Uint32(data[28:32]))
+		copy(ph.seed[:], data[32:48])
+		ph.layout = Layout(binary.BigEndian.Uint32(data[48:52]))
+		if ph.layout > LayoutCuckoo {
+			return fmt.Errorf("unknown layout %d", ph.layout)
+		}
+		ph.flags = binary.BigEndian.Uint32(data[52:56])
+		if ph.flags&^knownFlags != 0 {
+			return fmt.Errorf("unsupported feature flags %#x", ph.flags&^knownFlags)
+		}
+		ph.keyPrefix = binary.BigEndian.Uint32(data[68:72])
+		ph.capacity = binary.BigEndian.Uint32(data[72:76])
+		ph.bloomFP = math.Float32frombits(binary.BigEndian.Uint32(data[76:80]))
+		ph.plainValueSize = binary.BigEndian.Uint32(data[96:100])
+	default:
+		return fmt.Errorf("unsupported format version %d", ph.formatVersion)
+	}
+
+	ph.slotSize = binary.BigEndian.Uint32(data[16:20])
+	ph.keySize = binary.BigEndian.Uint32(data[20:24])
+	ph.valueSize = binary.BigEndian.Uint32(data[24:28])
+
+	// A new file already has its keys, derived in initFormat
+	if ph.flags&flagEncrypted == 0 {
+		if ph.opts.Encryption != nil {
+			return errors.New("encryption key given for a file that is not encrypted")
+		}
+	} else if ph.crypt == nil {
+		if err := ph.openSealer(binary.BigEndian.Uint32(data[80:84]), data[84:92]); err != nil {
+			return err
+		}
+	}
+
+	hasher, err := newHasher(ph.hashFunc, ph.seed, ph.opts.Hasher)
+	if err != nil {
+		return err
+	}
+	ph.hasher = hasher
+
+	ph.maxLoad = ph.opts.MaxLoadFactor
+	if ph.maxLoad <= 0 {
+		ph.maxLoad = ph.layout.defaultMaxLoad()
+	}
+	return nil
 }
 
 // Close closes the hash table and flushes changes to disk
 func (ph *PersistentHash) Close() error {
+	ph.stopReaper()
+
 	ph.mu.Lock()
 	defer ph.mu.Unlock()
 
+	// Finish any resize in flight so the file on disk holds every entry.
+	if ph.grow != nil {
+		if err := ph.migrate(ph.numSlots); err != nil {
+			return err
+		}
+	}
+
+	if ph.bloom != nil {
+		if err := ph.bloom.close(true); err != nil {
+			return err
+		}
+	}
 	if err := syscall.Munmap(ph.data); err != nil {
 		return err
 	}
+	if err := ph.closeLogs(); err != nil {
+		return err
+	}
+	if ph.db != nil {
+		ph.db.detach(ph)
+		return nil
+	}
+	if ph.inMemory {
+		return nil
+	}
 	return ph.file.Close()
 }
 
@@ -179,12 +548,31 @@ func (ph *PersistentHash) Put(key, value []byte) error {
 	ph.mu.Lock()
 	defer ph.mu.Unlock()
 
-	if uint32(len(key)) != ph.keySize || uint32(len(value)) != ph.valueSize {
+	return ph.putLocked(key, value, 0)
+}
+
+// putLocked is Put for callers that already hold the write lock, with the
+// entry's expiry in TTL mode.
+func (ph *PersistentHash) putLocked(key, value []byte, expiry int64) error {
+	if ph.vlog != nil {
+		return ph.putLogged(key, value, expiry)
+	}
+
+	if uint32(len(value)) != ph.userValueSize() {
 		return errors.New("invalid key/value size")
 	}
+	enc, err := ph.storeKey(key)
+	if err != nil {
+		return err
+	}
+	if ph.crypt != nil {
+		if value, err = ph.crypt.seal(enc, key, value); err != nil {
+			return err
+		}
+	}
 
 	// Try to insert with retries after potential resizes
-	return ph.putWithRetry(key, value, 0)
+	return ph.putWithRetry(enc, ph.appendExpiry(value, expiry), 0)
 }
 
 // putWithRetry handles the actual insertion, with a retry mechanism for resizes
@@ -194,45 +582,168 @@ func (ph *PersistentHash) putWithRetry(key, value []byte, retryCount int) error
 		return fmt.Errorf("exceeded maximum retry count (%d) during Put operation", retryCount)
 	}
 
-	hash := hashKey(key)
-	idx := hash % ph.numSlots
-
-	for i := uint32(0); i < ph.numSlots; i++ {
-		currentIdx := (idx + i) % ph.numSlots
-		slotStart := headerSize + currentIdx*ph.slotSize
-
-		switch ph.data[slotStart] {
-		case 0: // Empty slot
-			// Check if resize is needed
-			loadFactor := float32(ph.usedSlots+1) / float32(ph.numSlots)
-			if loadFactor > 0.7 {
-				fmt.Printf("Resize triggered at load factor %.2f (%d/%d slots used)\n",
-					loadFactor, ph.usedSlots+1, ph.numSlots)
-				if err := ph.resize(); err != nil {
-					return fmt.Errorf("resize failed: %w", err)
-				}
-				// After resize, retry the Put operation with incremented retry count
-				return ph.putWithRetry(key, value, retryCount+1)
-			}
+	if ph.grow != nil {
+		return ph.growPut(key, value, retryCount)
+	}
+
+	idx, found := ph.findSlot(&ph.table, key)
+	if found {
+		// Update existing key
+		slotStart := ph.base + idx*ph.slotSize
+		copy(ph.data[slotStart+1+ph.keySize:], value)
+		ph.touch(&ph.table, idx)
+		return nil
+	}
+	if idx == ph.numSlots {
+		return errors.New("hash table full")
+	}
 
-			// Insert the key-value pair
-			copy(ph.data[slotStart+1:], key)
-			copy(ph.data[slotStart+1+ph.keySize:], value)
-			ph.data[slotStart] = 1
-			ph.usedSlots++
-			binary.BigEndian.PutUint32(ph.data[12:16], ph.usedSlots)
-			return nil
-
-		case 1: // Occupied slot
-			if bytes.Equal(key, ph.data[slotStart+1:slotStart+1+ph.keySize]) {
-				// Update existing key
-				copy(ph.data[slotStart+1+ph.keySize:], value)
-				return nil
+	inserted, err := ph.tryInsert(idx, key, value)
+	if inserted || err != nil {
+		return err
+	}
+
+	loadFactor := float32(ph.usedSlots+1) / float32(ph.numSlots)
+	fmt.Printf("Resize triggered at load factor %.2f (%d/%d slots used)\n",
+		loadFactor, ph.usedSlots+1, ph.numSlots)
+	if err := ph.resize(); err != nil {
+		return fmt.Errorf("resize failed: %w", err)
+	}
+	// After resize, retry the Put operation with incremented retry count
+	return ph.putWithRetry(key, value, retryCount+1)
+}
+
+// tryInsert adds key, known to be absent, at the hint idx from findSlot
+// unless the table is due to grow first. It reports false when the caller
+// must resize and retry.
+func (ph *PersistentHash) tryInsert(idx uint32, key, value []byte) (bool, error) {
+	// A cache never grows; it makes room instead
+	if ph.capacity > 0 {
+		if ph.usedSlots >= ph.capacity {
+			if err := ph.evict(); err != nil {
+				return false, err
 			}
+			// The victim may have been on key's probe path, leaving the
+			// hint past a slot that is now empty
+			idx, _ = ph.findSlot(&ph.table, key)
+		}
+		return true, ph.insert(&ph.table, idx, key, value)
+	}
+
+	// Check if resize is needed
+	loadFactor := float32(ph.usedSlots+1) / float32(ph.numSlots)
+	if loadFactor > ph.maxLoad {
+		return false, nil
+	}
+
+	// Insert the key-value pair
+	err := ph.insert(&ph.table, idx, key, value)
+	if err == errProbeTooLong {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if ph.opts.BackgroundResize && float32(ph.usedSlots)/float32(ph.numSlots) > ph.opts.ResizeThreshold {
+		// The Put itself succeeded; a failure here is reported to the
+		// OnResizeFinish hook and retried when the hard limit is reached.
+		ph.resize()
+	}
+	return true, nil
+}
+
+// linearFind walks the linear probe sequence for key in t. It returns the
+// index of the slot holding key, or the index of the first free slot and
+// false if key is absent. t.numSlots is returned when there is neither.
+func (ph *PersistentHash) linearFind(t *table, key []byte) (uint32, bool) {
+	idx := uint32(ph.hash(key) % uint64(t.numSlots))
+
+	for i := uint32(0); i < t.numSlots; i++ {
+		currentIdx := (idx + i) % t.numSlots
+		slotStart := t.base + currentIdx*ph.slotSize
+
+		if t.data[slotStart] == 0 {
+			return currentIdx, false
+		}
+		if ph.keyEqual(t.data[slotStart+1:slotStart+1+ph.keySize], key) {
+			return currentIdx, true
+		}
+	}
+
+	return t.numSlots, false
+}
+
+// linearRemove empties slot idx and shifts back the entries after it that
+// would otherwise be cut off from their home slot, so deletes leave no
+// tombstones for later probes to walk. The caller updates the used count.
+func (ph *PersistentHash) linearRemove(t *table, idx uint32) {
+	n := uint64(t.numSlots)
+	hole := idx
+	for next := (hole + 1) % t.numSlots; t.data[t.base+next*ph.slotSize] != 0; next = (next + 1) % t.numSlots {
+		// An entry may move into the hole unless its home lies cyclically
+		// after the hole, up to and including where it is now
+		slotStart := t.base + next*ph.slotSize
+		home := ph.hash(t.data[slotStart+1:slotStart+1+ph.keySize]) % n
+		if (uint64(next)+n-home)%n >= (uint64(next)+n-uint64(hole))%n {
+			holeStart := t.base + hole*ph.slotSize
+			copy(t.data[holeStart:holeStart+ph.slotSize], t.data[slotStart:slotStart+ph.slotSize])
+			hole = next
 		}
 	}
+	t.data[t.base+hole*ph.slotSize] = 0
+}
+
+// insertAt writes a new entry into the free slot idx of t and bumps the
+// used count in both the struct and the file header.
+func (ph *PersistentHash) insertAt(t *table, idx uint32, key, value []byte) {
+	slotStart := t.base + idx*ph.slotSize
+	copy(t.data[slotStart+1:slotStart+1+ph.keySize], key)
+	copy(t.data[slotStart+1+ph.keySize:], value)
+	t.data[slotStart] = 1
+	t.usedSlots++
+	binary.BigEndian.PutUint32(t.data[12:16], t.usedSlots)
+}
+
+// Delete removes key from the hash table and reports whether it was present
+func (ph *PersistentHash) Delete(key []byte) bool {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	return ph.removeLocked(key)
+}
+
+// removeLocked is Delete for callers that already hold the write lock.
+func (ph *PersistentHash) removeLocked(key []byte) bool {
+	key, ok := ph.encodeKey(key)
+	if !ok {
+		return false
+	}
+
+	if ph.grow != nil && !ph.opts.BackgroundResize {
+		// A failed step leaves the resize in place for the next write to retry
+		ph.migrate(uint32(ph.opts.ResizeStep))
+	}
+	if ph.vlog != nil {
+		ph.releaseLogged(key)
+	}
+	return ph.deleteLocked(key)
+}
+
+// deleteLocked removes key from whichever tables hold it.
+func (ph *PersistentHash) deleteLocked(key []byte) bool {
+	if ph.grow != nil {
+		if _, _, found := ph.lookup(key); !found {
+			return false
+		}
+		return ph.growDelete(key)
+	}
 
-	return errors.New("hash table full")
+	idx, found := ph.findSlot(&ph.table, key)
+	if !found {
+		return false
+	}
+	ph.removeAt(&ph.table, idx)
+	return true
 }
 
 // Get retrieves a value from the hash table by key
@@ -240,84 +751,209 @@ func (ph *PersistentHash) Get(key []byte) ([]byte, bool) {
 	ph.mu.RLock()
 	defer ph.mu.RUnlock()
 
-	if uint32(len(key)) != ph.keySize {
+	val, found := ph.getLocked(key)
+	if ph.capacity > 0 {
+		if found {
+			ph.hits.Add(1)
+		} else {
+			ph.misses.Add(1)
+		}
+	}
+	return val, found
+}
+
+// getLocked is Get for callers that already hold the lock.
+func (ph *PersistentHash) getLocked(key []byte) ([]byte, bool) {
+	key, ok := ph.encodeKey(key)
+	if !ok {
+		return nil, false
+	}
+	if ph.bloom != nil && ph.bloomMiss(key) {
 		return nil, false
 	}
 
-	hash := hashKey(key)
-	idx := hash % ph.numSlots
+	t, idx, found := ph.lookup(key)
+	if !found {
+		if ph.bloom != nil {
+			ph.bloomFalse.Add(1)
+		}
+		return nil, false
+	}
+
+	slotStart := t.base + idx*ph.slotSize
+	field, expiry := ph.splitExpiry(ph.valueField(t.data, slotStart))
+	if expired(expiry) {
+		return nil, false
+	}
+	ph.touch(t, idx)
+	if ph.vlog != nil {
+		val, err := ph.loadValue(field)
+		return val, err == nil
+	}
+	if ph.crypt != nil {
+		_, val, err := ph.crypt.open(key, field)
+		return val, err == nil
+	}
 
-	for i := uint32(0); i < ph.numSlots; i++ {
-		currentIdx := (idx + i) % ph.numSlots
-		slotStart := headerSize + currentIdx*ph.slotSize
+	val := make([]byte, len(field))
+	copy(val, field)
+	return val, true
+}
 
-		switch ph.data[slotStart] {
-		case 0:
-			return nil, false
-		case 1:
-			if bytes.Equal(key, ph.data[slotStart+1:slotStart+1+ph.keySize]) {
-				val := make([]byte, ph.valueSize)
-				copy(val, ph.data[slotStart+1+ph.keySize:slotStart+ph.slotSize])
-				return val, true
-			}
+// lookup finds the live copy of key, consulting the resize target first
+// while an incremental resize is in progress.
+func (ph *PersistentHash) lookup(key []byte) (*table, uint32, bool) {
+	if g := ph.grow; g != nil {
+		if idx, found := ph.findSlot(&g.next, key); found {
+			return &g.next, idx, true
 		}
+		// Old slots below the cursor have already been copied, so a hit
+		// there means the key has since been removed from the new table.
+		idx, found := ph.findSlot(&ph.table, key)
+		if !found || idx < g.cursor {
+			return nil, 0, false
+		}
+		if _, ok := g.shadowed[idx]; ok {
+			return nil, 0, false
+		}
+		return &ph.table, idx, true
 	}
 
-	return nil, false
+	idx, found := ph.findSlot(&ph.table, key)
+	return &ph.table, idx, found
 }
 
+// resize doubles the table. By default the rehash happens here, under
+// the caller's write lock; with Options.IncrementalResize it only sets up
+// the new table and later writes migrate entries a few slots at a time.
 func (ph *PersistentHash) resize() error {
+	// Use fixed increase for predictability
+	if err := ph.beginResize(ph.numSlots * 2); err != nil {
+		return err
+	}
+	if ph.opts.BackgroundResize {
+		go ph.backgroundMigrate(ph.grow)
+		return nil
+	}
+	if ph.opts.IncrementalResize {
+		return nil
+	}
+
+	fmt.Printf("Copying data to new hash table\n")
+	return ph.migrate(ph.numSlots)
+}
+
+// beginResize creates and maps a table of newNumSlots at filePath + ".tmp",
+// or in a free region of the file for a table in a DB.
+func (ph *PersistentHash) beginResize(newNumSlots uint32) error {
 	fmt.Printf("Starting resize: current slots=%d, used=%d\n", ph.numSlots, ph.usedSlots)
 
-	// Use fixed increase for predictability
-	newNumSlots := ph.numSlots * 2
+	info := ResizeInfo{
+		OldSlots:   ph.numSlots,
+		NewSlots:   newNumSlots,
+		Entries:    ph.usedSlots,
+		Background: ph.opts.BackgroundResize,
+	}
+	if ph.opts.OnResizeStart != nil {
+		ph.opts.OnResizeStart(info)
+	}
+	started := time.Now()
+
+	// fail reports err to the finish hook
+	fail := func(err error) error {
+		if ph.opts.OnResizeFinish != nil {
+			info.Duration = time.Since(started)
+			info.Err = err
+			ph.opts.OnResizeFinish(info)
+		}
+		return err
+	}
+
+	var next table
+	var err error
+	switch {
+	case ph.db != nil:
+		next, err = ph.db.newRegion(ph, newNumSlots)
+	case ph.inMemory:
+		next, err = ph.anonTable(newNumSlots)
+	default:
+		next, err = ph.createTemp(newNumSlots)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if err := ph.prepareTable(&next); err != nil {
+		ph.dropTable(&next)
+		return fail(err)
+	}
+
+	var bloom *bloomFilter
+	if ph.bloom != nil {
+		if bloom, err = ph.bloomFor(ph.bloomPath()+".tmp", newNumSlots); err != nil {
+			ph.dropTable(&next)
+			return fail(err)
+		}
+	}
+
+	ph.grow = &growState{
+		bloom:    bloom,
+		next:     next,
+		pending:  ph.usedSlots,
+		shadowed: make(map[uint32]struct{}),
+		info:     info,
+		started:  started,
+	}
+	return nil
+}
+
+// createTemp creates and maps an empty table of numSlots at
+// filePath + ".tmp" to resize into.
+func (ph *PersistentHash) createTemp(numSlots uint32) (table, error) {
 	tmpPath := ph.filePath + ".tmp"
 
 	// Remove any existing temporary file
 	os.Remove(tmpPath)
 
-	fmt.Printf("Creating temp file: %s with %d slots\n", tmpPath, newNumSlots)
+	fmt.Printf("Creating temp file: %s with %d slots\n", tmpPath, numSlots)
+
+	// fail cleans up the temp file
+	var tmpFile *os.File
+	fail := func(err error) (table, error) {
+		if tmpFile != nil {
+			tmpFile.Close()
+		}
+		os.Remove(tmpPath)
+		return table{}, err
+	}
+
 	tmpFile, err := os.Create(tmpPath)
 	if err != nil {
-		return fmt.Errorf("failed to create temp file for resize: %w", err)
+		return fail(fmt.Errorf("failed to create temp file for resize: %w", err))
 	}
-	defer tmpFile.Close()
 
-	newSlotSize := ph.slotSize
-	newFileSize := int64(headerSize + newNumSlots*newSlotSize)
+	newFileSize := int64(ph.slotsBase(numSlots) + numSlots*ph.slotSize)
 	fmt.Printf("Truncating temp file to size: %d bytes\n", newFileSize)
 	if err := tmpFile.Truncate(newFileSize); err != nil {
-		os.Remove(tmpPath)
-		return fmt.Errorf("failed to truncate temp file: %w", err)
+		return fail(fmt.Errorf("failed to truncate temp file: %w", err))
 	}
 
-	// Write header data
-	header := make([]byte, headerSize)
-	binary.BigEndian.PutUint32(header[0:4], magicNumber)
-	binary.BigEndian.PutUint32(header[4:8], version)
-	binary.BigEndian.PutUint32(header[8:12], newNumSlots)
-	binary.BigEndian.PutUint32(header[12:16], 0) // Reset used slots
-	binary.BigEndian.PutUint32(header[16:20], newSlotSize)
-	binary.BigEndian.PutUint32(header[20:24], ph.keySize)
-	binary.BigEndian.PutUint32(header[24:28], ph.valueSize)
+	// Write header data, with used slots reset
+	header := ph.headerBytes(numSlots)
 
 	fmt.Printf("Writing header to temp file\n")
 	if _, err := tmpFile.WriteAt(header, 0); err != nil {
-		os.Remove(tmpPath)
-		return fmt.Errorf("failed to write header to temp file: %w", err)
+		return fail(fmt.Errorf("failed to write header to temp file: %w", err))
 	}
 
 	// Flush to ensure the header is written
 	if err := tmpFile.Sync(); err != nil {
-		os.Remove(tmpPath)
-		return fmt.Errorf("failed to sync temp file: %w", err)
+		return fail(fmt.Errorf("failed to sync temp file: %w", err))
 	}
 
 	// Get actual file size
 	fi, err := tmpFile.Stat()
 	if err != nil {
-		os.Remove(tmpPath)
-		return fmt.Errorf("failed to stat temp file: %w", err)
+		return fail(fmt.Errorf("failed to stat temp file: %w", err))
 	}
 	tempFileSize := int(fi.Size())
 	fmt.Printf("Actual temp file size: %d bytes\n", tempFileSize)
@@ -326,90 +962,94 @@ func (ph *PersistentHash) resize() error {
 	fmt.Printf("Memory mapping temp file\n")
 	tmpData, err := syscall.Mmap(int(tmpFile.Fd()), 0, tempFileSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
 	if err != nil {
-		os.Remove(tmpPath)
-		return fmt.Errorf("failed to mmap temp file: %w", err)
+		return fail(fmt.Errorf("failed to mmap temp file: %w", err))
 	}
-	defer syscall.Munmap(tmpData)
 
-	fmt.Printf("Copying data to new hash table\n")
-	// Rehash all existing entries
-	usedCount := uint32(0)
-	for i := uint32(0); i < ph.numSlots && usedCount < ph.usedSlots; i++ {
-		slotStart := headerSize + i*ph.slotSize
-		if ph.data[slotStart] == 1 {
-			usedCount++
-			key := ph.data[slotStart+1 : slotStart+1+ph.keySize]
-			value := ph.data[slotStart+1+ph.keySize : slotStart+ph.slotSize]
-
-			hash := hashKey(key)
-			idx := hash % newNumSlots
-
-			foundSlot := false
-			for j := uint32(0); j < newNumSlots; j++ {
-				currentIdx := (idx + j) % newNumSlots
-				newSlotStart := headerSize + currentIdx*newSlotSize
-
-				if tmpData[newSlotStart] == 0 {
-					// Copy the key-value pair
-					copy(tmpData[newSlotStart+1:], key)
-					copy(tmpData[newSlotStart+1+ph.keySize:], value)
-					tmpData[newSlotStart] = 1
-					foundSlot = true
-
-					// Update used slots count
-					usedSlotsCount := binary.BigEndian.Uint32(tmpData[12:16]) + 1
-					binary.BigEndian.PutUint32(tmpData[12:16], usedSlotsCount)
-					break
-				}
-			}
+	return table{
+		base:     ph.slotsBase(numSlots),
+		file:     tmpFile,
+		data:     tmpData,
+		numSlots: numSlots,
+	}, nil
+}
 
-			if !foundSlot {
-				return fmt.Errorf("failed to find slot for key during resize")
-			}
-		}
+// dropTable unmaps a table that was never put into service and removes
+// its file or frees its region.
+func (ph *PersistentHash) dropTable(t *table) {
+	syscall.Munmap(t.data)
+	if ph.db != nil {
+		ph.db.freeRegion(t.offset)
+		return
 	}
+	if ph.inMemory {
+		return
+	}
+	t.file.Close()
+	os.Remove(ph.filePath + ".tmp")
+}
+
+// abortResize throws away the table being built by an unfinished resize.
+func (ph *PersistentHash) abortResize(err error) {
+	g := ph.grow
+	ph.dropTable(&g.next)
+	if g.bloom != nil {
+		g.bloom.close(false)
+		os.Remove(ph.bloomPath() + ".tmp")
+	}
+	ph.closeGrowLog(g, true)
+	ph.grow = nil
+	ph.resizeFinished(g, err)
+}
+
+// finishResize retires the old table once every slot has been migrated and
+// moves the new one into place with an atomic rename.
+func (ph *PersistentHash) finishResize() error {
+	g := ph.grow
+	old := ph.table
 
 	// Close and unmap original file
 	fmt.Printf("Unmapping and closing original file\n")
-	syscall.Munmap(ph.data)
-	ph.file.Close()
-
-	// Rename temporary file to original
-	fmt.Printf("Renaming temp file to original\n")
-	if err := os.Rename(tmpPath, ph.filePath); err != nil {
-		return fmt.Errorf("failed to rename temp file: %w", err)
+	syscall.Munmap(old.data)
+	if old.file != nil && ph.db == nil {
+		old.file.Close()
 	}
 
-	// Reopen the file
-	fmt.Printf("Reopening the file\n")
-	file, err := os.OpenFile(ph.filePath, os.O_RDWR, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to reopen file after resize: %w", err)
+	ph.table = g.next
+	ph.grow = nil
+	if g.bloom != nil {
+		// A filter left stale by a failed rename names the old table size,
+		// so it is rebuilt on the next Open
+		ph.bloom.close(false)
+		ph.bloom = g.bloom
+		ph.bloomRemoved = 0
+		os.Rename(ph.bloomPath()+".tmp", ph.bloomPath())
 	}
 
-	// Get file size
-	fi, err = file.Stat()
-	if err != nil {
-		file.Close()
-		return fmt.Errorf("failed to stat file after resize: %w", err)
+	if ph.db != nil {
+		// The directory entry is the DB's equivalent of the rename
+		if err := ph.db.moveRegion(ph); err != nil {
+			ph.closeGrowLog(g, false)
+			ph.resizeFinished(g, err)
+			return err
+		}
+	} else if !ph.inMemory {
+		// Rename temporary file to original. The new mapping and descriptor
+		// stay valid across the rename, so there is nothing to reopen.
+		fmt.Printf("Renaming temp file to original\n")
+		if err := os.Rename(ph.filePath+".tmp", ph.filePath); err != nil {
+			err = fmt.Errorf("failed to rename temp file: %w", err)
+			ph.closeGrowLog(g, false)
+			ph.resizeFinished(g, err)
+			return err
+		}
 	}
-	fileSize := int(fi.Size())
-
-	// Map the file
-	fmt.Printf("Remapping the file, size=%d\n", fileSize)
-	data, err := syscall.Mmap(int(file.Fd()), 0, fileSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
-	if err != nil {
-		file.Close()
-		return fmt.Errorf("failed to mmap file after resize: %w", err)
+	if err := ph.closeGrowLog(g, true); err != nil {
+		ph.resizeFinished(g, err)
+		return err
 	}
 
-	// Update the hash state
-	ph.file = file
-	ph.data = data
-	ph.numSlots = newNumSlots
-	ph.usedSlots = binary.BigEndian.Uint32(data[12:16])
-
 	fmt.Printf("Resize complete: new slots=%d, used=%d\n", ph.numSlots, ph.usedSlots)
+	ph.resizeFinished(g, nil)
 	return nil
 }
 
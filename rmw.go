@@ -0,0 +1,161 @@
+package phash
+
+import (
+	"bytes"
+	"errors"
+)
+
+// PutIfAbsent stores value under key only if key is not already present.
+// It reports whether the value was stored.
+func (ph *PersistentHash) PutIfAbsent(key, value []byte) (bool, error) {
+	stored := false
+	err := ph.Update(key, func(_ []byte, exists bool) ([]byte, bool) {
+		stored = !exists
+		return value, !exists
+	})
+	return stored && err == nil, err
+}
+
+// CompareAndSwap replaces the value of key with new if key is present and
+// its value equals old. It reports whether the swap happened.
+func (ph *PersistentHash) CompareAndSwap(key, old, new []byte) (bool, error) {
+	swapped := false
+	err := ph.Update(key, func(cur []byte, exists bool) ([]byte, bool) {
+		swapped = exists && bytes.Equal(cur, old)
+		return new, swapped
+	})
+	return swapped && err == nil, err
+}
+
+// GetOrPut returns the value of key if it is present. Otherwise it stores
+// value and returns it. loaded reports whether the value was already there.
+func (ph *PersistentHash) GetOrPut(key, value []byte) (actual []byte, loaded bool, err error) {
+	err = ph.Update(key, func(cur []byte, exists bool) ([]byte, bool) {
+		loaded = exists
+		if exists {
+			actual = cur
+			return nil, false
+		}
+		actual = value
+		return value, true
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return actual, loaded, nil
+}
+
+// Update runs fn with the current value of key, or with exists false if it
+// is absent, and stores the value fn returns when its second result is
+// true. In TTL mode the entry keeps its expiry. old is a copy fn may keep.
+// The read and the write happen under one acquisition of the write lock,
+// so no other writer can slip in between, and fn must not call back into
+// the hash.
+//
+// Outside a resize the key is probed once: an existing value is replaced
+// in place and a new key goes into the free slot the same probe found,
+// unless the table has to grow first.
+func (ph *PersistentHash) Update(key []byte, fn func(old []byte, exists bool) ([]byte, bool)) error {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	return ph.updateLocked(key, fn)
+}
+
+// updateLocked is Update for callers that already hold the write lock.
+func (ph *PersistentHash) updateLocked(key []byte, fn func(old []byte, exists bool) ([]byte, bool)) error {
+	enc, ok := ph.encodeKey(key)
+	if !ok {
+		return errors.New("invalid key/value size")
+	}
+
+	t, idx, found := ph.lookup(enc)
+	var slotValue, old []byte
+	var expiry int64
+	live := false
+	if found {
+		slotStart := t.base + idx*ph.slotSize
+		slotValue = ph.valueField(t.data, slotStart)
+
+		// An expired entry is overwritten as if it were absent
+		var field []byte
+		field, expiry = ph.splitExpiry(slotValue)
+		if live = !expired(expiry); !live {
+			expiry = 0
+		} else if ph.vlog != nil {
+			var err error
+			if old, err = ph.loadValue(field); err != nil {
+				return err
+			}
+		} else if ph.crypt != nil {
+			var err error
+			if _, old, err = ph.crypt.open(enc, field); err != nil {
+				return err
+			}
+		} else {
+			old = append([]byte(nil), field...)
+		}
+	}
+
+	value, write := fn(old, live)
+	if !write {
+		return nil
+	}
+
+	if err := ph.checkValue(value); err != nil {
+		return err
+	}
+	var logged int64
+	if ph.vlog != nil {
+		field, err := ph.storeValue(value)
+		if err != nil {
+			return err
+		}
+		logged = ph.loggedBytes(field)
+		if found {
+			logged -= ph.loggedBytes(slotValue)
+		}
+		value = field
+	} else if ph.crypt != nil {
+		var err error
+		if value, err = ph.crypt.seal(enc, key, value); err != nil {
+			return err
+		}
+	}
+	value = ph.appendExpiry(value, expiry)
+
+	if err := ph.storeUpdate(t, idx, found, key, enc, value); err != nil {
+		return err
+	}
+	if ph.vlog != nil {
+		ph.setLogLive(ph.vlog.live + logged)
+	}
+	return nil
+}
+
+// storeUpdate writes the value for the result of updateLocked's probe,
+// in place when it can.
+func (ph *PersistentHash) storeUpdate(t *table, idx uint32, found bool, key, enc, value []byte) error {
+	// During a resize every write goes through growPut, which logs it
+	if found && ph.grow == nil {
+		slotStart := t.base + idx*ph.slotSize
+		copy(ph.valueField(t.data, slotStart), value)
+		ph.touch(t, idx)
+		return nil
+	}
+
+	if ph.longKey(key) {
+		if found {
+			ph.keepOverflow(enc, t, idx)
+		} else if err := ph.spillKey(enc, key); err != nil {
+			return err
+		}
+	}
+	if !found && ph.grow == nil && idx < ph.numSlots {
+		inserted, err := ph.tryInsert(idx, enc, value)
+		if inserted || err != nil {
+			return err
+		}
+	}
+	return ph.putWithRetry(enc, value, 0)
+}
@@ -0,0 +1,116 @@
+package phash
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Robin Hood hashing - https://cs.uwaterloo.ca/research/tr/1986/CS-86-14.pdf
+// An insert that meets an entry closer to its home slot than the one being
+// placed swaps them and carries on with the displaced entry. This keeps the
+// variance of probe lengths low, and since distances along a run never
+// drop by more than one per slot, a lookup can stop at the first entry that
+// is closer to home than the key would be.
+
+// rhMaxDist is the largest probe distance a status byte can hold.
+const rhMaxDist = 254
+
+// rhFind returns the slot holding key, or the slot where the search ended.
+func (ph *PersistentHash) rhFind(t *table, key []byte) (uint32, bool) {
+	idx := uint32(ph.hash(key) % uint64(t.numSlots))
+
+	for dist := uint32(0); dist < t.numSlots; dist++ {
+		slotStart := t.base + idx*ph.slotSize
+		status := uint32(t.data[slotStart])
+		if status == 0 || status-1 < dist {
+			return idx, false
+		}
+		if ph.keyEqual(t.data[slotStart+1:slotStart+1+ph.keySize], key) {
+			return idx, true
+		}
+		idx = (idx + 1) % t.numSlots
+	}
+
+	return t.numSlots, false
+}
+
+// rhInsert places key, displacing richer entries along the way. It checks
+// the whole displacement chain first so that nothing is moved when some
+// entry would end up beyond rhMaxDist.
+func (ph *PersistentHash) rhInsert(t *table, key, value []byte) error {
+	home := uint32(ph.hash(key) % uint64(t.numSlots))
+
+	idx := home
+	dist := uint32(0)
+	for n := uint32(0); ; n++ {
+		if n == t.numSlots {
+			return errors.New("hash table full")
+		}
+		status := uint32(t.data[t.base+idx*ph.slotSize])
+		if status == 0 {
+			break
+		}
+		if status-1 < dist {
+			dist = status - 1
+		}
+		dist++
+		if dist > rhMaxDist {
+			return errProbeTooLong
+		}
+		idx = (idx + 1) % t.numSlots
+	}
+
+	if ph.carry == nil {
+		ph.carry = make([]byte, ph.slotSize)
+		ph.swap = make([]byte, ph.slotSize)
+	}
+	carry, swap := ph.carry, ph.swap
+	copy(carry[1:1+ph.keySize], key)
+	copy(carry[1+ph.keySize:], value)
+
+	idx = home
+	dist = 0
+	for {
+		slotStart := t.base + idx*ph.slotSize
+		slot := t.data[slotStart : slotStart+ph.slotSize]
+		status := uint32(slot[0])
+
+		if status == 0 {
+			copy(slot, carry)
+			slot[0] = byte(dist + 1)
+			break
+		}
+		if status-1 < dist {
+			copy(swap, slot)
+			copy(slot, carry)
+			slot[0] = byte(dist + 1)
+			carry, swap = swap, carry
+			dist = status - 1
+		}
+		dist++
+		idx = (idx + 1) % t.numSlots
+	}
+
+	t.usedSlots++
+	binary.BigEndian.PutUint32(t.data[12:16], t.usedSlots)
+	return nil
+}
+
+// rhRemove empties slot idx and shifts the rest of its run back by one, so
+// no tombstone is needed. The caller updates the used count.
+func (ph *PersistentHash) rhRemove(t *table, idx uint32) {
+	for {
+		slotStart := t.base + idx*ph.slotSize
+		next := (idx + 1) % t.numSlots
+		nextStart := t.base + next*ph.slotSize
+
+		// Stop at an empty slot or an entry already in its home slot
+		if t.data[nextStart] <= 1 {
+			t.data[slotStart] = 0
+			return
+		}
+		copy(t.data[slotStart:slotStart+ph.slotSize], t.data[nextStart:nextStart+ph.slotSize])
+		t.data[slotStart]--
+		idx = next
+	}
+}
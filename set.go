@@ -0,0 +1,481 @@
+package phash
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// A PersistentSet stores fixed-size keys with no values in a file of its
+// own, laid out for membership tests over very many keys. The file is a
+// 64-byte header:
+//
+//   - Magic (4 bytes): setMagic
+//   - Version (4 bytes): setVersion
+//   - Key Size (4 bytes)
+//   - Hash Function (4 bytes): see HashFunc
+//   - Hash Seed (16 bytes)
+//   - Slots (8 bytes): A power of two
+//   - Keys (8 bytes): Number of keys in the set
+//
+// then a bitmap with one bit per slot, set when the slot holds a key and
+// padded to 64 bytes, then the slots' keys back to back.
+//
+// Slots are probed linearly from the key's home slot and deletes shift the
+// rest of the run back, so there are no tombstones and a single bit is all
+// the status a slot needs. Iteration reads the bitmap a word at a time and
+// skips empty stretches of the table without touching their keys.
+const (
+	setMagic      uint32 = 0x50485354 // "PHST"
+	setVersion    uint32 = 1
+	setHeaderSize        = 64
+	setMinSlots          = 1024
+)
+
+// PersistentSet is a persistent set of fixed-size keys. It is safe for
+// concurrent use.
+type PersistentSet struct {
+	mu sync.RWMutex
+	id uint64 // orders lock acquisition across sets
+
+	filePath string
+	file     *os.File
+	data     []byte
+
+	keySize  uint32
+	hashFunc HashFunc
+	seed     [16]byte
+	hasher   Hasher
+	custom   Hasher
+	maxLoad  float32
+
+	numSlots uint64
+	count    uint64
+	keysOff  uint64
+}
+
+// OpenSet creates or opens a set of keySize-byte keys at filePath. A
+// keySize of 0 opens an existing set with whatever key size it has. Of
+// opts only HashFunc, Hasher and MaxLoadFactor apply; opts may be nil.
+func OpenSet(filePath string, keySize uint32, opts *Options) (*PersistentSet, error) {
+	o := opts.withDefaults()
+	if o.MaxLoadFactor >= 1 {
+		return nil, errors.New("a set needs MaxLoadFactor below 1")
+	}
+	s := &PersistentSet{
+		id:       lastID.Add(1),
+		filePath: filePath,
+		custom:   o.Hasher,
+		maxLoad:  o.MaxLoadFactor,
+	}
+	if s.maxLoad <= 0 {
+		s.maxLoad = LayoutLinear.defaultMaxLoad()
+	}
+
+	fi, err := os.Stat(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to stat set: %w", err)
+	}
+	if err != nil || fi.Size() == 0 {
+		if keySize == 0 {
+			return nil, errors.New("key size must be positive")
+		}
+		s.keySize = keySize
+		s.hashFunc = o.HashFunc
+		if o.Hasher != nil {
+			s.hashFunc = HashCustom
+		}
+		if _, err := rand.Read(s.seed[:]); err != nil {
+			return nil, fmt.Errorf("failed to generate hash seed: %w", err)
+		}
+		if s.hasher, err = newHasher(s.hashFunc, s.seed, s.custom); err != nil {
+			return nil, err
+		}
+		file, data, err := s.createFile(filePath, setMinSlots)
+		if err != nil {
+			return nil, err
+		}
+		s.adopt(file, data)
+		return s, nil
+	}
+
+	file, err := os.OpenFile(filePath, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open set: %w", err)
+	}
+	if fi.Size() < setHeaderSize {
+		file.Close()
+		return nil, errors.New("set file too short")
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(fi.Size()), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("mmap failed: %w", err)
+	}
+	if err := s.load(data, keySize, fi.Size()); err != nil {
+		syscall.Munmap(data)
+		file.Close()
+		return nil, err
+	}
+	s.adopt(file, data)
+	return s, nil
+}
+
+// load validates the header of an existing set and takes its format.
+func (s *PersistentSet) load(data []byte, keySize uint32, size int64) error {
+	if binary.BigEndian.Uint32(data[0:4]) != setMagic {
+		return errors.New("invalid magic number")
+	}
+	if v := binary.BigEndian.Uint32(data[4:8]); v != setVersion {
+		return fmt.Errorf("unsupported set version %d", v)
+	}
+	s.keySize = binary.BigEndian.Uint32(data[8:12])
+	if keySize != 0 && keySize != s.keySize {
+		return fmt.Errorf("set has %d-byte keys, not %d", s.keySize, keySize)
+	}
+	s.hashFunc = HashFunc(binary.BigEndian.Uint32(data[12:16]))
+	copy(s.seed[:], data[16:32])
+
+	numSlots := binary.BigEndian.Uint64(data[32:40])
+	if s.keySize == 0 || numSlots == 0 || numSlots&(numSlots-1) != 0 ||
+		size != int64(s.fileSize(numSlots)) {
+		return errors.New("corrupt set header")
+	}
+
+	var err error
+	s.hasher, err = newHasher(s.hashFunc, s.seed, s.custom)
+	return err
+}
+
+// bitmapSize returns the bytes of bitmap for numSlots.
+func bitmapSize(numSlots uint64) uint64 {
+	return (numSlots/8 + 63) &^ 63
+}
+
+// fileSize returns the size of a set file with numSlots.
+func (s *PersistentSet) fileSize(numSlots uint64) uint64 {
+	return setHeaderSize + bitmapSize(numSlots) + numSlots*uint64(s.keySize)
+}
+
+// createFile creates an empty set file of numSlots at path in s's format.
+func (s *PersistentSet) createFile(path string, numSlots uint64) (*os.File, []byte, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create set: %w", err)
+	}
+	size := s.fileSize(numSlots)
+	if err := file.Truncate(int64(size)); err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to truncate set: %w", err)
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("mmap failed: %w", err)
+	}
+
+	binary.BigEndian.PutUint32(data[0:4], setMagic)
+	binary.BigEndian.PutUint32(data[4:8], setVersion)
+	binary.BigEndian.PutUint32(data[8:12], s.keySize)
+	binary.BigEndian.PutUint32(data[12:16], uint32(s.hashFunc))
+	copy(data[16:32], s.seed[:])
+	binary.BigEndian.PutUint64(data[32:40], numSlots)
+	return file, data, nil
+}
+
+// adopt makes the mapped file the set's table.
+func (s *PersistentSet) adopt(file *os.File, data []byte) {
+	s.file = file
+	s.data = data
+	s.numSlots = binary.BigEndian.Uint64(data[32:40])
+	s.count = binary.BigEndian.Uint64(data[40:48])
+	s.keysOff = setHeaderSize + bitmapSize(s.numSlots)
+}
+
+// Close unmaps and closes the set file.
+func (s *PersistentSet) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.data == nil {
+		return errors.New("set already closed")
+	}
+	if err := syscall.Munmap(s.data); err != nil {
+		return err
+	}
+	s.data = nil
+	return s.file.Close()
+}
+
+// KeySize returns the size of the set's keys.
+func (s *PersistentSet) KeySize() int {
+	return int(s.keySize)
+}
+
+// Len returns the number of keys in the set.
+func (s *PersistentSet) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return int(s.count)
+}
+
+// Add inserts key and reports whether it was not already in the set.
+func (s *PersistentSet) Add(key []byte) (bool, error) {
+	if uint32(len(key)) != s.keySize {
+		return false, errors.New("invalid key size")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addLocked(key)
+}
+
+func (s *PersistentSet) addLocked(key []byte) (bool, error) {
+	if err := s.reserve(s.count + 1); err != nil {
+		return false, err
+	}
+	idx, found := s.find(key)
+	if found {
+		return false, nil
+	}
+	s.insertAt(idx, key)
+	s.setCount(s.count + 1)
+	return true, nil
+}
+
+// Contains reports whether key is in the set.
+func (s *PersistentSet) Contains(key []byte) bool {
+	if uint32(len(key)) != s.keySize {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, found := s.find(key)
+	return found
+}
+
+// Remove deletes key and reports whether it was in the set.
+func (s *PersistentSet) Remove(key []byte) bool {
+	if uint32(len(key)) != s.keySize {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx, found := s.find(key)
+	if !found {
+		return false
+	}
+	s.removeAt(idx)
+	s.setCount(s.count - 1)
+	return true
+}
+
+// ForEach calls fn for every key until fn returns false. The key slice
+// points into the mapping and must not be modified or kept after fn
+// returns. fn must not call back into the set.
+func (s *PersistentSet) ForEach(fn func(key []byte) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.data == nil {
+		return errors.New("set closed")
+	}
+	s.forEachLocked(fn)
+	return nil
+}
+
+func (s *PersistentSet) forEachLocked(fn func(key []byte) bool) {
+	for w := uint64(0); w < s.numSlots/64; w++ {
+		word := binary.LittleEndian.Uint64(s.data[setHeaderSize+w*8:])
+		for word != 0 {
+			idx := w*64 + uint64(bits.TrailingZeros64(word))
+			if !fn(s.keyAt(idx)) {
+				return
+			}
+			word &= word - 1
+		}
+	}
+}
+
+// Union adds every key of other to s. Both sets must have the same key
+// size.
+func (s *PersistentSet) Union(other *PersistentSet) error {
+	if s == other {
+		return nil
+	}
+	if s.keySize != other.keySize {
+		return errors.New("sets have different key sizes")
+	}
+	unlock := lockSets(s, other)
+	defer unlock()
+
+	if err := s.reserve(s.count + other.count); err != nil {
+		return err
+	}
+	var err error
+	other.forEachLocked(func(key []byte) bool {
+		_, err = s.addLocked(key)
+		return err == nil
+	})
+	return err
+}
+
+// Intersect removes from s every key that is not in other. Both sets must
+// have the same key size. The surviving keys are copied into a new file
+// that replaces the old one, so it needs space for both while it runs.
+func (s *PersistentSet) Intersect(other *PersistentSet) error {
+	if s == other {
+		return nil
+	}
+	if s.keySize != other.keySize {
+		return errors.New("sets have different key sizes")
+	}
+	unlock := lockSets(s, other)
+	defer unlock()
+
+	return s.rebuild(s.numSlots, func(key []byte) bool {
+		_, found := other.find(key)
+		return found
+	})
+}
+
+// lockSets write-locks s and read-locks other, in id order so that two
+// sets combined both ways at once cannot deadlock.
+func lockSets(s, other *PersistentSet) func() {
+	if s.id < other.id {
+		s.mu.Lock()
+		other.mu.RLock()
+	} else {
+		other.mu.RLock()
+		s.mu.Lock()
+	}
+	return func() {
+		s.mu.Unlock()
+		other.mu.RUnlock()
+	}
+}
+
+// reserve grows the table until it can hold keys within the load factor.
+func (s *PersistentSet) reserve(keys uint64) error {
+	numSlots := s.numSlots
+	for float64(keys) > float64(numSlots)*float64(s.maxLoad) {
+		numSlots *= 2
+	}
+	if numSlots == s.numSlots {
+		return nil
+	}
+	return s.rebuild(numSlots, nil)
+}
+
+// rebuild copies the keys that keep accepts, or all of them if keep is
+// nil, into a new file of numSlots and atomically replaces the set file
+// with it.
+func (s *PersistentSet) rebuild(numSlots uint64, keep func(key []byte) bool) error {
+	tmpPath := s.filePath + ".tmp"
+	file, data, err := s.createFile(tmpPath, numSlots)
+	if err != nil {
+		return err
+	}
+
+	next := &PersistentSet{keySize: s.keySize, hasher: s.hasher}
+	next.adopt(file, data)
+	s.forEachLocked(func(key []byte) bool {
+		if keep == nil || keep(key) {
+			idx, _ := next.find(key)
+			next.insertAt(idx, key)
+			next.count++
+		}
+		return true
+	})
+	next.setCount(next.count)
+
+	fail := func(err error) error {
+		syscall.Munmap(data)
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return fail(fmt.Errorf("failed to sync set: %w", err))
+	}
+	if err := os.Rename(tmpPath, s.filePath); err != nil {
+		return fail(fmt.Errorf("failed to rename set: %w", err))
+	}
+
+	syscall.Munmap(s.data)
+	s.file.Close()
+	s.adopt(file, data)
+	return nil
+}
+
+// home returns the slot key hashes to. The hash is mixed first since the
+// default FNV-1a has only 32 bits and weak low bits.
+func (s *PersistentSet) home(key []byte) uint64 {
+	var h uint64
+	if s.hasher == nil {
+		h = uint64(hashKey(key))
+	} else {
+		h = s.hasher.Hash(key)
+	}
+	return fmix64(h) & (s.numSlots - 1)
+}
+
+// find returns the slot holding key and true, or the empty slot that ends
+// its probe run and false.
+func (s *PersistentSet) find(key []byte) (uint64, bool) {
+	mask := s.numSlots - 1
+	for idx := s.home(key); ; idx = (idx + 1) & mask {
+		if !s.used(idx) {
+			return idx, false
+		}
+		if bytes.Equal(s.keyAt(idx), key) {
+			return idx, true
+		}
+	}
+}
+
+// insertAt stores key in the empty slot idx.
+func (s *PersistentSet) insertAt(idx uint64, key []byte) {
+	copy(s.keyAt(idx), key)
+	s.data[setHeaderSize+idx/8] |= 1 << (idx % 8)
+}
+
+// removeAt empties slot idx and shifts back the keys after it that would
+// otherwise be cut off from their home slot.
+func (s *PersistentSet) removeAt(idx uint64) {
+	mask := s.numSlots - 1
+	hole := idx
+	for next := (hole + 1) & mask; s.used(next); next = (next + 1) & mask {
+		// A key may move into the hole unless its home lies cyclically
+		// after the hole, up to and including where it is now
+		home := s.home(s.keyAt(next))
+		if (next-home)&mask >= (next-hole)&mask {
+			copy(s.keyAt(hole), s.keyAt(next))
+			hole = next
+		}
+	}
+	s.data[setHeaderSize+hole/8] &^= 1 << (hole % 8)
+	key := s.keyAt(hole)
+	for i := range key {
+		key[i] = 0
+	}
+}
+
+func (s *PersistentSet) used(idx uint64) bool {
+	return s.data[setHeaderSize+idx/8]&(1<<(idx%8)) != 0
+}
+
+func (s *PersistentSet) keyAt(idx uint64) []byte {
+	off := s.keysOff + idx*uint64(s.keySize)
+	return s.data[off : off+uint64(s.keySize)]
+}
+
+func (s *PersistentSet) setCount(n uint64) {
+	s.count = n
+	binary.BigEndian.PutUint64(s.data[40:48], n)
+}
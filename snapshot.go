@@ -0,0 +1,138 @@
+package phash
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Snapshot is a read-only view of a hash frozen at the moment Snapshot was
+// called. Later writes to the hash do not show through, and reading the
+// snapshot takes no lock, so a long scan neither blocks writers nor sees a
+// mix of old and new values. A Snapshot is safe for concurrent readers and
+// must be released once no longer needed.
+type Snapshot struct {
+	view *PersistentHash
+}
+
+// errReleased is returned by a Snapshot used after Release.
+var errReleased = errors.New("snapshot released")
+
+// Snapshot freezes the current contents of the hash. The table is copied
+// into anonymous memory, which costs one pass over the mapping while the
+// write lock is held, but no more than that however long the snapshot is
+// read. Values and long keys are not copied: their logs are append-only,
+// so the snapshot keeps its own handles to them and reads what it needs.
+// Any resize in flight is finished first.
+func (ph *PersistentHash) Snapshot() (*Snapshot, error) {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	if ph.grow != nil {
+		if err := ph.migrate(ph.numSlots); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := syscall.Mmap(-1, 0, len(ph.data), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map snapshot: %w", err)
+	}
+	copy(data, ph.data)
+	// Read-only from here on, so a stray write faults instead of racing
+	if err := syscall.Mprotect(data, syscall.PROT_READ); err != nil {
+		syscall.Munmap(data)
+		return nil, fmt.Errorf("failed to protect snapshot: %w", err)
+	}
+
+	// The view leaves capacity unset, as if it were no cache: a cache's Get
+	// sets reference bits, and concurrent snapshot readers must not write
+	view := &PersistentHash{
+		filePath:       ph.filePath,
+		keySize:        ph.keySize,
+		valueSize:      ph.valueSize,
+		plainValueSize: ph.plainValueSize,
+		slotSize:       ph.slotSize,
+		opts:           ph.opts,
+		formatVersion:  ph.formatVersion,
+		hdrSize:        ph.hdrSize,
+		hashFunc:       ph.hashFunc,
+		seed:           ph.seed,
+		hasher:         ph.hasher,
+		layout:         ph.layout,
+		flags:          ph.flags,
+		keyPrefix:      ph.keyPrefix,
+		crypt:          ph.crypt,
+		maxLoad:        ph.maxLoad,
+		table: table{
+			base:      ph.base,
+			data:      data,
+			numSlots:  ph.numSlots,
+			usedSlots: ph.usedSlots,
+		},
+	}
+
+	// Compaction replaces the value log, so hold on to this generation
+	if ph.vlog != nil {
+		if view.vlog, err = reopenLog(ph.vlog, ph.valueLogPath(ph.vlog.gen)); err != nil {
+			syscall.Munmap(data)
+			return nil, err
+		}
+	}
+	if ph.klog != nil {
+		if view.klog, err = reopenLog(ph.klog, ph.filePath+".klog"); err != nil {
+			view.closeLogs()
+			syscall.Munmap(data)
+			return nil, err
+		}
+	}
+
+	return &Snapshot{view: view}, nil
+}
+
+// reopenLog opens a second, read-only handle to the log l stored at path.
+func reopenLog(l *valueLog, path string) (*valueLog, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log for snapshot: %w", err)
+	}
+	return &valueLog{file: file, gen: l.gen, size: l.size, live: l.live, codec: l.codec}, nil
+}
+
+// Get retrieves the value key had when the snapshot was taken.
+func (s *Snapshot) Get(key []byte) ([]byte, bool) {
+	if s.view.data == nil {
+		return nil, false
+	}
+	return s.view.getLocked(key)
+}
+
+// ForEach calls fn for every entry in the snapshot until fn returns false.
+// The slices may point into the snapshot and must not be modified or kept
+// after Release.
+func (s *Snapshot) ForEach(fn func(key, value []byte) bool) error {
+	if s.view.data == nil {
+		return errReleased
+	}
+	return s.view.forEachLocked(fn)
+}
+
+// Len returns the number of keys in the snapshot.
+func (s *Snapshot) Len() int {
+	return int(s.view.usedSlots)
+}
+
+// Release frees the snapshot's copy of the table and its log handles. The
+// snapshot must not be used afterwards.
+func (s *Snapshot) Release() error {
+	if s.view.data == nil {
+		return errReleased
+	}
+	err := syscall.Munmap(s.view.data)
+	s.view.data = nil
+	if cerr := s.view.closeLogs(); err == nil {
+		err = cerr
+	}
+	return err
+}
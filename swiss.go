@@ -0,0 +1,79 @@
+package phash
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// Swiss table style probing - https://abseil.io/about/design/swisstables
+// Control bytes are read as little-endian uint64 groups of 8, aligned to
+// the group, and compared against the fingerprint with SWAR bit tricks.
+// The slot's own status byte is kept in step with its control byte so that
+// code iterating slots does not need to know about the layout.
+//
+// Empty is zero so that a freshly truncated file needs no initialisation.
+const (
+	swEmpty   = 0x00
+	swDeleted = 0x01
+	swFull    = 0x80 // or'ed with the 7-bit fingerprint
+
+	swGroup = 8
+	swLSBs  = 0x0101010101010101
+	swMSBs  = 0x8080808080808080
+)
+
+// swFingerprint returns the control byte for a key with hash h. The bits
+// are taken from above those that pick the slot for all but huge tables,
+// folding in the top of 64-bit hashes.
+func swFingerprint(h uint64) byte {
+	return swFull | byte((h>>25)^(h>>57))&0x7f
+}
+
+// swZeroBytes sets the high bit of every zero byte in w. Bytes above a real
+// zero may be flagged spuriously, so callers verify any candidate other
+// than the lowest.
+func swZeroBytes(w uint64) uint64 {
+	return (w - swLSBs) & ^w & swMSBs
+}
+
+// swFind probes whole groups starting from the group holding the key's home
+// slot, stopping at the first group with an empty control byte.
+func (ph *PersistentHash) swFind(t *table, key []byte) (uint32, bool) {
+	h := ph.hash(key)
+	fp := swFingerprint(h)
+	match := swLSBs * uint64(fp)
+
+	ctrl := t.data[ph.hdrSize : ph.hdrSize+t.numSlots]
+	numGroups := t.numSlots / swGroup
+	group := uint32(h%uint64(t.numSlots)) / swGroup
+	free := t.numSlots
+
+	for n := uint32(0); n < numGroups; n++ {
+		first := group * swGroup
+		word := binary.LittleEndian.Uint64(ctrl[first:])
+
+		for m := swZeroBytes(word ^ match); m != 0; m &= m - 1 {
+			idx := first + uint32(bits.TrailingZeros64(m))/8
+			if ctrl[idx] != fp {
+				continue
+			}
+			slotStart := t.base + idx*ph.slotSize
+			if ph.keyEqual(t.data[slotStart+1:slotStart+1+ph.keySize], key) {
+				return idx, true
+			}
+		}
+
+		// Empty and deleted are the bytes without the full bit
+		if free == t.numSlots {
+			if m := ^word & swMSBs; m != 0 {
+				free = first + uint32(bits.TrailingZeros64(m))/8
+			}
+		}
+		if swZeroBytes(word) != 0 {
+			return free, false
+		}
+		group = (group + 1) % numGroups
+	}
+
+	return free, false
+}
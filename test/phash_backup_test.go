@@ -0,0 +1,125 @@
+package phash_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/theflywheel/phash"
+)
+
+func TestBackupRestore(t *testing.T) {
+	for _, opts := range []*phash.Options{
+		nil,
+		{HashFunc: phash.HashXXH64, Layout: phash.LayoutRobinHood},
+		{ValueLog: true, VarKeys: true},
+		{TTL: true, ReapInterval: -1},
+	} {
+		for _, compact := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%+v/compact=%v", opts, compact), func(t *testing.T) {
+				testBackupRestore(t, opts, compact)
+			})
+		}
+	}
+}
+
+func testBackupRestore(t *testing.T, opts *phash.Options, compact bool) {
+	dir := t.TempDir()
+
+	ph, err := phash.OpenWithOptions(filepath.Join(dir, "source.phash"), 8, 8, opts)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+
+	numEntries := 1000
+	key := make([]byte, 8)
+	for i := 0; i < numEntries; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if err := ph.Put(key, key); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+	for i := 0; i < numEntries; i += 3 {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		ph.Delete(key)
+	}
+
+	var buf bytes.Buffer
+	if err := ph.BackupWithOptions(&buf, &phash.BackupOptions{Compact: compact}); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	// Writes after the backup must not be in it
+	binary.BigEndian.PutUint64(key, uint64(numEntries))
+	ph.Put(key, key)
+
+	if err := phash.VerifyBackup(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+
+	restored, err := phash.Restore(bytes.NewReader(buf.Bytes()), filepath.Join(dir, "restored.phash"), nil)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	defer restored.Close()
+
+	for i := 0; i <= numEntries; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		val, found := restored.Get(key)
+		live := i%3 != 0 && i < numEntries
+		if found != live {
+			t.Fatalf("Restored key %d found=%v, expected %v", i, found, live)
+		}
+		if found && !bytes.Equal(val, key) {
+			t.Fatalf("Restored key %d has value %x", i, val)
+		}
+	}
+	if restored.Len() != numEntries-(numEntries+2)/3 {
+		t.Fatalf("Restored Len() = %d", restored.Len())
+	}
+}
+
+func TestBackupCorruption(t *testing.T) {
+	dir := t.TempDir()
+
+	ph, err := phash.Open(filepath.Join(dir, "source.phash"), 8, 8)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+	ph.Put([]byte("key00001"), []byte("value001"))
+
+	backupPath := filepath.Join(dir, "source.backup")
+	if err := ph.BackupTo(backupPath); err != nil {
+		t.Fatalf("BackupTo failed: %v", err)
+	}
+	data, err := os.ReadFile(backupPath)
+	if err != nil {
+		t.Fatalf("Failed to read backup: %v", err)
+	}
+
+	// Flip a byte in the middle, then cut the end off
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(corrupt)/2] ^= 0xFF
+	for name, bad := range map[string][]byte{"flipped": corrupt, "truncated": data[:len(data)-10]} {
+		if err := phash.VerifyBackup(bytes.NewReader(bad)); err == nil {
+			t.Fatalf("VerifyBackup accepted a %s backup", name)
+		}
+		target := filepath.Join(dir, name+".phash")
+		if _, err := phash.Restore(bytes.NewReader(bad), target, nil); err == nil {
+			t.Fatalf("Restore accepted a %s backup", name)
+		}
+		if _, err := os.Stat(target); !os.IsNotExist(err) {
+			t.Fatalf("Failed restore of a %s backup left %s behind", name, target)
+		}
+	}
+
+	// Restore never overwrites an existing file
+	if _, err := phash.Restore(bytes.NewReader(data), filepath.Join(dir, "source.phash"), nil); err == nil {
+		t.Fatalf("Restore overwrote an existing hash")
+	}
+}
@@ -202,3 +202,71 @@ func TestOverwrite(t *testing.T) {
 		t.Fatalf("Expected updated value 200, got %d", newValue)
 	}
 }
+
+// TestDelete tests deleting keys and reusing their slots
+func TestDelete(t *testing.T) {
+	tempFile := "delete_test.phash"
+	defer os.Remove(tempFile)
+
+	keySize := uint32(8)
+	valueSize := uint32(8)
+
+	ph, err := phash.Open(tempFile, keySize, valueSize)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+
+	key := make([]byte, keySize)
+	value := make([]byte, valueSize)
+	for i := uint64(0); i < 500; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		binary.BigEndian.PutUint64(value, i)
+		if err := ph.Put(key, value); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+
+	// Delete the even keys
+	for i := uint64(0); i < 500; i += 2 {
+		binary.BigEndian.PutUint64(key, i)
+		if !ph.Delete(key) {
+			t.Fatalf("Expected key %d to be deleted", i)
+		}
+		if ph.Delete(key) {
+			t.Fatalf("Key %d deleted twice", i)
+		}
+	}
+
+	for i := uint64(0); i < 500; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		_, found := ph.Get(key)
+		if found != (i%2 == 1) {
+			t.Fatalf("Key %d: expected found=%v, got %v", i, i%2 == 1, found)
+		}
+	}
+
+	// Re-insert the deleted keys with new values
+	for i := uint64(0); i < 500; i += 2 {
+		binary.BigEndian.PutUint64(key, i)
+		binary.BigEndian.PutUint64(value, i+1000)
+		if err := ph.Put(key, value); err != nil {
+			t.Fatalf("Failed to re-put key %d: %v", i, err)
+		}
+	}
+
+	for i := uint64(0); i < 500; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		got, found := ph.Get(key)
+		if !found {
+			t.Fatalf("Key %d not found after re-insert", i)
+		}
+		expected := i
+		if i%2 == 0 {
+			expected = i + 1000
+		}
+		if binary.BigEndian.Uint64(got) != expected {
+			t.Errorf("Value mismatch for key %d: expected %d, got %d", i, expected, binary.BigEndian.Uint64(got))
+		}
+	}
+}
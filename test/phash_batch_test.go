@@ -0,0 +1,185 @@
+package phash_test
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/theflywheel/phash"
+)
+
+func TestBatchWrite(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "batch_test.phash")
+
+	resizes := 0
+	opts := &phash.Options{OnResizeStart: func(phash.ResizeInfo) { resizes++ }}
+	ph, err := phash.OpenWithOptions(tempFile, 8, 8, opts)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+
+	// Big enough to need several doublings one Put at a time
+	numEntries := 10000
+	var b phash.Batch
+	key := make([]byte, 8)
+	for i := 0; i < numEntries; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		b.Put(key, key)
+	}
+	for i := 0; i < numEntries; i += 4 {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		b.Delete(key)
+	}
+	if err := ph.Write(&b); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+	if resizes != 1 {
+		t.Fatalf("Batch caused %d resizes, expected 1", resizes)
+	}
+
+	for i := 0; i < numEntries; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		val, found := ph.Get(key)
+		if found != (i%4 != 0) {
+			t.Fatalf("Key %d found=%v", i, found)
+		}
+		if found && binary.BigEndian.Uint64(val) != uint64(i) {
+			t.Fatalf("Value mismatch for key %d", i)
+		}
+	}
+	if _, err := os.Stat(tempFile + ".wal"); !os.IsNotExist(err) {
+		t.Fatalf("Batch log left behind after Write: %v", err)
+	}
+
+	// A batch with a bad op is rejected before anything is applied
+	b.Reset()
+	binary.BigEndian.PutUint64(key, uint64(numEntries))
+	b.Put(key, key)
+	b.Put([]byte("short"), key)
+	if err := ph.Write(&b); err == nil {
+		t.Fatalf("Expected an error for a batch with a bad key")
+	}
+	if _, found := ph.Get(key); found {
+		t.Fatalf("Rejected batch was partly applied")
+	}
+}
+
+// writeBatchLog writes a batch log of puts in the documented format, as an
+// interrupted Write would have left it.
+func writeBatchLog(t *testing.T, path string, keys []uint64, torn bool) {
+	buf := binary.BigEndian.AppendUint32(nil, 0x50484257)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(keys)))
+	for _, k := range keys {
+		buf = append(buf, 0)
+		buf = binary.BigEndian.AppendUint32(buf, 8)
+		buf = binary.BigEndian.AppendUint32(buf, 8)
+		buf = binary.BigEndian.AppendUint64(buf, k)
+		buf = binary.BigEndian.AppendUint64(buf, k*2)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+	if torn {
+		buf = buf[:len(buf)-10]
+	}
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		t.Fatalf("Failed to write batch log: %v", err)
+	}
+}
+
+func TestBatchReplay(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "batch_replay_test.phash")
+
+	ph, err := phash.Open(tempFile, 8, 8)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	if err := ph.Close(); err != nil {
+		t.Fatalf("Failed to close hash: %v", err)
+	}
+
+	keys := []uint64{1, 2, 3, 1 << 40}
+	writeBatchLog(t, tempFile+".wal", keys, false)
+
+	ph, err = phash.Open(tempFile, 8, 8)
+	if err != nil {
+		t.Fatalf("Failed to reopen hash: %v", err)
+	}
+	key := make([]byte, 8)
+	for _, k := range keys {
+		binary.BigEndian.PutUint64(key, k)
+		val, found := ph.Get(key)
+		if !found || binary.BigEndian.Uint64(val) != k*2 {
+			t.Fatalf("Replayed key %d missing or wrong", k)
+		}
+	}
+	if err := ph.Close(); err != nil {
+		t.Fatalf("Failed to close hash: %v", err)
+	}
+
+	// A torn log was never applied and must be dropped
+	writeBatchLog(t, tempFile+".wal", []uint64{99}, true)
+	ph, err = phash.Open(tempFile, 8, 8)
+	if err != nil {
+		t.Fatalf("Failed to reopen hash: %v", err)
+	}
+	defer ph.Close()
+
+	binary.BigEndian.PutUint64(key, 99)
+	if _, found := ph.Get(key); found {
+		t.Fatalf("Torn batch log was applied")
+	}
+	if _, err := os.Stat(tempFile + ".wal"); !os.IsNotExist(err) {
+		t.Fatalf("Torn batch log left behind: %v", err)
+	}
+	if ph.Len() != len(keys) {
+		t.Fatalf("Len() = %d, expected %d", ph.Len(), len(keys))
+	}
+}
+
+func TestBatchWriteFailure(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "batch_failure_test.phash")
+
+	// Only eight colliding keys fit, so the ninth Put of the batch fails
+	opts := &phash.Options{Layout: phash.LayoutCuckoo, Hasher: constantHasher{}}
+	ph, err := phash.OpenWithOptions(tempFile, 8, 8, opts)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+
+	key := make([]byte, 8)
+	value := make([]byte, 8)
+	var b phash.Batch
+	for i := uint64(0); i < 10; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		binary.BigEndian.PutUint64(value, i)
+		b.Put(key, value)
+	}
+	if err := ph.Write(&b); err == nil {
+		t.Fatal("Expected the batch to fail")
+	}
+	if _, err := os.Stat(tempFile + ".wal"); !os.IsNotExist(err) {
+		t.Fatalf("Failed batch left its log behind: %v", err)
+	}
+
+	// A later write must not be undone by the failed batch on reopen
+	binary.BigEndian.PutUint64(key, 0)
+	binary.BigEndian.PutUint64(value, 100)
+	if err := ph.Put(key, value); err != nil {
+		t.Fatalf("Failed to put key: %v", err)
+	}
+	if err := ph.Close(); err != nil {
+		t.Fatalf("Failed to close hash: %v", err)
+	}
+
+	ph, err = phash.OpenWithOptions(tempFile, 8, 8, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen hash: %v", err)
+	}
+	defer ph.Close()
+	got, found := ph.Get(key)
+	if !found || binary.BigEndian.Uint64(got) != 100 {
+		t.Fatalf("Later write lost after reopen: %v %v", got, found)
+	}
+}
@@ -0,0 +1,130 @@
+package phash_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/theflywheel/phash"
+)
+
+func TestBloomFilter(t *testing.T) {
+	for _, layout := range []phash.Layout{phash.LayoutLinear, phash.LayoutRobinHood, phash.LayoutSwiss, phash.LayoutCuckoo} {
+		t.Run(fmt.Sprintf("layout%d", layout), func(t *testing.T) {
+			tempFile := filepath.Join(t.TempDir(), "bloom_test.phash")
+			opts := &phash.Options{Layout: layout, BloomFalsePositive: 0.01}
+			ph, err := phash.OpenWithOptions(tempFile, 8, 8, opts)
+			if err != nil {
+				t.Fatalf("Failed to open hash: %v", err)
+			}
+
+			// Enough keys to resize, so the filter is rebuilt along the way
+			const n = 5000
+			key := make([]byte, 8)
+			for i := 0; i < n; i++ {
+				binary.BigEndian.PutUint64(key, uint64(i))
+				if err := ph.Put(key, key); err != nil {
+					t.Fatalf("Failed to put key %d: %v", i, err)
+				}
+			}
+			if _, err := os.Stat(tempFile + ".bloom"); err != nil {
+				t.Fatalf("Bloom filter file missing: %v", err)
+			}
+
+			check := func(ph *phash.PersistentHash) {
+				for i := 0; i < n; i++ {
+					binary.BigEndian.PutUint64(key, uint64(i))
+					if _, found := ph.Get(key); !found {
+						t.Fatalf("Key %d not found", i)
+					}
+				}
+				before := ph.BloomStats()
+				for i := n; i < 2*n; i++ {
+					binary.BigEndian.PutUint64(key, uint64(i))
+					if _, found := ph.Get(key); found {
+						t.Fatalf("Absent key %d found", i)
+					}
+				}
+				stats := ph.BloomStats()
+				checks := stats.Checks - before.Checks
+				skipped := stats.Skipped - before.Skipped
+				falsePos := stats.FalsePositives - before.FalsePositives
+				if checks != n || skipped+falsePos != n {
+					t.Fatalf("BloomStats() over %d misses: %+v", n, stats)
+				}
+				if falsePos > n/20 {
+					t.Fatalf("%d false positives in %d misses", falsePos, n)
+				}
+			}
+			check(ph)
+
+			if err := ph.Close(); err != nil {
+				t.Fatalf("Failed to close hash: %v", err)
+			}
+			ph, err = phash.Open(tempFile, 8, 8)
+			if err != nil {
+				t.Fatalf("Failed to reopen hash: %v", err)
+			}
+			defer ph.Close()
+			check(ph)
+		})
+	}
+}
+
+func TestBloomFilterRebuild(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "bloom_rebuild_test.phash")
+	opts := &phash.Options{BloomFalsePositive: 0.01}
+	ph, err := phash.OpenWithOptions(tempFile, 8, 8, opts)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	key := make([]byte, 8)
+	for i := 0; i < 500; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if err := ph.Put(key, key); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+	if err := ph.Close(); err != nil {
+		t.Fatalf("Failed to close hash: %v", err)
+	}
+
+	// A lost or damaged filter must not hide any key
+	if err := os.WriteFile(tempFile+".bloom", []byte("garbage"), 0644); err != nil {
+		t.Fatalf("Failed to damage filter: %v", err)
+	}
+	ph, err = phash.Open(tempFile, 8, 8)
+	if err != nil {
+		t.Fatalf("Failed to reopen hash: %v", err)
+	}
+	defer ph.Close()
+	for i := 0; i < 500; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if _, found := ph.Get(key); !found {
+			t.Fatalf("Key %d not found after rebuild", i)
+		}
+	}
+
+	// Deleting churns the filter without losing live keys
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 500; i++ {
+			binary.BigEndian.PutUint64(key, uint64(i))
+			ph.Delete(key)
+			if err := ph.Put(key, key); err != nil {
+				t.Fatalf("Failed to put key %d: %v", i, err)
+			}
+		}
+	}
+	for i := 0; i < 500; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if _, found := ph.Get(key); !found {
+			t.Fatalf("Key %d not found after churn", i)
+		}
+	}
+
+	if _, err := phash.OpenWithOptions(filepath.Join(t.TempDir(), "bad.phash"), 8, 8, &phash.Options{BloomFalsePositive: 1.5}); err == nil {
+		t.Fatal("Expected an error for a false positive rate above 1")
+	}
+}
@@ -0,0 +1,157 @@
+package phash_test
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/theflywheel/phash"
+)
+
+func TestCache(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "cache_test.phash")
+
+	capacity := 1000
+	evicted := make(map[uint64]uint64)
+	opts := &phash.Options{
+		CacheCapacity: capacity,
+		OnEvict: func(key, value []byte) {
+			evicted[binary.BigEndian.Uint64(key)] = binary.BigEndian.Uint64(value)
+		},
+	}
+	ph, err := phash.OpenWithOptions(tempFile, 8, 8, opts)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+
+	fi, err := os.Stat(tempFile)
+	if err != nil {
+		t.Fatalf("Failed to stat cache file: %v", err)
+	}
+	size := fi.Size()
+
+	key := make([]byte, 8)
+	for i := 0; i < capacity; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if err := ph.Put(key, key); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+
+	// Touch the first hundred so the clock gives them a second chance
+	for i := 0; i < 100; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if _, found := ph.Get(key); !found {
+			t.Fatalf("Key %d missing before the cache filled", i)
+		}
+	}
+
+	for i := capacity; i < capacity+100; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if err := ph.Put(key, key); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+
+	if ph.Len() != capacity {
+		t.Fatalf("Len() = %d, expected the capacity %d", ph.Len(), capacity)
+	}
+	if len(evicted) != 100 {
+		t.Fatalf("OnEvict saw %d entries, expected 100", len(evicted))
+	}
+	for k, v := range evicted {
+		if k != v {
+			t.Fatalf("OnEvict got key %d with value %d", k, v)
+		}
+		if k < 100 {
+			t.Fatalf("Recently read key %d was evicted", k)
+		}
+		binary.BigEndian.PutUint64(key, k)
+		if _, found := ph.Get(key); found {
+			t.Fatalf("Evicted key %d still found", k)
+		}
+	}
+
+	stats := ph.CacheStats()
+	if stats.Hits != 100 || stats.Misses != 100 || stats.Evictions != 100 {
+		t.Fatalf("CacheStats() = %+v", stats)
+	}
+
+	// Keep churning: the file never grows and every key stays reachable
+	for i := 0; i < 20*capacity; i++ {
+		binary.BigEndian.PutUint64(key, uint64(capacity+100+i))
+		if err := ph.Put(key, key); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+		if _, found := ph.Get(key); !found {
+			t.Fatalf("Key %d missing right after Put", i)
+		}
+	}
+	if fi, _ := os.Stat(tempFile); fi.Size() != size {
+		t.Fatalf("Cache file grew from %d to %d bytes", size, fi.Size())
+	}
+	if ph.Len() != capacity {
+		t.Fatalf("Len() = %d after churn", ph.Len())
+	}
+}
+
+func TestCacheNeedsLinearLayout(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "cache_layout_test.phash")
+
+	opts := &phash.Options{CacheCapacity: 10, Layout: phash.LayoutRobinHood}
+	if _, err := phash.OpenWithOptions(tempFile, 8, 8, opts); err == nil {
+		t.Fatalf("Expected an error for a Robin Hood cache")
+	}
+}
+
+// homeHasher places each key at the slot named by its first four bytes
+type homeHasher struct{}
+
+func (homeHasher) Hash(key []byte) uint64 { return uint64(binary.BigEndian.Uint32(key)) }
+
+func TestCacheEvictionInProbeChain(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "cache_probe_test.phash")
+
+	// A capacity of 10 gives 16 slots
+	opts := &phash.Options{CacheCapacity: 10, Hasher: homeHasher{}}
+	ph, err := phash.OpenWithOptions(tempFile, 8, 8, opts)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+
+	makeKey := func(home, id uint32) []byte {
+		key := binary.BigEndian.AppendUint32(nil, home)
+		return binary.BigEndian.AppendUint32(key, id)
+	}
+	put := func(key []byte) {
+		if err := ph.Put(key, key); err != nil {
+			t.Fatalf("Failed to put key %x: %v", key, err)
+		}
+	}
+
+	// Two keys homed at slot 3 take slots 3 and 4, the rest fill 8-15
+	put(makeKey(3, 0))
+	put(makeKey(3, 1))
+	for home := uint32(8); home < 16; home++ {
+		put(makeKey(home, 0))
+	}
+
+	// With slot 3 recently used, the clock evicts slot 4, which sits
+	// between slot 3 and the free slot 5 a third key homed at 3 probes to
+	ph.Get(makeKey(3, 0))
+	third := makeKey(3, 2)
+	put(third)
+
+	if _, found := ph.Get(third); !found {
+		t.Fatal("Key missing right after Put")
+	}
+	if _, found := ph.Get(makeKey(3, 0)); !found {
+		t.Fatal("Recently used key was evicted")
+	}
+	if ph.Len() != 10 {
+		t.Fatalf("Len() = %d, expected 10", ph.Len())
+	}
+}
@@ -0,0 +1,233 @@
+package phash_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/theflywheel/phash"
+)
+
+func TestCompression(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "compress_test.phash")
+
+	dict := []byte(`{"id":,"name":"user-","active":true,"tags":["alpha","beta"]}`)
+	opts := &phash.Options{ValueLog: true, Compress: true, CompressThreshold: 32, CompressDict: dict}
+	ph, err := phash.OpenWithOptions(tempFile, 8, 0, opts)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+
+	// Zero-padded records, JSON documents and values under the threshold
+	makeValue := func(i int) []byte {
+		switch i % 3 {
+		case 0:
+			v := make([]byte, 512)
+			binary.BigEndian.PutUint64(v, uint64(i))
+			return v
+		case 1:
+			return []byte(fmt.Sprintf(`{"id":%d,"name":"user-%d","active":true,"tags":["alpha","beta"]}`, i, i))
+		default:
+			return []byte(fmt.Sprintf("short-%d", i))
+		}
+	}
+
+	numEntries := 3000
+	key := make([]byte, 8)
+	for i := 0; i < numEntries; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if err := ph.Put(key, makeValue(i)); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+
+	check := func(stage string) {
+		for i := 0; i < numEntries; i++ {
+			binary.BigEndian.PutUint64(key, uint64(i))
+			got, found := ph.Get(key)
+			if !found || !bytes.Equal(got, makeValue(i)) {
+				t.Fatalf("Key %d %s: got %q, found %v", i, stage, got, found)
+			}
+		}
+	}
+	check("after put")
+
+	stats := ph.CompressionStats()
+	if stats.Values != uint64(numEntries) || stats.Compressed != uint64(2*numEntries/3) {
+		t.Fatalf("CompressionStats() = %+v", stats)
+	}
+	if stats.Ratio() < 2 {
+		t.Fatalf("Ratio() = %.2f, expected at least 2", stats.Ratio())
+	}
+	if _, live := ph.ValueLogSize(); live != int64(stats.StoredBytes) {
+		t.Fatalf("Live log bytes %d, expected the stored %d", live, stats.StoredBytes)
+	}
+
+	// Overwrite with Update and compact: records are carried over as stored
+	for i := 0; i < numEntries; i += 2 {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if err := ph.Update(key, func(old []byte, exists bool) ([]byte, bool) {
+			return old, true
+		}); err != nil {
+			t.Fatalf("Failed to update key %d: %v", i, err)
+		}
+	}
+	if err := ph.CompactValueLog(); err != nil {
+		t.Fatalf("Failed to compact value log: %v", err)
+	}
+	check("after compaction")
+
+	if err := ph.Close(); err != nil {
+		t.Fatalf("Failed to close hash: %v", err)
+	}
+
+	if _, err := phash.OpenWithOptions(tempFile, 0, 0, &phash.Options{ValueLog: true}); err == nil {
+		t.Fatalf("Expected an error opening without the dictionary")
+	}
+
+	ph, err = phash.OpenWithOptions(tempFile, 0, 0, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen hash: %v", err)
+	}
+	defer ph.Close()
+	check("after reopen")
+}
+
+func TestCompressionFixedSize(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "compress_fixed_test.phash")
+
+	if _, err := phash.OpenWithOptions(tempFile, 8, 8, &phash.Options{Compress: true}); err == nil {
+		t.Fatal("Expected an error for values below CompressThreshold")
+	}
+	os.Remove(tempFile)
+
+	const valueSize = 512
+	opts := &phash.Options{Compress: true, TTL: true}
+	ph, err := phash.OpenWithOptions(tempFile, 8, valueSize, opts)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+
+	// Zero-padded records and JSON documents fit their slots; random bytes
+	// spill to the value log
+	noise := make([]byte, valueSize)
+	rand.New(rand.NewSource(1)).Read(noise)
+	makeValue := func(i int) []byte {
+		v := make([]byte, valueSize)
+		switch i % 3 {
+		case 0:
+			binary.BigEndian.PutUint64(v, uint64(i))
+		case 1:
+			copy(v, fmt.Sprintf(`{"id":%d,"name":"user-%d","active":true}`, i, i))
+		default:
+			copy(v, noise)
+			binary.BigEndian.PutUint64(v, uint64(i))
+		}
+		return v
+	}
+
+	numEntries := 3000
+	key := make([]byte, 8)
+	for i := 0; i < numEntries; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if err := ph.Put(key, makeValue(i)); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+	if err := ph.Put(key, make([]byte, 64)); err == nil {
+		t.Fatal("Expected an error for a value of the wrong size")
+	}
+
+	check := func(stage string) {
+		for i := 0; i < numEntries; i++ {
+			binary.BigEndian.PutUint64(key, uint64(i))
+			got, found := ph.Get(key)
+			if !found || !bytes.Equal(got, makeValue(i)) {
+				t.Fatalf("Key %d %s: got %x, found %v", i, stage, got, found)
+			}
+		}
+	}
+	check("after put")
+
+	stats := ph.CompressionStats()
+	if stats.Values != uint64(numEntries) || stats.Spilled != uint64(numEntries/3) ||
+		stats.Compressed != uint64(2*numEntries/3) {
+		t.Fatalf("CompressionStats() = %+v", stats)
+	}
+
+	// The same entries uncompressed
+	plainFile := filepath.Join(t.TempDir(), "uncompressed_test.phash")
+	plain, err := phash.OpenWithOptions(plainFile, 8, valueSize, &phash.Options{TTL: true})
+	if err != nil {
+		t.Fatalf("Failed to open uncompressed hash: %v", err)
+	}
+	for i := 0; i < numEntries; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		plain.Put(key, makeValue(i))
+	}
+	plain.Close()
+	fi, err := os.Stat(tempFile)
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	plainFi, err := os.Stat(plainFile)
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	if fi.Size()*3 > plainFi.Size() {
+		t.Fatalf("File is %d bytes, %d uncompressed", fi.Size(), plainFi.Size())
+	}
+
+	// Replace every spilled value, then delete a third of the rest
+	for i := 2; i < numEntries; i += 3 {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if err := ph.Update(key, func(old []byte, exists bool) ([]byte, bool) {
+			return old, exists
+		}); err != nil {
+			t.Fatalf("Failed to update key %d: %v", i, err)
+		}
+	}
+	for i := 0; i < numEntries; i += 9 {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		ph.Delete(key)
+	}
+	total, live := ph.ValueLogSize()
+	if live != total/2 {
+		t.Fatalf("ValueLogSize() = %d, %d after rewriting every spilled value", total, live)
+	}
+	if err := ph.CompactValueLog(); err != nil {
+		t.Fatalf("CompactValueLog failed: %v", err)
+	}
+	if total, live = ph.ValueLogSize(); total != live {
+		t.Fatalf("ValueLogSize() = %d, %d after compaction", total, live)
+	}
+
+	verify := func(stage string) {
+		for i := 0; i < numEntries; i++ {
+			binary.BigEndian.PutUint64(key, uint64(i))
+			got, found := ph.Get(key)
+			if i%9 == 0 {
+				if found {
+					t.Fatalf("Deleted key %d found %s", i, stage)
+				}
+			} else if !found || !bytes.Equal(got, makeValue(i)) {
+				t.Fatalf("Key %d %s: got %x, found %v", i, stage, got, found)
+			}
+		}
+	}
+	verify("after compaction")
+	if err := ph.Close(); err != nil {
+		t.Fatalf("Failed to close hash: %v", err)
+	}
+
+	ph, err = phash.OpenWithOptions(tempFile, 8, valueSize, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen hash: %v", err)
+	}
+	defer ph.Close()
+	verify("after reopen")
+}
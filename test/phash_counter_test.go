@@ -0,0 +1,86 @@
+package phash_test
+
+import (
+	"encoding/binary"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/theflywheel/phash"
+)
+
+func TestCounters(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "counter_test.phash")
+
+	ph, err := phash.OpenWithOptions(tempFile, 8, 8, &phash.Options{IncrementalResize: true})
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+
+	key := []byte("counter1")
+	if n, err := ph.Add(key, 5); err != nil || n != 5 {
+		t.Fatalf("Add on a new key = %d, %v, expected 5", n, err)
+	}
+	if n, err := ph.Add(key, -8); err != nil || n != -3 {
+		t.Fatalf("Add = %d, %v, expected -3", n, err)
+	}
+	val, _ := ph.Get(key)
+	if int64(binary.BigEndian.Uint64(val)) != -3 {
+		t.Fatalf("Stored counter is %x, expected -3", val)
+	}
+
+	wrap := []byte("counter2")
+	if _, err := ph.AddUint64(wrap, math.MaxUint64); err != nil {
+		t.Fatalf("AddUint64 failed: %v", err)
+	}
+	if n, err := ph.AddUint64(wrap, 2); err != nil || n != 1 {
+		t.Fatalf("AddUint64 did not wrap: %d, %v", n, err)
+	}
+
+	// Aggregate over enough keys to resize, with repeats within a call
+	numKeys := 3000
+	keys := make([][]byte, 0, 2*numKeys)
+	deltas := make([]int64, 0, 2*numKeys)
+	for i := 0; i < numKeys; i++ {
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, uint64(i))
+		keys = append(keys, k, k)
+		deltas = append(deltas, int64(i), 1)
+	}
+	for round := 0; round < 2; round++ {
+		if err := ph.AddMany(keys, deltas); err != nil {
+			t.Fatalf("AddMany failed: %v", err)
+		}
+	}
+	for i := 0; i < numKeys; i++ {
+		n, err := ph.Add(keys[2*i], 0)
+		if err != nil || n != int64(2*(i+1)) {
+			t.Fatalf("Counter %d = %d, %v, expected %d", i, n, err, 2*(i+1))
+		}
+	}
+
+	if err := ph.AddMany(keys[:1], nil); err == nil {
+		t.Fatalf("Expected an error for mismatched keys and deltas")
+	}
+	if err := ph.AddMany([][]byte{keys[0], []byte("bad")}, []int64{1, 1}); err == nil {
+		t.Fatalf("Expected an error for a bad key")
+	}
+	if n, _ := ph.Add(keys[0], 0); n != 2 {
+		t.Fatalf("Rejected AddMany changed counter 0 to %d", n)
+	}
+}
+
+func TestCountersNeedEightByteValues(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "counter_size_test.phash")
+
+	ph, err := phash.Open(tempFile, 8, 4)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+
+	if _, err := ph.Add([]byte("counter1"), 1); err == nil {
+		t.Fatalf("Expected an error adding to 4-byte values")
+	}
+}
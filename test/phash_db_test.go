@@ -0,0 +1,204 @@
+package phash_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/theflywheel/phash"
+)
+
+func TestDBTables(t *testing.T) {
+	dir := t.TempDir()
+	dbFile := filepath.Join(dir, "tables.phdb")
+
+	db, err := phash.OpenDB(dbFile, nil)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	users, err := db.CreateTable("users", 8, 16, nil)
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	counts, err := db.CreateTable("counts", 4, 8, &phash.Options{Layout: phash.LayoutRobinHood})
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if _, err := db.CreateTable("users", 8, 8, nil); err == nil {
+		t.Fatal("Expected an error creating a table twice")
+	}
+
+	// Both tables outgrow their first region, one after the other
+	const n = 3000
+	key8, val16 := make([]byte, 8), make([]byte, 16)
+	key4 := make([]byte, 4)
+	for i := 0; i < n; i++ {
+		binary.BigEndian.PutUint64(key8, uint64(i))
+		binary.BigEndian.PutUint64(val16[8:], uint64(i*2))
+		if err := users.Put(key8, val16); err != nil {
+			t.Fatalf("Failed to put user %d: %v", i, err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		binary.BigEndian.PutUint32(key4, uint32(i))
+		if _, err := counts.Add(key4, int64(i)); err != nil {
+			t.Fatalf("Failed to add count %d: %v", i, err)
+		}
+	}
+	if again, err := db.Table("users", nil); err != nil || again != users {
+		t.Fatalf("Table(users) = %p, %v; expected the open table %p", again, err, users)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close DB: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to list directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected only the DB file, found %d files", len(entries))
+	}
+
+	db, err = phash.OpenDB(dbFile, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	if names := db.Tables(); !reflect.DeepEqual(names, []string{"counts", "users"}) {
+		t.Fatalf("Tables() = %v", names)
+	}
+
+	users, err = db.Table("users", nil)
+	if err != nil {
+		t.Fatalf("Failed to open table: %v", err)
+	}
+	counts, err = db.Table("counts", nil)
+	if err != nil {
+		t.Fatalf("Failed to open table: %v", err)
+	}
+	if users.Len() != n || counts.Len() != n {
+		t.Fatalf("Len() = %d and %d, expected %d", users.Len(), counts.Len(), n)
+	}
+	for i := 0; i < n; i++ {
+		binary.BigEndian.PutUint64(key8, uint64(i))
+		val, found := users.Get(key8)
+		if !found || binary.BigEndian.Uint64(val[8:]) != uint64(i*2) {
+			t.Fatalf("User %d = %x, %v", i, val, found)
+		}
+		binary.BigEndian.PutUint32(key4, uint32(i))
+		val, found = counts.Get(key4)
+		if !found || binary.BigEndian.Uint64(val) != uint64(i) {
+			t.Fatalf("Count %d = %x, %v", i, val, found)
+		}
+	}
+
+	if err := db.DropTable("counts"); err == nil {
+		t.Fatal("Expected an error dropping an open table")
+	}
+	if err := counts.Close(); err != nil {
+		t.Fatalf("Failed to close table: %v", err)
+	}
+	if err := db.DropTable("counts"); err != nil {
+		t.Fatalf("Failed to drop table: %v", err)
+	}
+	if _, err := db.Table("counts", nil); err == nil {
+		t.Fatal("Expected an error opening a dropped table")
+	}
+	if names := db.Tables(); !reflect.DeepEqual(names, []string{"users"}) {
+		t.Fatalf("Tables() after drop = %v", names)
+	}
+}
+
+func TestDBRegionReuse(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "reuse.phdb")
+	db, err := phash.OpenDB(dbFile, nil)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// Tables that keep resizing must reuse the space they leave behind
+	for round := 0; round < 3; round++ {
+		name := fmt.Sprintf("t%d", round)
+		ph, err := db.CreateTable(name, 8, 8, nil)
+		if err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+		key := make([]byte, 8)
+		for i := 0; i < 5000; i++ {
+			binary.BigEndian.PutUint64(key, uint64(i))
+			if err := ph.Put(key, key); err != nil {
+				t.Fatalf("Failed to put key %d: %v", i, err)
+			}
+		}
+		if err := ph.Close(); err != nil {
+			t.Fatalf("Failed to close table: %v", err)
+		}
+		if err := db.DropTable(name); err != nil {
+			t.Fatalf("Failed to drop table: %v", err)
+		}
+	}
+
+	fi, err := os.Stat(dbFile)
+	if err != nil {
+		t.Fatalf("Failed to stat DB: %v", err)
+	}
+	if fi.Size() > 64<<10 {
+		t.Fatalf("DB file is %d bytes with no tables left", fi.Size())
+	}
+}
+
+func TestDBMixedTables(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "mixed.phdb")
+	tableOpts := map[string]*phash.Options{
+		"plain":   nil,
+		"secrets": {Encryption: phash.StaticKey("db master key")},
+		"custom":  {Hasher: clusterHasher{}},
+	}
+
+	db, err := phash.OpenDB(dbFile, nil)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	key := make([]byte, 8)
+	for name, opts := range tableOpts {
+		ph, err := db.CreateTable(name, 8, 8, opts)
+		if err != nil {
+			t.Fatalf("Failed to create table %s: %v", name, err)
+		}
+		for i := uint64(0); i < 100; i++ {
+			binary.BigEndian.PutUint64(key, i)
+			if err := ph.Put(key, []byte(fmt.Sprintf("%-8s", name))); err != nil {
+				t.Fatalf("Failed to put key %d in %s: %v", i, name, err)
+			}
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close DB: %v", err)
+	}
+
+	db, err = phash.OpenDB(dbFile, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Table("secrets", nil); err == nil {
+		t.Fatal("Expected an error opening the encrypted table without its key")
+	}
+	for name, opts := range tableOpts {
+		ph, err := db.Table(name, opts)
+		if err != nil {
+			t.Fatalf("Failed to open table %s: %v", name, err)
+		}
+		for i := uint64(0); i < 100; i++ {
+			binary.BigEndian.PutUint64(key, i)
+			if got, found := ph.Get(key); !found || string(got) != fmt.Sprintf("%-8s", name) {
+				t.Fatalf("Table %s key %d = %q, %v", name, i, got, found)
+			}
+		}
+	}
+}
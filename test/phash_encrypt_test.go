@@ -0,0 +1,170 @@
+package phash_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/theflywheel/phash"
+)
+
+func TestEncryption(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "encrypt_test.phash")
+	key1 := phash.StaticKey("first master key, for the tests")
+
+	ph, err := phash.OpenWithOptions(tempFile, 12, 16, &phash.Options{Encryption: key1, TTL: true})
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+
+	const n = 3000
+	secret := []byte("pii-")
+	entry := func(i int) ([]byte, []byte) {
+		key := append(append([]byte(nil), secret...), make([]byte, 8)...)
+		binary.BigEndian.PutUint64(key[4:], uint64(i))
+		value := bytes.Repeat([]byte{byte(i)}, 16)
+		copy(value, "secret-value")
+		return key, value
+	}
+	for i := 0; i < n; i++ {
+		key, value := entry(i)
+		if err := ph.Put(key, value); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+	if _, err := ph.Add(make([]byte, 12), 1); err == nil {
+		t.Fatal("Expected counters to be refused on an encrypted table")
+	}
+	seen := 0
+	if err := ph.ForEach(func(key, value []byte) bool {
+		i := int(binary.BigEndian.Uint64(key[4:]))
+		if _, expect := entry(i); !bytes.Equal(value, expect) {
+			t.Fatalf("ForEach gave %x for key %d", value, i)
+		}
+		seen++
+		return true
+	}); err != nil {
+		t.Fatalf("ForEach failed: %v", err)
+	}
+	if seen != n {
+		t.Fatalf("ForEach saw %d entries, expected %d", seen, n)
+	}
+	if err := ph.Close(); err != nil {
+		t.Fatalf("Failed to close hash: %v", err)
+	}
+
+	raw, err := os.ReadFile(tempFile)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if bytes.Contains(raw, secret) || bytes.Contains(raw, []byte("secret-value")) {
+		t.Fatal("Plaintext found in the encrypted file")
+	}
+
+	if _, err := phash.Open(tempFile, 12, 16); err == nil {
+		t.Fatal("Expected an error opening without the key")
+	}
+	if _, err := phash.OpenWithOptions(tempFile, 12, 16, &phash.Options{Encryption: phash.StaticKey("wrong")}); err == nil {
+		t.Fatal("Expected an error opening with the wrong key")
+	}
+
+	key2 := phash.StaticKey("second master key")
+	if err := phash.RotateKeys(tempFile, key1, key2, nil); err != nil {
+		t.Fatalf("Failed to rotate keys: %v", err)
+	}
+	if _, err := phash.OpenWithOptions(tempFile, 12, 16, &phash.Options{Encryption: key1}); err == nil {
+		t.Fatal("Expected the old key to be refused after rotation")
+	}
+
+	ph, err = phash.OpenWithOptions(tempFile, 12, 16, &phash.Options{Encryption: key2})
+	if err != nil {
+		t.Fatalf("Failed to open rotated hash: %v", err)
+	}
+	defer ph.Close()
+	if ph.Len() != n {
+		t.Fatalf("Len() = %d after rotation, expected %d", ph.Len(), n)
+	}
+	for i := 0; i < n; i++ {
+		key, value := entry(i)
+		got, found := ph.Get(key)
+		if !found || !bytes.Equal(got, value) {
+			t.Fatalf("Key %d = %x, %v after rotation", i, got, found)
+		}
+	}
+	if _, found := ph.Get(make([]byte, 12)); found {
+		t.Fatal("Absent key found")
+	}
+	key, value := entry(0)
+	updated := bytes.Repeat([]byte{0xEE}, 16)
+	if swapped, err := ph.CompareAndSwap(key, value, updated); !swapped || err != nil {
+		t.Fatalf("CompareAndSwap = %v, %v", swapped, err)
+	}
+	if got, _ := ph.Get(key); !bytes.Equal(got, updated) {
+		t.Fatalf("Get after CompareAndSwap = %x", got)
+	}
+}
+
+func TestEncryptedBatch(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "encrypt_batch_test.phash")
+	opts := &phash.Options{Encryption: phash.StaticKey("batch master key")}
+
+	ph, err := phash.OpenWithOptions(tempFile, 8, 8, opts)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	ph.Put([]byte("removeme"), []byte("whatever"))
+
+	// Both go through the batch log, which must be sealed like the table
+	var b phash.Batch
+	b.Put([]byte("batchkey"), []byte("batchval"))
+	b.Delete([]byte("removeme"))
+	if err := ph.Write(&b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	txn := ph.Begin()
+	txn.Put([]byte("txnkey00"), []byte("txnval00"))
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if err := ph.Close(); err != nil {
+		t.Fatalf("Failed to close hash: %v", err)
+	}
+
+	ph, err = phash.OpenWithOptions(tempFile, 8, 8, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen hash: %v", err)
+	}
+	defer ph.Close()
+	for key, want := range map[string]string{"batchkey": "batchval", "txnkey00": "txnval00"} {
+		if got, found := ph.Get([]byte(key)); !found || string(got) != want {
+			t.Fatalf("Get(%q) = %q, %v", key, got, found)
+		}
+	}
+	if _, found := ph.Get([]byte("removeme")); found {
+		t.Fatal("Deleted key found")
+	}
+}
+
+func TestRotateKeysMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing.phash")
+	key1, key2 := phash.StaticKey("first"), phash.StaticKey("second")
+
+	if err := phash.RotateKeys(missing, key1, key2, nil); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("RotateKeys on a missing file = %v", err)
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatal("RotateKeys created the missing file")
+	}
+
+	empty := filepath.Join(dir, "empty.phash")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := phash.RotateKeys(empty, key1, key2, nil); err == nil {
+		t.Fatal("Expected an error rotating an empty file")
+	}
+}
@@ -0,0 +1,125 @@
+package phash_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/theflywheel/phash"
+)
+
+func TestHashFuncs(t *testing.T) {
+	testCases := []struct {
+		name     string
+		hashFunc phash.HashFunc
+	}{
+		{"FNV1a", phash.HashFNV1a},
+		{"XXH64", phash.HashXXH64},
+		{"Wyhash", phash.HashWyhash},
+		{"SipHash", phash.HashSipHash},
+	}
+
+	keySize := uint32(16)
+	valueSize := uint32(8)
+	numEntries := 3000 // enough for a couple of resizes
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tempFile := "hasher_test_" + tc.name + ".phash"
+			defer os.Remove(tempFile)
+
+			ph, err := phash.OpenWithOptions(tempFile, keySize, valueSize, &phash.Options{HashFunc: tc.hashFunc})
+			if err != nil {
+				t.Fatalf("Failed to open hash: %v", err)
+			}
+
+			for i := 0; i < numEntries; i++ {
+				key := make([]byte, keySize)
+				value := make([]byte, valueSize)
+				binary.BigEndian.PutUint64(key[8:], uint64(i))
+				binary.BigEndian.PutUint64(value, uint64(i*3))
+				if err := ph.Put(key, value); err != nil {
+					t.Fatalf("Failed to put key %d: %v", i, err)
+				}
+			}
+			if err := ph.Close(); err != nil {
+				t.Fatalf("Failed to close hash: %v", err)
+			}
+
+			// Plain Open must pick up the hash function from the header
+			ph, err = phash.Open(tempFile, keySize, valueSize)
+			if err != nil {
+				t.Fatalf("Failed to reopen hash: %v", err)
+			}
+			defer ph.Close()
+
+			for i := 0; i < numEntries; i++ {
+				key := make([]byte, keySize)
+				expected := make([]byte, valueSize)
+				binary.BigEndian.PutUint64(key[8:], uint64(i))
+				binary.BigEndian.PutUint64(expected, uint64(i*3))
+
+				got, found := ph.Get(key)
+				if !found {
+					t.Fatalf("Key %d not found after reopen", i)
+				}
+				if !bytes.Equal(got, expected) {
+					t.Errorf("Value mismatch for key %d after reopen", i)
+				}
+			}
+		})
+	}
+}
+
+// lastByteHasher is a deliberately poor custom hash function
+type lastByteHasher struct{}
+
+func (lastByteHasher) Hash(key []byte) uint64 {
+	return uint64(key[len(key)-1])
+}
+
+func TestCustomHasher(t *testing.T) {
+	tempFile := "custom_hasher_test.phash"
+	defer os.Remove(tempFile)
+
+	keySize := uint32(8)
+	valueSize := uint32(8)
+	opts := &phash.Options{Hasher: lastByteHasher{}}
+
+	ph, err := phash.OpenWithOptions(tempFile, keySize, valueSize, opts)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	key := make([]byte, keySize)
+	value := make([]byte, valueSize)
+	for i := uint64(0); i < 100; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		binary.BigEndian.PutUint64(value, i)
+		if err := ph.Put(key, value); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+	if err := ph.Close(); err != nil {
+		t.Fatalf("Failed to close hash: %v", err)
+	}
+
+	if ph, err := phash.Open(tempFile, keySize, valueSize); err == nil {
+		ph.Close()
+		t.Fatal("Expected an error reopening a custom-hash file without its hasher")
+	}
+
+	ph, err = phash.OpenWithOptions(tempFile, keySize, valueSize, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen hash with its hasher: %v", err)
+	}
+	defer ph.Close()
+
+	for i := uint64(0); i < 100; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		got, found := ph.Get(key)
+		if !found || binary.BigEndian.Uint64(got) != i {
+			t.Fatalf("Key %d not found or wrong after reopen", i)
+		}
+	}
+}
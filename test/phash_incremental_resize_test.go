@@ -0,0 +1,315 @@
+package phash_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/theflywheel/phash"
+)
+
+func TestIncrementalResize(t *testing.T) {
+	tempFile := "incremental_resize_test.phash"
+	defer os.Remove(tempFile)
+
+	keySize := uint32(8)
+	valueSize := uint32(8)
+
+	opts := &phash.Options{IncrementalResize: true, ResizeStep: 16}
+	ph, err := phash.OpenWithOptions(tempFile, keySize, valueSize, opts)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+
+	numEntries := 5000
+	for i := 0; i < numEntries; i++ {
+		key := make([]byte, keySize)
+		value := make([]byte, valueSize)
+		binary.BigEndian.PutUint64(key, uint64(i))
+		binary.BigEndian.PutUint64(value, uint64(i*100))
+
+		if err := ph.Put(key, value); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+
+		// Every key written so far must stay visible while slots are
+		// being migrated between the two tables.
+		for j := 0; j <= i; j += 97 {
+			binary.BigEndian.PutUint64(key, uint64(j))
+			got, found := ph.Get(key)
+			if !found {
+				t.Fatalf("Key %d not found after inserting %d keys", j, i+1)
+			}
+			if binary.BigEndian.Uint64(got) != uint64(j*100) {
+				t.Fatalf("Value mismatch for key %d after inserting %d keys", j, i+1)
+			}
+		}
+	}
+
+	// Overwrite half the keys, some of which are still in the old table
+	for i := 0; i < numEntries; i += 2 {
+		key := make([]byte, keySize)
+		value := make([]byte, valueSize)
+		binary.BigEndian.PutUint64(key, uint64(i))
+		binary.BigEndian.PutUint64(value, uint64(i*7))
+
+		if err := ph.Put(key, value); err != nil {
+			t.Fatalf("Failed to overwrite key %d: %v", i, err)
+		}
+	}
+
+	// Delete every tenth key while the migration is still running
+	for i := 1; i < numEntries; i += 10 {
+		key := make([]byte, keySize)
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if !ph.Delete(key) {
+			t.Fatalf("Failed to delete key %d", i)
+		}
+		if _, found := ph.Get(key); found {
+			t.Fatalf("Key %d still found after delete", i)
+		}
+	}
+
+	// Close finishes any resize still in flight
+	if err := ph.Close(); err != nil {
+		t.Fatalf("Failed to close hash: %v", err)
+	}
+	if _, err := os.Stat(tempFile + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Expected temp file to be gone after close, stat err: %v", err)
+	}
+
+	ph, err = phash.Open(tempFile, keySize, valueSize)
+	if err != nil {
+		t.Fatalf("Failed to reopen hash: %v", err)
+	}
+	defer ph.Close()
+
+	for i := 0; i < numEntries; i++ {
+		key := make([]byte, keySize)
+		expected := make([]byte, valueSize)
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if i%2 == 0 {
+			binary.BigEndian.PutUint64(expected, uint64(i*7))
+		} else {
+			binary.BigEndian.PutUint64(expected, uint64(i*100))
+		}
+
+		got, found := ph.Get(key)
+		if i%10 == 1 {
+			if found {
+				t.Fatalf("Deleted key %d found after reopen", i)
+			}
+			continue
+		}
+		if !found {
+			t.Fatalf("Key %d not found after reopen", i)
+		}
+		if !bytes.Equal(got, expected) {
+			t.Errorf("Value mismatch for key %d after reopen: expected %v, got %v", i, expected, got)
+		}
+	}
+}
+
+func TestBackgroundResize(t *testing.T) {
+	tempFile := "background_resize_test.phash"
+	defer os.Remove(tempFile)
+
+	keySize := uint32(8)
+	valueSize := uint32(8)
+
+	started := make(chan phash.ResizeInfo, 16)
+	finished := make(chan phash.ResizeInfo, 16)
+	opts := &phash.Options{
+		BackgroundResize:  true,
+		ResizeThreshold:   0.5,
+		ResizeStep:        64,
+		ResizeBytesPerSec: 1 << 20,
+		OnResizeStart:     func(info phash.ResizeInfo) { started <- info },
+		OnResizeFinish:    func(info phash.ResizeInfo) { finished <- info },
+	}
+	ph, err := phash.OpenWithOptions(tempFile, keySize, valueSize, opts)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+
+	// Cross the soft threshold of the initial 1024 slots, but not the hard one
+	numEntries := 600
+	key := make([]byte, keySize)
+	value := make([]byte, valueSize)
+	for i := 0; i < numEntries; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		binary.BigEndian.PutUint64(value, uint64(i))
+		if err := ph.Put(key, value); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+
+	info := <-started
+	if info.OldSlots != 1024 || info.NewSlots != 2048 || !info.Background {
+		t.Errorf("Unexpected resize start info: %+v", info)
+	}
+
+	info = <-finished
+	if info.Err != nil {
+		t.Fatalf("Background resize failed: %v", info.Err)
+	}
+	if info.Duration <= 0 {
+		t.Errorf("Expected a positive resize duration, got %v", info.Duration)
+	}
+
+	for i := 0; i < numEntries; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		got, found := ph.Get(key)
+		if !found {
+			t.Fatalf("Key %d not found after background resize", i)
+		}
+		if binary.BigEndian.Uint64(got) != uint64(i) {
+			t.Errorf("Value mismatch for key %d after background resize", i)
+		}
+	}
+}
+
+func TestIncrementalResizeDeletes(t *testing.T) {
+	tempFile := "incremental_resize_delete_test.phash"
+	defer os.Remove(tempFile)
+
+	keySize := uint32(8)
+	valueSize := uint32(8)
+
+	// One slot per write keeps the migration running for the whole test
+	opts := &phash.Options{IncrementalResize: true, ResizeStep: 1}
+	ph, err := phash.OpenWithOptions(tempFile, keySize, valueSize, opts)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+
+	key := make([]byte, keySize)
+	value := make([]byte, valueSize)
+	for i := uint64(0); i < 800; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		binary.BigEndian.PutUint64(value, i)
+		if err := ph.Put(key, value); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+
+	// Delete keys from both tables, then bring a few back
+	for i := uint64(0); i < 800; i += 4 {
+		binary.BigEndian.PutUint64(key, i)
+		if !ph.Delete(key) {
+			t.Fatalf("Failed to delete key %d", i)
+		}
+	}
+	for i := uint64(0); i < 800; i += 8 {
+		binary.BigEndian.PutUint64(key, i)
+		binary.BigEndian.PutUint64(value, i+1)
+		if err := ph.Put(key, value); err != nil {
+			t.Fatalf("Failed to re-put key %d: %v", i, err)
+		}
+	}
+
+	for i := uint64(0); i < 800; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		got, found := ph.Get(key)
+		switch {
+		case i%8 == 0:
+			if !found || binary.BigEndian.Uint64(got) != i+1 {
+				t.Fatalf("Re-inserted key %d missing or stale", i)
+			}
+		case i%4 == 0:
+			if found {
+				t.Fatalf("Deleted key %d still found", i)
+			}
+		default:
+			if !found || binary.BigEndian.Uint64(got) != i {
+				t.Fatalf("Key %d missing or wrong", i)
+			}
+		}
+	}
+}
+
+func TestIncrementalResizeCrash(t *testing.T) {
+	modes := map[string]*phash.Options{
+		"incremental": {IncrementalResize: true, ResizeStep: 1},
+		// Throttled so the migration is still running when the child exits
+		"background": {BackgroundResize: true, ResizeStep: 1, ResizeBytesPerSec: 1},
+		"valuelog":   {IncrementalResize: true, ResizeStep: 1, ValueLog: true},
+	}
+
+	// The child writes while a resize is in flight and exits without Close
+	if path := os.Getenv("PHASH_CRASH_FILE"); path != "" {
+		opts := modes[os.Getenv("PHASH_CRASH_MODE")]
+		ph, err := phash.OpenWithOptions(path, 8, 8, opts)
+		if err != nil {
+			t.Fatalf("Failed to open hash: %v", err)
+		}
+		key := make([]byte, 8)
+		value := make([]byte, 8)
+		for i := uint64(0); i < 800; i++ {
+			binary.BigEndian.PutUint64(key, i)
+			binary.BigEndian.PutUint64(value, i)
+			if err := ph.Put(key, value); err != nil {
+				t.Fatalf("Failed to put key %d: %v", i, err)
+			}
+		}
+		for i := uint64(0); i < 800; i += 4 {
+			binary.BigEndian.PutUint64(key, i)
+			ph.Delete(key)
+		}
+		os.Exit(0)
+	}
+
+	for mode := range modes {
+		t.Run(mode, func(t *testing.T) {
+			tempFile := filepath.Join(t.TempDir(), "incremental_resize_crash_test.phash")
+			cmd := exec.Command(os.Args[0], "-test.run=^TestIncrementalResizeCrash$")
+			cmd.Env = append(os.Environ(), "PHASH_CRASH_FILE="+tempFile, "PHASH_CRASH_MODE="+mode)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("Child process failed: %v\n%s", err, out)
+			}
+			checkCrashedTable(t, tempFile, modes[mode].ValueLog)
+		})
+	}
+}
+
+// checkCrashedTable reopens a table left behind by the crash test's child.
+func checkCrashedTable(t *testing.T, tempFile string, valueLog bool) {
+	if _, err := os.Stat(tempFile + ".grow"); err != nil {
+		t.Fatalf("Expected a resize log after the crash: %v", err)
+	}
+
+	ph, err := phash.Open(tempFile, 8, 8)
+	if err != nil {
+		t.Fatalf("Failed to reopen hash: %v", err)
+	}
+	defer ph.Close()
+
+	key := make([]byte, 8)
+	for i := uint64(0); i < 800; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		got, found := ph.Get(key)
+		if i%4 == 0 {
+			if found {
+				t.Fatalf("Deleted key %d found after the crash", i)
+			}
+			continue
+		}
+		if !found || binary.BigEndian.Uint64(got) != i {
+			t.Fatalf("Key %d missing or wrong after the crash", i)
+		}
+	}
+	if ph.Len() != 600 {
+		t.Fatalf("Len() = %d, expected 600", ph.Len())
+	}
+	if _, live := ph.ValueLogSize(); valueLog && live != 600*8 {
+		t.Fatalf("Value log live bytes = %d, expected %d", live, 600*8)
+	}
+	if _, err := os.Stat(tempFile + ".grow"); !os.IsNotExist(err) {
+		t.Fatalf("Resize log left behind after replay: %v", err)
+	}
+}
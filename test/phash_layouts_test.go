@@ -0,0 +1,313 @@
+package phash_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/theflywheel/phash"
+)
+
+// TestLayouts runs the same put/delete/reopen workload against every layout,
+// with both regular and incremental resizing.
+func TestLayouts(t *testing.T) {
+	layouts := []struct {
+		name   string
+		layout phash.Layout
+	}{
+		{"Linear", phash.LayoutLinear},
+		{"RobinHood", phash.LayoutRobinHood},
+		{"Swiss", phash.LayoutSwiss},
+		{"Cuckoo", phash.LayoutCuckoo},
+	}
+
+	keySize := uint32(16)
+	valueSize := uint32(100)
+	numEntries := uint64(4000)
+
+	makeValue := func(i uint64) []byte {
+		value := make([]byte, valueSize)
+		for j := range value {
+			value[j] = byte(i + uint64(j))
+		}
+		return value
+	}
+
+	for _, l := range layouts {
+		for _, incremental := range []bool{false, true} {
+			name := l.name
+			if incremental {
+				name += "_Incremental"
+			}
+			t.Run(name, func(t *testing.T) {
+				tempFile := "layout_test_" + name + ".phash"
+				defer os.Remove(tempFile)
+
+				opts := &phash.Options{Layout: l.layout, IncrementalResize: incremental, ResizeStep: 8}
+				ph, err := phash.OpenWithOptions(tempFile, keySize, valueSize, opts)
+				if err != nil {
+					t.Fatalf("Failed to open hash: %v", err)
+				}
+
+				key := make([]byte, keySize)
+				for i := uint64(0); i < numEntries; i++ {
+					binary.BigEndian.PutUint64(key[8:], i)
+					if err := ph.Put(key, makeValue(i)); err != nil {
+						t.Fatalf("Failed to put key %d: %v", i, err)
+					}
+				}
+
+				for i := uint64(0); i < numEntries; i += 5 {
+					binary.BigEndian.PutUint64(key[8:], i)
+					if !ph.Delete(key) {
+						t.Fatalf("Failed to delete key %d", i)
+					}
+				}
+
+				// Reuse some of the freed slots
+				for i := uint64(0); i < numEntries; i += 10 {
+					binary.BigEndian.PutUint64(key[8:], i)
+					if err := ph.Put(key, makeValue(i+1)); err != nil {
+						t.Fatalf("Failed to re-put key %d: %v", i, err)
+					}
+				}
+
+				check := func(stage string) {
+					for i := uint64(0); i < numEntries+500; i++ {
+						binary.BigEndian.PutUint64(key[8:], i)
+						got, found := ph.Get(key)
+
+						var expected []byte
+						switch {
+						case i >= numEntries:
+						case i%10 == 0:
+							expected = makeValue(i + 1)
+						case i%5 != 0:
+							expected = makeValue(i)
+						}
+
+						if found != (expected != nil) {
+							t.Fatalf("Key %d %s: expected found=%v, got %v", i, stage, expected != nil, found)
+						}
+						if found && !bytes.Equal(got, expected) {
+							t.Fatalf("Value mismatch for key %d %s", i, stage)
+						}
+					}
+				}
+
+				check("before reopen")
+				if err := ph.Close(); err != nil {
+					t.Fatalf("Failed to close hash: %v", err)
+				}
+
+				ph, err = phash.Open(tempFile, keySize, valueSize)
+				if err != nil {
+					t.Fatalf("Failed to reopen hash: %v", err)
+				}
+				defer ph.Close()
+				check("after reopen")
+			})
+		}
+	}
+}
+
+func TestCuckooHighLoad(t *testing.T) {
+	tempFile := "cuckoo_high_load_test.phash"
+	defer os.Remove(tempFile)
+
+	keySize := uint32(8)
+	valueSize := uint32(8)
+	opts := &phash.Options{Layout: phash.LayoutCuckoo, HashFunc: phash.HashWyhash, MaxLoadFactor: 0.93}
+
+	ph, err := phash.OpenWithOptions(tempFile, keySize, valueSize, opts)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+
+	// Fill the initial 1024 slots to 0.93 so the displacement search has to
+	// do real work, then keep going through a resize.
+	key := make([]byte, keySize)
+	value := make([]byte, valueSize)
+	for i := uint64(0); i < 3000; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		binary.BigEndian.PutUint64(value, ^i)
+		if err := ph.Put(key, value); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+
+	for i := uint64(0); i < 3000; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		got, found := ph.Get(key)
+		if !found || binary.BigEndian.Uint64(got) != ^i {
+			t.Fatalf("Key %d missing or wrong after displacements", i)
+		}
+	}
+}
+
+func TestCuckooBucketAlignment(t *testing.T) {
+	for _, valueSize := range []uint32{8, 40, 100} {
+		tempFile := "cuckoo_alignment_test.phash"
+		opts := &phash.Options{Layout: phash.LayoutCuckoo, TTL: true}
+		ph, err := phash.OpenWithOptions(tempFile, 8, valueSize, opts)
+		if err != nil {
+			t.Fatalf("Failed to open hash: %v", err)
+		}
+		key := make([]byte, 8)
+		value := make([]byte, valueSize)
+		for i := uint64(0); i < 2000; i++ {
+			binary.BigEndian.PutUint64(key, i)
+			binary.BigEndian.PutUint64(value, ^i)
+			if err := ph.Put(key, value); err != nil {
+				t.Fatalf("Failed to put key %d: %v", i, err)
+			}
+		}
+		for i := uint64(0); i < 2000; i++ {
+			binary.BigEndian.PutUint64(key, i)
+			got, found := ph.Get(key)
+			if !found || binary.BigEndian.Uint64(got) != ^i || len(got) != int(valueSize) {
+				t.Fatalf("Key %d: got %x, found %v", i, got, found)
+			}
+		}
+		if err := ph.Close(); err != nil {
+			t.Fatalf("Failed to close hash: %v", err)
+		}
+
+		raw, err := os.ReadFile(tempFile)
+		os.Remove(tempFile)
+		if err != nil {
+			t.Fatalf("Failed to read file: %v", err)
+		}
+		numSlots := int(binary.BigEndian.Uint32(raw[8:12]))
+		slotSize := int(binary.BigEndian.Uint32(raw[16:20]))
+		base := len(raw) - numSlots*slotSize
+		if base%64 != 0 || (4*slotSize)%64 != 0 {
+			t.Fatalf("%d-byte values: slots of %d bytes from offset %d leave buckets off cache lines",
+				valueSize, slotSize, base)
+		}
+	}
+}
+
+// constantHasher sends every key to the same two buckets
+type constantHasher struct{}
+
+func (constantHasher) Hash([]byte) uint64 { return 42 }
+
+func TestCuckooBoundedCollisions(t *testing.T) {
+	tempFile := "cuckoo_collision_test.phash"
+	defer os.Remove(tempFile)
+	defer os.Remove(tempFile + ".tmp")
+
+	opts := &phash.Options{Layout: phash.LayoutCuckoo, Hasher: constantHasher{}}
+	ph, err := phash.OpenWithOptions(tempFile, 8, 8, opts)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+
+	// Two 4-way buckets hold exactly eight colliding keys; the ninth must
+	// fail instead of scanning the table.
+	key := make([]byte, 8)
+	value := make([]byte, 8)
+	for i := uint64(0); i < 8; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		if err := ph.Put(key, value); err != nil {
+			t.Fatalf("Failed to put colliding key %d: %v", i, err)
+		}
+	}
+	binary.BigEndian.PutUint64(key, 8)
+	if err := ph.Put(key, value); err == nil {
+		t.Fatal("Expected an error for a ninth colliding key")
+	}
+	for i := uint64(0); i < 8; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		if _, found := ph.Get(key); !found {
+			t.Fatalf("Colliding key %d lost", i)
+		}
+	}
+}
+
+// clusterHasher sends every key to one of the last four or first four slots
+// of a power-of-two table
+type clusterHasher struct{}
+
+func (clusterHasher) Hash(key []byte) uint64 { return 1<<32 - 4 + uint64(key[len(key)-1]%8) }
+
+func TestLinearChurn(t *testing.T) {
+	tempFile := "linear_churn_test.phash"
+	defer os.Remove(tempFile)
+
+	ph, err := phash.Open(tempFile, 8, 8)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+
+	// Insert/delete churn around a few live keys
+	key := make([]byte, 8)
+	value := make([]byte, 8)
+	for i := uint64(0); i < 20000; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		if err := ph.Put(key, value); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+		if i%40 != 0 && !ph.Delete(key) {
+			t.Fatalf("Failed to delete key %d", i)
+		}
+	}
+	if ph.Len() != 500 {
+		t.Fatalf("Len() = %d, expected 500", ph.Len())
+	}
+	if err := ph.Close(); err != nil {
+		t.Fatalf("Failed to close hash: %v", err)
+	}
+
+	// Misses walk every non-empty slot of a run, so only live entries may
+	// be left
+	raw, err := os.ReadFile(tempFile)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	numSlots := int(binary.BigEndian.Uint32(raw[8:12]))
+	slotSize := int(binary.BigEndian.Uint32(raw[16:20]))
+	base := len(raw) - numSlots*slotSize
+	nonEmpty := 0
+	for i := 0; i < numSlots; i++ {
+		if raw[base+i*slotSize] != 0 {
+			nonEmpty++
+		}
+	}
+	if nonEmpty != 500 {
+		t.Fatalf("%d non-empty slots for 500 entries", nonEmpty)
+	}
+
+	// Deletes in the middle of long runs, including ones that wrap
+	clusterFile := "linear_cluster_test.phash"
+	defer os.Remove(clusterFile)
+	ph, err = phash.OpenWithOptions(clusterFile, 8, 8, &phash.Options{Hasher: clusterHasher{}})
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+	for i := uint64(0); i < 600; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		binary.BigEndian.PutUint64(value, ^i)
+		if err := ph.Put(key, value); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+	for i := uint64(0); i < 600; i += 3 {
+		binary.BigEndian.PutUint64(key, i)
+		if !ph.Delete(key) {
+			t.Fatalf("Failed to delete key %d", i)
+		}
+	}
+	for i := uint64(0); i < 600; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		got, found := ph.Get(key)
+		if found != (i%3 != 0) || (found && binary.BigEndian.Uint64(got) != ^i) {
+			t.Fatalf("Key %d: got %x, found %v", i, got, found)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package phash_test
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	"github.com/theflywheel/phash"
+)
+
+func TestOpenMemory(t *testing.T) {
+	ph, err := phash.OpenMemory(8, 8)
+	if err != nil {
+		t.Fatalf("Failed to open in-memory hash: %v", err)
+	}
+	defer ph.Close()
+
+	// Enough keys to resize a few times
+	const n = 10000
+	key := make([]byte, 8)
+	for i := 0; i < n; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if err := ph.Put(key, key); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+	for i := 0; i < n; i += 2 {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if !ph.Delete(key) {
+			t.Fatalf("Failed to delete key %d", i)
+		}
+	}
+
+	b := &phash.Batch{}
+	binary.BigEndian.PutUint64(key, n)
+	b.Put(key, key)
+	if err := ph.Write(b); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+	if ph.Len() != n/2+1 {
+		t.Fatalf("Len() = %d, expected %d", ph.Len(), n/2+1)
+	}
+
+	path := filepath.Join(t.TempDir(), "saved.phash")
+	if err := ph.SaveTo(path); err != nil {
+		t.Fatalf("Failed to save: %v", err)
+	}
+
+	saved, err := phash.Open(path, 8, 8)
+	if err != nil {
+		t.Fatalf("Failed to open saved file: %v", err)
+	}
+	defer saved.Close()
+	if saved.Len() != n/2+1 {
+		t.Fatalf("Saved Len() = %d, expected %d", saved.Len(), n/2+1)
+	}
+	for i := 0; i <= n; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		val, found := saved.Get(key)
+		if expect := i%2 == 1 || i == n; found != expect {
+			t.Fatalf("Saved key %d found = %v, expected %v", i, found, expect)
+		}
+		if found && binary.BigEndian.Uint64(val) != uint64(i) {
+			t.Fatalf("Saved key %d has value %x", i, val)
+		}
+	}
+
+	// The in-memory table is unaffected by writes to the saved copy
+	binary.BigEndian.PutUint64(key, 1)
+	saved.Delete(key)
+	if _, found := ph.Get(key); !found {
+		t.Fatal("Deleting from the saved file changed the in-memory table")
+	}
+
+	if _, err := phash.OpenMemoryWithOptions(8, 8, &phash.Options{ValueLog: true}); err == nil {
+		t.Fatal("Expected an error for an in-memory value log")
+	}
+}
@@ -0,0 +1,205 @@
+package phash_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/theflywheel/phash"
+)
+
+func TestMultiMap(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "multimap_test.phash")
+
+	// 2-byte values are padded to hold the head's count
+	m, err := phash.OpenMultiMap(tempFile, 8, 2, nil)
+	if err != nil {
+		t.Fatalf("Failed to open multimap: %v", err)
+	}
+
+	numKeys := 300
+	key := make([]byte, 8)
+	value := make([]byte, 2)
+	for i := 0; i < numKeys; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		for j := 0; j < i%10+1; j++ {
+			binary.BigEndian.PutUint16(value, uint16(j))
+			if err := m.Append(key, value); err != nil {
+				t.Fatalf("Failed to append %d to key %d: %v", j, i, err)
+			}
+		}
+	}
+
+	values := func(m *phash.MultiMap, i int) []int {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		var got []int
+		it := m.GetAll(key)
+		for it.Next() {
+			got = append(got, int(binary.BigEndian.Uint16(it.Value())))
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("Iterating key %d failed: %v", i, err)
+		}
+		if m.Count(key) != len(got) {
+			t.Fatalf("Count(%d) = %d, iterator saw %d", i, m.Count(key), len(got))
+		}
+		return got
+	}
+	for i := 0; i < numKeys; i++ {
+		got := values(m, i)
+		for j := range got {
+			if got[j] != j {
+				t.Fatalf("Key %d values %v not in append order", i, got)
+			}
+		}
+		if len(got) != i%10+1 {
+			t.Fatalf("Key %d has %d values", i, len(got))
+		}
+	}
+
+	// Remove value 0 from every key: the last value moves into its place
+	for i := 0; i < numKeys; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		binary.BigEndian.PutUint16(value, 0)
+		removed, err := m.RemoveValue(key, value)
+		if err != nil || !removed {
+			t.Fatalf("RemoveValue(%d) = %v, %v", i, removed, err)
+		}
+		if removed, _ := m.RemoveValue(key, value); removed {
+			t.Fatalf("Removed value 0 of key %d twice", i)
+		}
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatalf("Failed to close multimap: %v", err)
+	}
+	if _, err := phash.OpenMultiMap(tempFile, 8, 8, nil); err == nil {
+		t.Fatalf("Expected an error for the wrong value size")
+	}
+	m, err = phash.OpenMultiMap(tempFile, 8, 2, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen multimap: %v", err)
+	}
+	defer m.Close()
+
+	for i := 0; i < numKeys; i++ {
+		got := values(m, i)
+		sort.Ints(got)
+		if len(got) != i%10 {
+			t.Fatalf("Key %d has %d values after remove", i, len(got))
+		}
+		for j := range got {
+			if got[j] != j+1 {
+				t.Fatalf("Key %d values %v after remove", i, got)
+			}
+		}
+	}
+
+	// A key whose last value goes has no head left behind
+	binary.BigEndian.PutUint64(key, 0)
+	if m.Count(key) != 0 || m.Hash().Len() != (numKeys/10)*45+numKeys-numKeys/10 {
+		t.Fatalf("Count(0) = %d, %d slots in use", m.Count(key), m.Hash().Len())
+	}
+}
+
+func TestMultiMapValueLog(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "multimap_log_test.phash")
+
+	m, err := phash.OpenMultiMap(tempFile, 4, 0, &phash.Options{ValueLog: true})
+	if err != nil {
+		t.Fatalf("Failed to open multimap: %v", err)
+	}
+	defer m.Close()
+
+	key := []byte("term")
+	var want [][]byte
+	for i := 0; i < 50; i++ {
+		v := []byte(fmt.Sprintf("doc-%d", i*i))
+		want = append(want, v)
+		if err := m.Append(key, v); err != nil {
+			t.Fatalf("Failed to append %d: %v", i, err)
+		}
+	}
+	if removed, err := m.RemoveValue(key, want[49]); err != nil || !removed {
+		t.Fatalf("RemoveValue = %v, %v", removed, err)
+	}
+
+	it := m.GetAll(key)
+	n := 0
+	for ; it.Next(); n++ {
+		if !bytes.Equal(it.Value(), want[n]) {
+			t.Fatalf("Value %d = %q, expected %q", n, it.Value(), want[n])
+		}
+	}
+	if n != 49 || m.Count(key) != 49 {
+		t.Fatalf("Iterated %d values, Count() = %d", n, m.Count(key))
+	}
+}
+
+// walHasher hashes like FNV-1a, and when armed exits the process the first
+// time it places a head record while a batch log exists: part way through
+// applying RemoveValue's batch.
+type walHasher struct {
+	armed string // path of the table
+}
+
+func (h walHasher) Hash(key []byte) uint64 {
+	if h.armed != "" && binary.BigEndian.Uint32(key[len(key)-4:]) == 0 {
+		if _, err := os.Stat(h.armed + ".wal"); err == nil {
+			os.Exit(0)
+		}
+	}
+	f := fnv.New64a()
+	f.Write(key)
+	return f.Sum64()
+}
+
+func TestMultiMapRemoveCrash(t *testing.T) {
+	key := []byte("crashkey")
+	values := [][]byte{[]byte("value-01"), []byte("value-02"), []byte("value-03")}
+
+	if path := os.Getenv("PHASH_MULTIMAP_CRASH_FILE"); path != "" {
+		m, err := phash.OpenMultiMap(path, 8, 8, &phash.Options{Hasher: walHasher{armed: path}})
+		if err != nil {
+			t.Fatalf("Failed to open multimap: %v", err)
+		}
+		for _, v := range values {
+			if err := m.Append(key, v); err != nil {
+				t.Fatalf("Failed to append: %v", err)
+			}
+		}
+		// The last value is moved into the hole before the crash
+		m.RemoveValue(key, values[0])
+		t.Fatal("Expected to crash in RemoveValue")
+	}
+
+	tempFile := filepath.Join(t.TempDir(), "multimap_crash_test.phash")
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMultiMapRemoveCrash$")
+	cmd.Env = append(os.Environ(), "PHASH_MULTIMAP_CRASH_FILE="+tempFile)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Child process failed: %v\n%s", err, out)
+	}
+	if _, err := os.Stat(tempFile + ".wal"); err != nil {
+		t.Fatalf("Expected a batch log after the crash: %v", err)
+	}
+
+	m, err := phash.OpenMultiMap(tempFile, 8, 8, &phash.Options{Hasher: walHasher{}})
+	if err != nil {
+		t.Fatalf("Failed to reopen multimap: %v", err)
+	}
+	defer m.Close()
+	var got []string
+	for it := m.GetAll(key); it.Next(); {
+		got = append(got, string(it.Value()))
+	}
+	sort.Strings(got)
+	if m.Count(key) != 2 || fmt.Sprint(got) != "[value-02 value-03]" {
+		t.Fatalf("After the crash Count() = %d, values %v", m.Count(key), got)
+	}
+}
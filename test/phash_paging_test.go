@@ -0,0 +1,70 @@
+package phash_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/theflywheel/phash"
+)
+
+func TestPagingOptions(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "paging_test.phash")
+
+	var progress []phash.WarmupProgress
+	opts := &phash.Options{
+		Advice:    phash.AdviceRandom,
+		HugePages: true,
+		Prefault:  true,
+		Lock:      runtime.GOOS == "linux",
+		OnWarmupProgress: func(p phash.WarmupProgress) {
+			progress = append(progress, p)
+		},
+	}
+	ph, err := phash.OpenWithOptions(tempFile, 8, 8, opts)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+
+	// The options apply again to the table each resize maps
+	key := make([]byte, 8)
+	for i := 0; i < 5000; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if err := ph.Put(key, key); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+
+	if err := ph.Warmup(context.Background()); err != nil {
+		t.Fatalf("Warmup failed: %v", err)
+	}
+	if len(progress) == 0 {
+		t.Fatal("Warmup reported no progress")
+	}
+	last := progress[len(progress)-1]
+	if last.Done != last.Total || last.Total == 0 {
+		t.Fatalf("Warmup ended at %+v", last)
+	}
+	for i := 1; i < len(progress); i++ {
+		if progress[i].Done <= progress[i-1].Done {
+			t.Fatalf("Warmup progress went backwards: %+v", progress)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ph.Warmup(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Warmup with a cancelled context returned %v", err)
+	}
+
+	for i := 0; i < 5000; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if _, found := ph.Get(key); !found {
+			t.Fatalf("Key %d not found", i)
+		}
+	}
+}
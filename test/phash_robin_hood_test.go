@@ -0,0 +1,99 @@
+package phash_test
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/theflywheel/phash"
+)
+
+func TestRobinHood(t *testing.T) {
+	tempFile := "robin_hood_test.phash"
+	defer os.Remove(tempFile)
+
+	keySize := uint32(8)
+	valueSize := uint32(8)
+	opts := &phash.Options{Layout: phash.LayoutRobinHood, HashFunc: phash.HashXXH64}
+
+	ph, err := phash.OpenWithOptions(tempFile, keySize, valueSize, opts)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+
+	// 0.9 of the initial 1024 slots, so no resize yet
+	numEntries := uint64(920)
+	key := make([]byte, keySize)
+	value := make([]byte, valueSize)
+	for i := uint64(0); i < numEntries; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		binary.BigEndian.PutUint64(value, i*10)
+		if err := ph.Put(key, value); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+
+	for i := uint64(0); i < numEntries; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		got, found := ph.Get(key)
+		if !found {
+			t.Fatalf("Key %d not found", i)
+		}
+		if binary.BigEndian.Uint64(got) != i*10 {
+			t.Fatalf("Value mismatch for key %d", i)
+		}
+	}
+
+	// Misses terminate early but must still be misses
+	for i := numEntries; i < numEntries+1000; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		if _, found := ph.Get(key); found {
+			t.Fatalf("Unexpected hit for absent key %d", i)
+		}
+	}
+
+	// Backward-shift deletion must keep every other key reachable
+	for i := uint64(0); i < numEntries; i += 3 {
+		binary.BigEndian.PutUint64(key, i)
+		if !ph.Delete(key) {
+			t.Fatalf("Failed to delete key %d", i)
+		}
+	}
+	for i := uint64(0); i < numEntries; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		_, found := ph.Get(key)
+		if found != (i%3 != 0) {
+			t.Fatalf("Key %d: expected found=%v after deletes", i, i%3 != 0)
+		}
+	}
+
+	// Grow well past the initial capacity
+	for i := numEntries; i < 5000; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		binary.BigEndian.PutUint64(value, i*10)
+		if err := ph.Put(key, value); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+	if err := ph.Close(); err != nil {
+		t.Fatalf("Failed to close hash: %v", err)
+	}
+
+	ph, err = phash.Open(tempFile, keySize, valueSize)
+	if err != nil {
+		t.Fatalf("Failed to reopen hash: %v", err)
+	}
+	defer ph.Close()
+
+	for i := uint64(0); i < 5000; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		got, found := ph.Get(key)
+		shouldExist := i >= numEntries || i%3 != 0
+		if found != shouldExist {
+			t.Fatalf("Key %d: expected found=%v after reopen", i, shouldExist)
+		}
+		if found && binary.BigEndian.Uint64(got) != i*10 {
+			t.Fatalf("Value mismatch for key %d after reopen", i)
+		}
+	}
+}
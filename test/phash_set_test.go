@@ -0,0 +1,136 @@
+package phash_test
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	"github.com/theflywheel/phash"
+)
+
+func TestSet(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "set_test.phset")
+
+	s, err := phash.OpenSet(tempFile, 8, &phash.Options{HashFunc: phash.HashXXH64})
+	if err != nil {
+		t.Fatalf("Failed to open set: %v", err)
+	}
+
+	// Enough keys to grow several times
+	numKeys := 20000
+	key := make([]byte, 8)
+	for i := 0; i < numKeys; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		added, err := s.Add(key)
+		if err != nil || !added {
+			t.Fatalf("Add(%d) = %v, %v", i, added, err)
+		}
+	}
+	binary.BigEndian.PutUint64(key, 7)
+	if added, err := s.Add(key); err != nil || added {
+		t.Fatalf("Second Add(7) = %v, %v", added, err)
+	}
+
+	// Remove every third key; backward shifts must keep the rest reachable
+	for i := 0; i < numKeys; i += 3 {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if !s.Remove(key) {
+			t.Fatalf("Failed to remove key %d", i)
+		}
+	}
+	if s.Remove(key) {
+		t.Fatalf("Removed key %d twice", binary.BigEndian.Uint64(key))
+	}
+
+	check := func(s *phash.PersistentSet, stage string) {
+		for i := 0; i < numKeys; i++ {
+			binary.BigEndian.PutUint64(key, uint64(i))
+			if s.Contains(key) != (i%3 != 0) {
+				t.Fatalf("Contains(%d) = %v %s", i, s.Contains(key), stage)
+			}
+		}
+		if s.Len() != numKeys-(numKeys+2)/3 {
+			t.Fatalf("Len() = %d %s", s.Len(), stage)
+		}
+	}
+	check(s, "after remove")
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Failed to close set: %v", err)
+	}
+	if _, err := phash.OpenSet(tempFile, 4, nil); err == nil {
+		t.Fatalf("Expected an error for the wrong key size")
+	}
+	s, err = phash.OpenSet(tempFile, 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen set: %v", err)
+	}
+	defer s.Close()
+	check(s, "after reopen")
+
+	seen := make(map[uint64]bool)
+	if err := s.ForEach(func(k []byte) bool {
+		seen[binary.BigEndian.Uint64(k)] = true
+		return true
+	}); err != nil {
+		t.Fatalf("ForEach failed: %v", err)
+	}
+	if len(seen) != s.Len() {
+		t.Fatalf("ForEach saw %d keys, expected %d", len(seen), s.Len())
+	}
+}
+
+func TestSetUnionIntersect(t *testing.T) {
+	dir := t.TempDir()
+
+	open := func(name string, from, to int) *phash.PersistentSet {
+		s, err := phash.OpenSet(filepath.Join(dir, name), 8, nil)
+		if err != nil {
+			t.Fatalf("Failed to open set %s: %v", name, err)
+		}
+		key := make([]byte, 8)
+		for i := from; i < to; i++ {
+			binary.BigEndian.PutUint64(key, uint64(i))
+			if _, err := s.Add(key); err != nil {
+				t.Fatalf("Failed to add %d to %s: %v", i, name, err)
+			}
+		}
+		return s
+	}
+	a := open("a.phset", 0, 3000)
+	defer a.Close()
+	b := open("b.phset", 2000, 5000)
+	defer b.Close()
+	c := open("c.phset", 0, 3000)
+	defer c.Close()
+
+	if err := a.Union(b); err != nil {
+		t.Fatalf("Union failed: %v", err)
+	}
+	if err := c.Intersect(b); err != nil {
+		t.Fatalf("Intersect failed: %v", err)
+	}
+
+	key := make([]byte, 8)
+	for i := 0; i < 6000; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if a.Contains(key) != (i < 5000) {
+			t.Fatalf("Union: Contains(%d) = %v", i, a.Contains(key))
+		}
+		if c.Contains(key) != (i >= 2000 && i < 3000) {
+			t.Fatalf("Intersect: Contains(%d) = %v", i, c.Contains(key))
+		}
+	}
+	if a.Len() != 5000 || c.Len() != 1000 || b.Len() != 3000 {
+		t.Fatalf("Len() = %d, %d, %d", a.Len(), b.Len(), c.Len())
+	}
+
+	small, err := phash.OpenSet(filepath.Join(dir, "small.phset"), 4, nil)
+	if err != nil {
+		t.Fatalf("Failed to open set: %v", err)
+	}
+	defer small.Close()
+	if err := a.Union(small); err == nil {
+		t.Fatalf("Expected an error for sets with different key sizes")
+	}
+}
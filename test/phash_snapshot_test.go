@@ -0,0 +1,159 @@
+package phash_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"testing"
+
+	"github.com/theflywheel/phash"
+)
+
+func TestSnapshot(t *testing.T) {
+	for _, opts := range []*phash.Options{
+		nil,
+		{IncrementalResize: true, Layout: phash.LayoutSwiss},
+		{ValueLog: true, VarKeys: true},
+	} {
+		t.Run(fmt.Sprintf("%+v", opts), func(t *testing.T) {
+			testSnapshot(t, opts)
+		})
+	}
+}
+
+func testSnapshot(t *testing.T, opts *phash.Options) {
+	tempFile := filepath.Join(t.TempDir(), "snapshot_test.phash")
+
+	ph, err := phash.OpenWithOptions(tempFile, 8, 8, opts)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+
+	numEntries := 500
+	key := make([]byte, 8)
+	value := func(i, round int) []byte {
+		return binary.BigEndian.AppendUint64(nil, uint64(i*10+round))
+	}
+	for i := 0; i < numEntries; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if err := ph.Put(key, value(i, 0)); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+
+	snap, err := ph.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	// Overwrite, delete and grow well past a resize
+	for i := 0; i < 4*numEntries; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if err := ph.Put(key, value(i, 1)); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+	for i := 0; i < numEntries; i += 2 {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		ph.Delete(key)
+	}
+	if opts != nil && opts.ValueLog {
+		if err := ph.CompactValueLog(); err != nil {
+			t.Fatalf("CompactValueLog failed: %v", err)
+		}
+	}
+
+	for i := 0; i < 4*numEntries; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		got, found := snap.Get(key)
+		if found != (i < numEntries) {
+			t.Fatalf("Snapshot key %d found=%v", i, found)
+		}
+		if found && !bytes.Equal(got, value(i, 0)) {
+			t.Fatalf("Snapshot key %d has a later value", i)
+		}
+	}
+	if snap.Len() != numEntries {
+		t.Fatalf("Snapshot Len() = %d, expected %d", snap.Len(), numEntries)
+	}
+
+	seen := 0
+	err = snap.ForEach(func(k, v []byte) bool {
+		if !bytes.Equal(v, value(int(binary.BigEndian.Uint64(k)), 0)) {
+			t.Fatalf("Snapshot ForEach key %x has a later value", k)
+		}
+		seen++
+		return true
+	})
+	if err != nil || seen != numEntries {
+		t.Fatalf("Snapshot ForEach visited %d entries, err %v", seen, err)
+	}
+
+	if err := snap.Release(); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if _, found := snap.Get(key); found {
+		t.Fatalf("Get succeeded on a released snapshot")
+	}
+	if err := snap.ForEach(func(k, v []byte) bool { return true }); err == nil {
+		t.Fatalf("ForEach succeeded on a released snapshot")
+	}
+
+	// The live hash is unaffected
+	if ph.Len() != 4*numEntries-numEntries/2 {
+		t.Fatalf("Len() = %d after snapshot", ph.Len())
+	}
+}
+
+// Get on a cache sets reference bits, which a snapshot's concurrent readers
+// must not do. Run with -race.
+func TestSnapshotOfCache(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "snapshot_cache_test.phash")
+
+	ph, err := phash.OpenWithOptions(tempFile, 8, 8, &phash.Options{CacheCapacity: 256})
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+
+	key := make([]byte, 8)
+	for i := uint64(0); i < 256; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		if err := ph.Put(key, key); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+	snap, err := ph.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	defer snap.Release()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The snapshot is mapped read-only, so a write faults
+			debug.SetPanicOnFault(true)
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("Snapshot Get wrote to the snapshot: %v", r)
+				}
+			}()
+			key := make([]byte, 8)
+			for i := uint64(0); i < 256; i++ {
+				binary.BigEndian.PutUint64(key, i)
+				if got, found := snap.Get(key); !found || !bytes.Equal(got, key) {
+					t.Errorf("Snapshot key %d = %x, %v", i, got, found)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,147 @@
+package phash_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/theflywheel/phash"
+)
+
+func TestTTL(t *testing.T) {
+	for _, layout := range []phash.Layout{phash.LayoutLinear, phash.LayoutRobinHood, phash.LayoutSwiss, phash.LayoutCuckoo} {
+		t.Run(fmt.Sprintf("layout%d", layout), func(t *testing.T) {
+			testTTL(t, &phash.Options{TTL: true, Layout: layout, ReapInterval: -1})
+		})
+	}
+	t.Run("ValueLog", func(t *testing.T) {
+		testTTL(t, &phash.Options{TTL: true, ValueLog: true, ReapInterval: -1})
+	})
+}
+
+func testTTL(t *testing.T, opts *phash.Options) {
+	tempFile := filepath.Join(t.TempDir(), "ttl_test.phash")
+
+	ph, err := phash.OpenWithOptions(tempFile, 8, 8, opts)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+
+	// Even keys expire quickly, odd ones never
+	numEntries := 2000
+	key := make([]byte, 8)
+	for i := 0; i < numEntries; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if i%2 == 0 {
+			err = ph.PutWithTTL(key, key, 100*time.Millisecond)
+		} else {
+			err = ph.Put(key, key)
+		}
+		if err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+	binary.BigEndian.PutUint64(key, 0)
+	if _, found := ph.Get(key); !found {
+		t.Fatalf("Key with a TTL missing before expiry")
+	}
+
+	// Expiry times survive a reopen
+	if err := ph.Close(); err != nil {
+		t.Fatalf("Failed to close hash: %v", err)
+	}
+	ph, err = phash.OpenWithOptions(tempFile, 8, 8, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen hash: %v", err)
+	}
+	defer ph.Close()
+
+	time.Sleep(150 * time.Millisecond)
+
+	for i := 0; i < numEntries; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if _, found := ph.Get(key); found != (i%2 == 1) {
+			t.Fatalf("Key %d found=%v after expiry", i, found)
+		}
+	}
+	seen := 0
+	ph.ForEach(func(k, v []byte) bool {
+		seen++
+		return true
+	})
+	if seen != numEntries/2 {
+		t.Fatalf("ForEach visited %d entries, expected %d", seen, numEntries/2)
+	}
+
+	// Counting from an expired entry starts over and drops the expiry
+	binary.BigEndian.PutUint64(key, 0)
+	if !opts.ValueLog {
+		if n, err := ph.Add(key, 3); err != nil || n != 3 {
+			t.Fatalf("Add on an expired key = %d, %v, expected 3", n, err)
+		}
+	} else {
+		if err := ph.Put(key, key); err != nil {
+			t.Fatalf("Failed to overwrite expired key: %v", err)
+		}
+	}
+
+	freed, err := ph.ReapExpired()
+	if err != nil {
+		t.Fatalf("ReapExpired failed: %v", err)
+	}
+	if freed != numEntries/2-1 {
+		t.Fatalf("ReapExpired freed %d slots, expected %d", freed, numEntries/2-1)
+	}
+	if ph.Len() != numEntries/2+1 {
+		t.Fatalf("Len() = %d after reaping, expected %d", ph.Len(), numEntries/2+1)
+	}
+	for i := 1; i < numEntries; i += 2 {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if _, found := ph.Get(key); !found {
+			t.Fatalf("Permanent key %d lost while reaping", i)
+		}
+	}
+}
+
+func TestTTLReaper(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "ttl_reaper_test.phash")
+
+	opts := &phash.Options{TTL: true, ReapInterval: 10 * time.Millisecond, ReapBatch: 64}
+	ph, err := phash.OpenWithOptions(tempFile, 8, 8, opts)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+
+	key := make([]byte, 8)
+	for i := 0; i < 500; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if err := ph.PutWithTTL(key, key, 20*time.Millisecond); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ph.Len() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Reaper left %d expired entries", ph.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTTLNeedsOption(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "ttl_option_test.phash")
+
+	ph, err := phash.Open(tempFile, 8, 8)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+
+	if err := ph.PutWithTTL([]byte("key00001"), []byte("value001"), time.Minute); err == nil {
+		t.Fatalf("Expected an error from PutWithTTL without Options.TTL")
+	}
+}
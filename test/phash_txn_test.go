@@ -0,0 +1,176 @@
+package phash_test
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/theflywheel/phash"
+)
+
+func TestTxn(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "txn_test.phash")
+
+	ph, err := phash.Open(tempFile, 8, 8)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+
+	a, b := []byte("accountA"), []byte("accountB")
+	amount := func(n uint64) []byte { return binary.BigEndian.AppendUint64(nil, n) }
+	ph.Put(a, amount(100))
+
+	// Writes are invisible outside the transaction until Commit
+	txn := ph.Begin()
+	if err := txn.Put(b, amount(1)); err != nil {
+		t.Fatalf("Txn Put failed: %v", err)
+	}
+	if err := txn.Delete(a); err != nil {
+		t.Fatalf("Txn Delete failed: %v", err)
+	}
+	if _, found := txn.Get(a); found {
+		t.Fatalf("Txn does not see its own delete")
+	}
+	if val, found := txn.Get(b); !found || binary.BigEndian.Uint64(val) != 1 {
+		t.Fatalf("Txn does not see its own put")
+	}
+	if _, found := ph.Get(b); found {
+		t.Fatalf("Uncommitted put is visible")
+	}
+	txn.Rollback()
+	if err := txn.Commit(); err != phash.ErrTxnDone {
+		t.Fatalf("Commit after Rollback = %v, expected ErrTxnDone", err)
+	}
+	if _, found := ph.Get(a); !found {
+		t.Fatalf("Rolled back delete was applied")
+	}
+
+	// A value read by the transaction changes before it commits
+	txn = ph.Begin()
+	txn.Get(a)
+	txn.Put(b, amount(50))
+	ph.Put(a, amount(70))
+	if err := txn.Commit(); err != phash.ErrConflict {
+		t.Fatalf("Commit = %v, expected ErrConflict", err)
+	}
+	if _, found := ph.Get(b); found {
+		t.Fatalf("Conflicting transaction was applied")
+	}
+
+	if err := ph.Begin().Put([]byte("short"), amount(1)); err == nil {
+		t.Fatalf("Expected an error for a bad key size")
+	}
+}
+
+func TestTxnTransfers(t *testing.T) {
+	dir := t.TempDir()
+
+	// Two hashes, so commits lock both and must agree on the order
+	left, err := phash.Open(filepath.Join(dir, "left.phash"), 8, 8)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer left.Close()
+	right, err := phash.Open(filepath.Join(dir, "right.phash"), 8, 8)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer right.Close()
+
+	numAccounts := 20
+	key := func(i int) []byte { return binary.BigEndian.AppendUint64(nil, uint64(i)) }
+	for i := 0; i < numAccounts; i++ {
+		left.Put(key(i), binary.BigEndian.AppendUint64(nil, 1000))
+		right.Put(key(i), binary.BigEndian.AppendUint64(nil, 1000))
+	}
+
+	// Move units between accounts in both directions, retrying conflicts.
+	// The total is conserved only if every commit is atomic and isolated.
+	transfer := func(from, to *phash.PersistentHash, fromKey, toKey []byte) {
+		for {
+			txn := from.Begin()
+			dst := txn.With(to)
+			src, _ := txn.Get(fromKey)
+			cur, _ := dst.Get(toKey)
+			txn.Put(fromKey, binary.BigEndian.AppendUint64(nil, binary.BigEndian.Uint64(src)-1))
+			dst.Put(toKey, binary.BigEndian.AppendUint64(nil, binary.BigEndian.Uint64(cur)+1))
+
+			err := txn.Commit()
+			if err == nil {
+				return
+			}
+			if err != phash.ErrConflict {
+				t.Errorf("Commit failed: %v", err)
+				return
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				from, to := left, right
+				if (i+w)%2 == 0 {
+					from, to = right, left
+				}
+				transfer(from, to, key((i*7+w)%numAccounts), key((i*3+w)%numAccounts))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	total := uint64(0)
+	for _, ph := range []*phash.PersistentHash{left, right} {
+		ph.ForEach(func(_, value []byte) bool {
+			total += binary.BigEndian.Uint64(value)
+			return true
+		})
+	}
+	if total != uint64(2*numAccounts*1000) {
+		t.Fatalf("Total balance %d, expected %d", total, 2*numAccounts*1000)
+	}
+}
+
+func TestTxnDuringCompaction(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "txn_compaction_test.phash")
+
+	ph, err := phash.OpenWithOptions(tempFile, 8, 0, &phash.Options{ValueLog: true})
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+
+	// Buffering writes must not race with the value log being swapped
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := ph.CompactValueLog(); err != nil {
+				t.Errorf("Compaction failed: %v", err)
+				return
+			}
+		}
+	}()
+
+	key := make([]byte, 8)
+	for i := uint64(0); i < 200; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		txn := ph.Begin()
+		if err := txn.Put(key, []byte("value")); err != nil {
+			t.Fatalf("Txn Put failed: %v", err)
+		}
+		if err := txn.Commit(); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+	}
+	wg.Wait()
+	if ph.Len() != 200 {
+		t.Fatalf("Len() = %d, expected 200", ph.Len())
+	}
+}
@@ -0,0 +1,203 @@
+package phash_test
+
+import (
+	"bytes"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/theflywheel/phash"
+)
+
+type point struct {
+	X, Y  int32
+	Label [6]byte
+	Valid bool
+}
+
+func TestTypedMap(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "typed_test.phash")
+
+	m, err := phash.OpenTyped[int16, float64](tempFile, phash.IntCodec[int16]{}, phash.FloatCodec[float64]{}, nil)
+	if err != nil {
+		t.Fatalf("Failed to open typed map: %v", err)
+	}
+
+	for i := -1000; i < 1000; i++ {
+		if err := m.Put(int16(i), float64(i)/3); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+	if !m.Delete(-5) {
+		t.Fatalf("Failed to delete key -5")
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("Failed to close typed map: %v", err)
+	}
+
+	m, err = phash.OpenTyped[int16, float64](tempFile, phash.IntCodec[int16]{}, phash.FloatCodec[float64]{}, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen typed map: %v", err)
+	}
+	defer m.Close()
+
+	for i := -1000; i < 1000; i++ {
+		got, found := m.Get(int16(i))
+		if i == -5 {
+			if found {
+				t.Fatalf("Deleted key -5 found")
+			}
+			continue
+		}
+		if !found || got != float64(i)/3 {
+			t.Fatalf("Key %d: got %v, %v", i, got, found)
+		}
+	}
+	if m.Len() != 1999 {
+		t.Fatalf("Len() = %d, expected 1999", m.Len())
+	}
+
+	sum := 0
+	err = m.ForEach(func(key int16, value float64) bool {
+		if math.Abs(value*3-float64(key)) > 1e-9 {
+			t.Fatalf("ForEach: key %d has value %v", key, value)
+		}
+		sum += int(key)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("ForEach failed: %v", err)
+	}
+	if sum != 5-1000 {
+		t.Fatalf("ForEach key sum = %d, expected %d", sum, 5-1000)
+	}
+}
+
+func TestTypedMapCodecs(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := phash.OpenTyped[phash.UUID, point](filepath.Join(dir, "uuid.phash"), phash.UUIDCodec{}, phash.StructCodec[point]{}, nil)
+	if err != nil {
+		t.Fatalf("Failed to open typed map: %v", err)
+	}
+	defer m.Close()
+
+	id, err := phash.ParseUUID("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	if err != nil {
+		t.Fatalf("Failed to parse UUID: %v", err)
+	}
+	if id.String() != "6ba7b810-9dad-11d1-80b4-00c04fd430c8" {
+		t.Fatalf("UUID round trip gave %s", id)
+	}
+	want := point{X: -7, Y: 1 << 20, Label: [6]byte{'o', 'r', 'i', 'g', 'i', 'n'}, Valid: true}
+	if err := m.Put(id, want); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if got, found := m.Get(id); !found || got != want {
+		t.Fatalf("Got %+v, %v, expected %+v", got, found, want)
+	}
+
+	digests, err := phash.OpenTyped[[32]byte, uint64](filepath.Join(dir, "digests.phash"), phash.ArrayCodec[[32]byte]{}, phash.IntCodec[uint64]{}, nil)
+	if err != nil {
+		t.Fatalf("Failed to open typed map: %v", err)
+	}
+	defer digests.Close()
+
+	var digest [32]byte
+	digest[0], digest[31] = 0xAB, 0xCD
+	if err := digests.Put(digest, math.MaxUint64); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if got, found := digests.Get(digest); !found || got != math.MaxUint64 {
+		t.Fatalf("Got %d, %v", got, found)
+	}
+}
+
+func TestStructCodec(t *testing.T) {
+	var c phash.StructCodec[point]
+	want := point{X: -7, Y: 1 << 20, Label: [6]byte{'o', 'r', 'i', 'g', 'i', 'n'}, Valid: true}
+
+	// The whole of dst is overwritten, whatever it held
+	dst := bytes.Repeat([]byte{0xFF}, c.Size())
+	c.Encode(dst, want)
+	if got := c.Decode(dst); got != want {
+		t.Fatalf("Decode(Encode(%+v)) = %+v", want, got)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Expected Encode to panic on a short destination")
+			}
+		}()
+		c.Encode(make([]byte, c.Size()-1), want)
+	}()
+}
+
+func TestTypedMapGeometryMismatch(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "mismatch.phash")
+
+	m, err := phash.OpenTyped[uint64, uint64](tempFile, phash.IntCodec[uint64]{}, phash.IntCodec[uint64]{}, nil)
+	if err != nil {
+		t.Fatalf("Failed to open typed map: %v", err)
+	}
+	m.Close()
+
+	if _, err := phash.OpenTyped[uint32, uint64](tempFile, phash.IntCodec[uint32]{}, phash.IntCodec[uint64]{}, nil); err == nil {
+		t.Fatalf("Expected an error opening 8-byte keys with a 4-byte key codec")
+	}
+	if _, err := phash.OpenTyped[uint64, string](tempFile, phash.IntCodec[uint64]{}, phash.StructCodec[string]{}, nil); err == nil {
+		t.Fatalf("Expected an error for a codec with no fixed size")
+	}
+}
+
+func TestTypedMapEncrypted(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "typed_encrypted.phash")
+
+	opts := &phash.Options{Encryption: phash.StaticKey("typed map master key")}
+	m, err := phash.OpenTyped[uint64, uint64](tempFile, phash.IntCodec[uint64]{}, phash.IntCodec[uint64]{}, opts)
+	if err != nil {
+		t.Fatalf("Failed to open typed map: %v", err)
+	}
+	for i := uint64(0); i < 500; i++ {
+		if err := m.Put(i, i*i); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+	if !m.Delete(7) {
+		t.Fatalf("Failed to delete key 7")
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("Failed to close typed map: %v", err)
+	}
+
+	m, err = phash.OpenTyped[uint64, uint64](tempFile, phash.IntCodec[uint64]{}, phash.IntCodec[uint64]{}, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen typed map: %v", err)
+	}
+	defer m.Close()
+
+	for i := uint64(0); i < 500; i++ {
+		got, found := m.Get(i)
+		if i == 7 {
+			if found {
+				t.Fatalf("Deleted key 7 found")
+			}
+			continue
+		}
+		if !found || got != i*i {
+			t.Fatalf("Key %d: got %d, %v", i, got, found)
+		}
+	}
+	n := 0
+	m.ForEach(func(key, value uint64) bool {
+		if value != key*key {
+			t.Errorf("ForEach gave %d for key %d", value, key)
+		}
+		n++
+		return true
+	})
+	if n != 499 {
+		t.Fatalf("ForEach visited %d entries, expected 499", n)
+	}
+}
@@ -0,0 +1,124 @@
+package phash_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/theflywheel/phash"
+)
+
+func TestReadModifyWrite(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "rmw_test.phash")
+
+	ph, err := phash.Open(tempFile, 8, 8)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+
+	key := []byte("key00001")
+	one := []byte("value001")
+	two := []byte("value002")
+
+	if stored, err := ph.PutIfAbsent(key, one); err != nil || !stored {
+		t.Fatalf("PutIfAbsent on a new key: stored=%v err=%v", stored, err)
+	}
+	if stored, err := ph.PutIfAbsent(key, two); err != nil || stored {
+		t.Fatalf("PutIfAbsent on an existing key: stored=%v err=%v", stored, err)
+	}
+
+	if swapped, err := ph.CompareAndSwap(key, two, one); err != nil || swapped {
+		t.Fatalf("CompareAndSwap with a stale old value: swapped=%v err=%v", swapped, err)
+	}
+	if swapped, err := ph.CompareAndSwap(key, one, two); err != nil || !swapped {
+		t.Fatalf("CompareAndSwap with the current value: swapped=%v err=%v", swapped, err)
+	}
+	if swapped, _ := ph.CompareAndSwap([]byte("missing!"), nil, one); swapped {
+		t.Fatalf("CompareAndSwap swapped a missing key")
+	}
+	if val, _ := ph.Get(key); !bytes.Equal(val, two) {
+		t.Fatalf("Got %q after CompareAndSwap, expected %q", val, two)
+	}
+
+	actual, loaded, err := ph.GetOrPut(key, one)
+	if err != nil || !loaded || !bytes.Equal(actual, two) {
+		t.Fatalf("GetOrPut on an existing key: %q, %v, %v", actual, loaded, err)
+	}
+	actual, loaded, err = ph.GetOrPut([]byte("key00002"), one)
+	if err != nil || loaded || !bytes.Equal(actual, one) {
+		t.Fatalf("GetOrPut on a new key: %q, %v, %v", actual, loaded, err)
+	}
+
+	err = ph.Update(key, func(old []byte, exists bool) ([]byte, bool) {
+		return []byte("wrong"), true
+	})
+	if err == nil {
+		t.Fatalf("Expected an error for a wrong-sized value from Update")
+	}
+}
+
+func TestUpdateConcurrent(t *testing.T) {
+	for _, opts := range []*phash.Options{
+		nil,
+		{IncrementalResize: true},
+		{Layout: phash.LayoutCuckoo},
+		{ValueLog: true},
+		{VarKeys: true},
+	} {
+		t.Run(fmt.Sprintf("%+v", opts), func(t *testing.T) {
+			tempFile := filepath.Join(t.TempDir(), "update_test.phash")
+
+			ph, err := phash.OpenWithOptions(tempFile, 8, 8, opts)
+			if err != nil {
+				t.Fatalf("Failed to open hash: %v", err)
+			}
+			defer ph.Close()
+
+			// Every goroutine increments every counter; lost updates would
+			// show up as short counts. Enough keys to resize underneath.
+			numKeys, workers, rounds := 1000, 4, 5
+			incr := func(old []byte, exists bool) ([]byte, bool) {
+				var n uint64
+				if exists {
+					n = binary.BigEndian.Uint64(old)
+				}
+				return binary.BigEndian.AppendUint64(nil, n+1), true
+			}
+
+			var wg sync.WaitGroup
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					key := make([]byte, 8)
+					for r := 0; r < rounds; r++ {
+						for i := 0; i < numKeys; i++ {
+							binary.BigEndian.PutUint64(key, uint64(i))
+							if err := ph.Update(key, incr); err != nil {
+								t.Errorf("Update failed for key %d: %v", i, err)
+								return
+							}
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			key := make([]byte, 8)
+			for i := 0; i < numKeys; i++ {
+				binary.BigEndian.PutUint64(key, uint64(i))
+				val, found := ph.Get(key)
+				if !found || binary.BigEndian.Uint64(val) != uint64(workers*rounds) {
+					t.Fatalf("Counter %d = %v (found=%v), expected %d", i, val, found, workers*rounds)
+				}
+			}
+			if ph.Len() != numKeys {
+				t.Fatalf("Len() = %d, expected %d", ph.Len(), numKeys)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package phash_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/theflywheel/phash"
+)
+
+func TestValueLog(t *testing.T) {
+	dir := t.TempDir()
+	tempFile := filepath.Join(dir, "value_log_test.phash")
+
+	keySize := uint32(8)
+	opts := &phash.Options{ValueLog: true}
+
+	ph, err := phash.OpenWithOptions(tempFile, keySize, 0, opts)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+
+	makeValue := func(i, round int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("{\"id\":%d,\"round\":%d}", i, round)), i%7+1)
+	}
+
+	// Enough keys to resize, with values of many different lengths
+	numEntries := 2000
+	key := make([]byte, keySize)
+	for i := 0; i < numEntries; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if err := ph.Put(key, makeValue(i, 0)); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+
+	// Overwrite half and delete a tenth, leaving garbage in the log
+	for i := 0; i < numEntries; i += 2 {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if err := ph.Put(key, makeValue(i, 1)); err != nil {
+			t.Fatalf("Failed to overwrite key %d: %v", i, err)
+		}
+	}
+	for i := 1; i < numEntries; i += 10 {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if !ph.Delete(key) {
+			t.Fatalf("Failed to delete key %d", i)
+		}
+	}
+
+	check := func(stage string) {
+		for i := 0; i < numEntries; i++ {
+			binary.BigEndian.PutUint64(key, uint64(i))
+			got, found := ph.Get(key)
+			if i%10 == 1 {
+				if found {
+					t.Fatalf("Deleted key %d found %s", i, stage)
+				}
+				continue
+			}
+			round := 0
+			if i%2 == 0 {
+				round = 1
+			}
+			expected := makeValue(i, round)
+			if !found || !bytes.Equal(got, expected) {
+				t.Fatalf("Key %d %s: expected %q, got %q (found=%v)", i, stage, expected, got, found)
+			}
+		}
+	}
+	check("before compaction")
+
+	total, live := ph.ValueLogSize()
+	if live >= total {
+		t.Fatalf("Expected garbage in the log, got total=%d live=%d", total, live)
+	}
+
+	if err := ph.CompactValueLog(); err != nil {
+		t.Fatalf("Failed to compact value log: %v", err)
+	}
+	newTotal, newLive := ph.ValueLogSize()
+	if newTotal != live || newLive != live {
+		t.Errorf("Expected compacted log of %d bytes, got total=%d live=%d", live, newTotal, newLive)
+	}
+	check("after compaction")
+
+	if err := ph.Close(); err != nil {
+		t.Fatalf("Failed to close hash: %v", err)
+	}
+
+	// Only the table and the current log generation are left behind
+	logs, _ := filepath.Glob(tempFile + ".vlog.*")
+	if len(logs) != 1 || logs[0] != tempFile+".vlog.1" {
+		t.Errorf("Unexpected value log files: %v", logs)
+	}
+
+	ph, err = phash.Open(tempFile, keySize, 0)
+	if err != nil {
+		t.Fatalf("Failed to reopen hash: %v", err)
+	}
+	defer ph.Close()
+	check("after reopen")
+
+	if total, live := ph.ValueLogSize(); total != newTotal || live != newLive {
+		t.Errorf("Log sizes changed across reopen: total=%d live=%d", total, live)
+	}
+}
+
+func TestValueLogFileSize(t *testing.T) {
+	tempFile := "value_log_size_test.phash"
+	defer os.Remove(tempFile)
+	defer os.Remove(tempFile + ".vlog.0")
+
+	// Short values should not pay for the maximum size
+	ph, err := phash.OpenWithOptions(tempFile, 8, 4096, &phash.Options{ValueLog: true})
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+
+	key := make([]byte, 8)
+	for i := uint64(0); i < 100; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		if err := ph.Put(key, []byte("short")); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+
+	fi, err := os.Stat(tempFile)
+	if err != nil {
+		t.Fatalf("Failed to stat table: %v", err)
+	}
+	if fi.Size() > 64*1024 {
+		t.Errorf("Table file is %d bytes; slots should hold pointers, not values", fi.Size())
+	}
+}
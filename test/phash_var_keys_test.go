@@ -0,0 +1,234 @@
+package phash_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/theflywheel/phash"
+)
+
+func TestVarKeys(t *testing.T) {
+	for _, layout := range []phash.Layout{phash.LayoutLinear, phash.LayoutRobinHood, phash.LayoutSwiss, phash.LayoutCuckoo} {
+		for _, incremental := range []bool{false, true} {
+			t.Run(fmt.Sprintf("layout%d/incremental=%v", layout, incremental), func(t *testing.T) {
+				testVarKeys(t, &phash.Options{
+					VarKeys:           true,
+					KeyPrefix:         8,
+					Layout:            layout,
+					IncrementalResize: incremental,
+				})
+			})
+		}
+	}
+}
+
+func TestVarKeysIncrementalResize(t *testing.T) {
+	for _, layout := range []phash.Layout{phash.LayoutLinear, phash.LayoutRobinHood, phash.LayoutSwiss, phash.LayoutCuckoo} {
+		t.Run(fmt.Sprintf("layout%d", layout), func(t *testing.T) {
+			tempFile := filepath.Join(t.TempDir(), "var_keys_resize_test.phash")
+
+			// One slot per write keeps keys in the old table while they
+			// are updated
+			opts := &phash.Options{VarKeys: true, KeyPrefix: 8, Layout: layout, IncrementalResize: true, ResizeStep: 1}
+			ph, err := phash.OpenWithOptions(tempFile, 0, 8, opts)
+			if err != nil {
+				t.Fatalf("Failed to open hash: %v", err)
+			}
+
+			makeKey := func(i int) []byte {
+				return []byte(fmt.Sprintf("%s/%d", strings.Repeat("long", 4), i))
+			}
+			value := make([]byte, 8)
+			for i := 0; i < 800; i++ {
+				binary.BigEndian.PutUint64(value, uint64(i))
+				if err := ph.Put(makeKey(i), value); err != nil {
+					t.Fatalf("Failed to put key %d: %v", i, err)
+				}
+			}
+			for i := 0; i < 800; i++ {
+				binary.BigEndian.PutUint64(value, uint64(i)*10)
+				if i%2 == 0 {
+					err = ph.Put(makeKey(i), value)
+				} else {
+					err = ph.Update(makeKey(i), func([]byte, bool) ([]byte, bool) { return value, true })
+				}
+				if err != nil {
+					t.Fatalf("Failed to update key %d: %v", i, err)
+				}
+			}
+
+			check := func(when string) {
+				for i := 0; i < 800; i++ {
+					got, found := ph.Get(makeKey(i))
+					if !found || binary.BigEndian.Uint64(got) != uint64(i)*10 {
+						t.Fatalf("Key %d missing or wrong %s", i, when)
+					}
+				}
+			}
+			check("during the resize")
+			if err := ph.Close(); err != nil {
+				t.Fatalf("Failed to close hash: %v", err)
+			}
+			if ph, err = phash.OpenWithOptions(tempFile, 0, 8, opts); err != nil {
+				t.Fatalf("Failed to reopen hash: %v", err)
+			}
+			defer ph.Close()
+			check("after reopen")
+		})
+	}
+}
+
+func testVarKeys(t *testing.T, opts *phash.Options) {
+	tempFile := filepath.Join(t.TempDir(), "var_keys_test.phash")
+
+	ph, err := phash.OpenWithOptions(tempFile, 0, 8, opts)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+
+	// Short keys fit the inline prefix; long ones share a prefix and
+	// differ only past it
+	makeKey := func(i int) []byte {
+		if i%2 == 0 {
+			return []byte(fmt.Sprintf("k%d", i))
+		}
+		return []byte(fmt.Sprintf("%s/%d", strings.Repeat("long", i%5+2), i))
+	}
+
+	numEntries := 1500
+	value := make([]byte, 8)
+	for i := 0; i < numEntries; i++ {
+		binary.BigEndian.PutUint64(value, uint64(i))
+		if err := ph.Put(makeKey(i), value); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+	for i := 0; i < numEntries; i += 3 {
+		binary.BigEndian.PutUint64(value, uint64(i)*10)
+		if err := ph.Put(makeKey(i), value); err != nil {
+			t.Fatalf("Failed to overwrite key %d: %v", i, err)
+		}
+	}
+	for i := 1; i < numEntries; i += 7 {
+		if !ph.Delete(makeKey(i)) {
+			t.Fatalf("Failed to delete key %d", i)
+		}
+	}
+
+	if err := ph.Put(nil, value); err != nil {
+		t.Fatalf("Failed to put empty key: %v", err)
+	}
+	if _, found := ph.Get(nil); !found {
+		t.Fatalf("Empty key not found")
+	}
+	if !ph.Delete(nil) {
+		t.Fatalf("Failed to delete empty key")
+	}
+
+	expected := func(i int) (uint64, bool) {
+		if i%7 == 1 {
+			return 0, false
+		}
+		if i%3 == 0 {
+			return uint64(i) * 10, true
+		}
+		return uint64(i), true
+	}
+
+	check := func(stage string) {
+		want := 0
+		for i := 0; i < numEntries; i++ {
+			v, live := expected(i)
+			got, found := ph.Get(makeKey(i))
+			if found != live {
+				t.Fatalf("Key %d found=%v %s, expected %v", i, found, stage, live)
+			}
+			if live {
+				want++
+				if binary.BigEndian.Uint64(got) != v {
+					t.Fatalf("Value mismatch for key %d %s", i, stage)
+				}
+			}
+		}
+		if _, found := ph.Get([]byte(strings.Repeat("long", 3) + "/missing")); found {
+			t.Fatalf("Missing long key found %s", stage)
+		}
+		if ph.Len() != want {
+			t.Fatalf("Len() = %d %s, expected %d", ph.Len(), stage, want)
+		}
+
+		// ForEach must hand back the original keys
+		seen := make(map[string]uint64)
+		err := ph.ForEach(func(key, value []byte) bool {
+			seen[string(key)] = binary.BigEndian.Uint64(value)
+			return true
+		})
+		if err != nil {
+			t.Fatalf("ForEach failed %s: %v", stage, err)
+		}
+		if len(seen) != want {
+			t.Fatalf("ForEach visited %d keys %s, expected %d", len(seen), stage, want)
+		}
+		for i := 0; i < numEntries; i++ {
+			v, live := expected(i)
+			got, ok := seen[string(makeKey(i))]
+			if ok != live || (live && got != v) {
+				t.Fatalf("ForEach entry for key %d wrong %s", i, stage)
+			}
+		}
+	}
+
+	check("before reopen")
+
+	if err := ph.Close(); err != nil {
+		t.Fatalf("Failed to close hash: %v", err)
+	}
+	// The key size argument is ignored for an existing VarKeys file
+	ph, err = phash.OpenWithOptions(tempFile, 0, 8, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen hash: %v", err)
+	}
+	defer ph.Close()
+
+	check("after reopen")
+}
+
+func TestForEach(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "for_each_test.phash")
+
+	ph, err := phash.Open(tempFile, 8, 8)
+	if err != nil {
+		t.Fatalf("Failed to open hash: %v", err)
+	}
+	defer ph.Close()
+
+	key := make([]byte, 8)
+	for i := 0; i < 100; i++ {
+		binary.BigEndian.PutUint64(key, uint64(i))
+		if err := ph.Put(key, key); err != nil {
+			t.Fatalf("Failed to put key %d: %v", i, err)
+		}
+	}
+
+	count := 0
+	err = ph.ForEach(func(k, v []byte) bool {
+		if !bytes.Equal(k, v) {
+			t.Fatalf("Key %x has value %x", k, v)
+		}
+		count++
+		return count < 10
+	})
+	if err != nil {
+		t.Fatalf("ForEach failed: %v", err)
+	}
+	if count != 10 {
+		t.Fatalf("ForEach did not stop early: visited %d", count)
+	}
+	if ph.Len() != 100 {
+		t.Fatalf("Len() = %d, expected 100", ph.Len())
+	}
+}
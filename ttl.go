@@ -0,0 +1,177 @@
+package phash
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// In TTL mode every slot's value field ends with an expiry: the Unix time
+// in nanoseconds after which the entry is gone, or 0 for never (8 bytes).
+// Expired entries read as misses straight away; their slots are freed by
+// the reaper, or sooner by a write to the same key. The header's value
+// size includes the expiry.
+const expirySize = 8
+
+// userValueSize returns the length of the values callers store, without
+// the expiry or, for an encrypted table, the sealing. It is meaningless in
+// ValueLog mode.
+func (ph *PersistentHash) userValueSize() uint32 {
+	if ph.plainValueSize != 0 {
+		return ph.plainValueSize
+	}
+	n := ph.valueSize
+	if ph.flags&flagTTL != 0 {
+		n -= expirySize
+	}
+	if ph.crypt != nil {
+		n -= sealOverhead + ph.crypt.keySize
+	}
+	return n
+}
+
+// appendExpiry returns the slot value field for value in TTL mode, and
+// value itself otherwise.
+func (ph *PersistentHash) appendExpiry(value []byte, expiry int64) []byte {
+	if ph.flags&flagTTL == 0 {
+		return value
+	}
+	field := make([]byte, len(value), len(value)+expirySize)
+	copy(field, value)
+	return binary.BigEndian.AppendUint64(field, uint64(expiry))
+}
+
+// splitExpiry separates a slot value field into the value and its expiry.
+func (ph *PersistentHash) splitExpiry(field []byte) ([]byte, int64) {
+	if ph.flags&flagTTL == 0 {
+		return field, 0
+	}
+	n := len(field) - expirySize
+	return field[:n], int64(binary.BigEndian.Uint64(field[n:]))
+}
+
+// expired reports whether an entry with the given expiry has expired.
+func expired(expiry int64) bool {
+	return expiry != 0 && expiry <= time.Now().UnixNano()
+}
+
+// PutWithTTL is Put for an entry that expires after ttl. The table must
+// have been created with Options.TTL. A later Put of the same key without
+// a TTL makes it permanent again.
+func (ph *PersistentHash) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	if ph.flags&flagTTL == 0 {
+		return errors.New("table was not created with TTL support")
+	}
+	if ttl <= 0 {
+		return errors.New("ttl must be positive")
+	}
+
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	return ph.putLocked(key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// ReapExpired frees the slots of every expired entry now, rather than
+// waiting for the background reaper, and returns how many it freed. Any
+// resize in flight is finished first.
+func (ph *PersistentHash) ReapExpired() (int, error) {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	if ph.flags&flagTTL == 0 {
+		return 0, nil
+	}
+	if ph.grow != nil {
+		if err := ph.migrate(ph.numSlots); err != nil {
+			return 0, err
+		}
+	}
+	return ph.reapRange(0, ph.numSlots), nil
+}
+
+// startReaper runs the background reaper of a TTL table until Close.
+func (ph *PersistentHash) startReaper() {
+	if ph.flags&flagTTL == 0 || ph.opts.ReapInterval <= 0 {
+		return
+	}
+	ph.reapStop = make(chan struct{})
+	ph.reapDone = make(chan struct{})
+	go ph.reap(ph.reapStop, ph.reapDone)
+}
+
+// stopReaper stops the background reaper and waits for it to exit. It must
+// be called without the lock held, since the reaper takes it.
+func (ph *PersistentHash) stopReaper() {
+	if ph.reapStop == nil {
+		return
+	}
+	close(ph.reapStop)
+	<-ph.reapDone
+	ph.reapStop = nil
+}
+
+// reap makes a pass over the table every ReapInterval, taking the write
+// lock for ReapBatch slots at a time so writers are never held up long.
+func (ph *PersistentHash) reap(stop, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(ph.opts.ReapInterval)
+	defer ticker.Stop()
+
+	var cursor uint32
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			ph.mu.Lock()
+			// Slot indexes move under a resize; pick up after it instead
+			if ph.grow != nil || cursor >= ph.numSlots {
+				cursor = 0
+				ph.mu.Unlock()
+				break
+			}
+			end := cursor + uint32(ph.opts.ReapBatch)
+			if end > ph.numSlots || end < cursor {
+				end = ph.numSlots
+			}
+			ph.reapRange(cursor, end)
+			cursor = end
+			ph.mu.Unlock()
+		}
+	}
+}
+
+// reapRange frees expired entries in slots [from, to) of the table and
+// returns how many it freed.
+func (ph *PersistentHash) reapRange(from, to uint32) int {
+	freed := 0
+	for i := from; i < to; {
+		slotStart := ph.base + i*ph.slotSize
+		field := ph.valueField(ph.data, slotStart)
+		if _, expiry := ph.splitExpiry(field); ph.occupied(&ph.table, i) && expired(expiry) {
+			if ph.vlog != nil {
+				ph.setLogLive(ph.vlog.live - ph.loggedBytes(field))
+			}
+			ph.removeAt(&ph.table, i)
+			freed++
+
+			// Backward-shift deletion may have moved a later entry here
+			if ph.layout == LayoutRobinHood || ph.layout == LayoutLinear {
+				continue
+			}
+		}
+		i++
+	}
+	return freed
+}
@@ -0,0 +1,210 @@
+package phash
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+)
+
+// ErrConflict is returned by Txn.Commit when a value the transaction read
+// was changed by someone else before it committed.
+var ErrConflict = errors.New("transaction conflict")
+
+// ErrTxnDone is returned when a transaction is used after Commit or
+// Rollback.
+var ErrTxnDone = errors.New("transaction already committed or rolled back")
+
+// Txn is an optimistic transaction. Writes are buffered and only reach the
+// hash at Commit; reads see the transaction's own writes. Commit checks
+// that every value the transaction read is still current and, if so,
+// applies all writes while holding the write lock of every hash involved.
+// Nothing is locked before Commit.
+//
+// Conflicts are detected by comparing values, so a key changed and then
+// changed back in the meantime is not a conflict. A Txn is not safe for
+// concurrent use.
+type Txn struct {
+	ph    *PersistentHash
+	state *txnState
+}
+
+type txnState struct {
+	tables map[*PersistentHash]*txnTable
+	done   bool
+}
+
+// txnTable is a transaction's view of one hash.
+type txnTable struct {
+	reads  map[string]txnRead
+	writes map[string]batchOp
+	order  []string // keys in writes, in first-write order
+}
+
+type txnRead struct {
+	value  []byte
+	exists bool
+}
+
+// Begin starts a transaction on ph. Txn.With extends it to other hashes.
+func (ph *PersistentHash) Begin() *Txn {
+	return &Txn{
+		ph:    ph,
+		state: &txnState{tables: make(map[*PersistentHash]*txnTable)},
+	}
+}
+
+// With returns a handle to the same transaction whose Get, Put and Delete
+// act on other. Committing or rolling back either handle ends the whole
+// transaction, so a single Commit covers every hash it touched.
+func (txn *Txn) With(other *PersistentHash) *Txn {
+	return &Txn{ph: other, state: txn.state}
+}
+
+// table returns the transaction's view of txn.ph.
+func (txn *Txn) table() *txnTable {
+	tt := txn.state.tables[txn.ph]
+	if tt == nil {
+		tt = &txnTable{
+			reads:  make(map[string]txnRead),
+			writes: make(map[string]batchOp),
+		}
+		txn.state.tables[txn.ph] = tt
+	}
+	return tt
+}
+
+// Get returns the value of key as the transaction sees it: its own write
+// if it made one, otherwise the value in the hash, which Commit checks is
+// still current.
+func (txn *Txn) Get(key []byte) ([]byte, bool) {
+	if txn.state.done {
+		return nil, false
+	}
+	tt := txn.table()
+	if op, ok := tt.writes[string(key)]; ok {
+		if op.delete {
+			return nil, false
+		}
+		return append([]byte(nil), op.value...), true
+	}
+	if r, ok := tt.reads[string(key)]; ok {
+		return append([]byte(nil), r.value...), r.exists
+	}
+
+	value, exists := txn.ph.Get(key)
+	tt.reads[string(key)] = txnRead{value: value, exists: exists}
+	return append([]byte(nil), value...), exists
+}
+
+// Put buffers a write of key. The key and value are copied.
+func (txn *Txn) Put(key, value []byte) error {
+	op := batchOp{key: append([]byte(nil), key...), value: append([]byte(nil), value...)}
+	return txn.write(op)
+}
+
+// Delete buffers the removal of key.
+func (txn *Txn) Delete(key []byte) error {
+	return txn.write(batchOp{key: append([]byte(nil), key...), delete: true})
+}
+
+func (txn *Txn) write(op batchOp) error {
+	if txn.state.done {
+		return ErrTxnDone
+	}
+	// The check reads the table's format, which CompactValueLog swaps
+	txn.ph.mu.RLock()
+	err := txn.ph.checkBatchOp(op)
+	txn.ph.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	tt := txn.table()
+	if _, ok := tt.writes[string(op.key)]; !ok {
+		tt.order = append(tt.order, string(op.key))
+	}
+	tt.writes[string(op.key)] = op
+	return nil
+}
+
+// Rollback discards the transaction's writes.
+func (txn *Txn) Rollback() {
+	txn.state.done = true
+	txn.state.tables = nil
+}
+
+// Commit applies the transaction's writes if none of the values it read
+// have changed, and returns ErrConflict otherwise. The hashes involved are
+// locked in a fixed order, so concurrent commits cannot deadlock. Within
+// each hash the writes go through the same write-ahead log as Write and
+// are all-or-nothing across a crash; a crash part way through a commit
+// that spans several hashes may leave only some of them updated. So may a
+// Commit that fails while applying the writes, whose error says how far
+// it got in the hash that failed.
+func (txn *Txn) Commit() error {
+	if txn.state.done {
+		return ErrTxnDone
+	}
+	defer txn.Rollback()
+
+	hashes := make([]*PersistentHash, 0, len(txn.state.tables))
+	for ph := range txn.state.tables {
+		hashes = append(hashes, ph)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i].id < hashes[j].id })
+	for _, ph := range hashes {
+		ph.mu.Lock()
+		defer ph.mu.Unlock()
+	}
+
+	for _, ph := range hashes {
+		for key, r := range txn.state.tables[ph].reads {
+			value, exists := ph.getLocked([]byte(key))
+			if exists != r.exists || !bytes.Equal(value, r.value) {
+				return ErrConflict
+			}
+		}
+	}
+
+	// Log every hash's writes before applying any, so a failure to log
+	// leaves them all untouched
+	batches := make([]*Batch, len(hashes))
+	for i, ph := range hashes {
+		tt := txn.state.tables[ph]
+		if len(tt.order) == 0 {
+			continue
+		}
+		b := &Batch{}
+		for _, key := range tt.order {
+			op := tt.writes[key]
+			b.ops = append(b.ops, op)
+			if !op.delete {
+				b.puts++
+			}
+		}
+		if err := ph.logBatch(b); err != nil {
+			discardBatches(hashes[:i], batches)
+			return err
+		}
+		batches[i] = b
+	}
+	for i, ph := range hashes {
+		if batches[i] == nil {
+			continue
+		}
+		if err := ph.applyBatch(batches[i]); err != nil {
+			// The hashes not reached yet must not apply theirs on reopen
+			discardBatches(hashes[i+1:], batches[i+1:])
+			return err
+		}
+	}
+	return nil
+}
+
+// discardBatches drops the logged batches[i] of each hashes[i].
+func discardBatches(hashes []*PersistentHash, batches []*Batch) {
+	for i, ph := range hashes {
+		if batches[i] != nil {
+			ph.discardBatch()
+		}
+	}
+}
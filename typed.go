@@ -0,0 +1,97 @@
+package phash
+
+import (
+	"errors"
+	"fmt"
+)
+
+// TypedMap is a PersistentHash with typed keys and values, converted by a
+// pair of codecs. The key and value sizes of the file are those of the
+// codecs.
+type TypedMap[K, V any] struct {
+	ph     *PersistentHash
+	keys   Codec[K]
+	values Codec[V]
+}
+
+// OpenTyped opens or creates a typed map at filePath. An existing file must
+// have been created with the same key and value sizes. opts may be nil;
+// ValueLog and VarKeys are not supported since their slots are not the
+// codecs' size.
+func OpenTyped[K, V any](filePath string, keys Codec[K], values Codec[V], opts *Options) (*TypedMap[K, V], error) {
+	keySize, valueSize := keys.Size(), values.Size()
+	if keySize <= 0 || valueSize <= 0 {
+		return nil, errors.New("codec has no fixed size")
+	}
+	if opts != nil && (opts.ValueLog || opts.VarKeys) {
+		return nil, errors.New("typed maps need fixed-size keys and values")
+	}
+
+	ph, err := OpenWithOptions(filePath, uint32(keySize), uint32(valueSize), opts)
+	if err != nil {
+		return nil, err
+	}
+	if ph.flags&(flagValueLog|flagVarKeys) != 0 ||
+		ph.userKeySize() != uint32(keySize) || ph.userValueSize() != uint32(valueSize) {
+		ph.Close()
+		return nil, fmt.Errorf("file has %d-byte keys and %d-byte values, codecs need %d and %d",
+			ph.userKeySize(), ph.userValueSize(), keySize, valueSize)
+	}
+
+	return &TypedMap[K, V]{ph: ph, keys: keys, values: values}, nil
+}
+
+// Hash returns the underlying PersistentHash.
+func (m *TypedMap[K, V]) Hash() *PersistentHash {
+	return m.ph
+}
+
+// Close closes the underlying hash.
+func (m *TypedMap[K, V]) Close() error {
+	return m.ph.Close()
+}
+
+// Put inserts or updates the value for key.
+func (m *TypedMap[K, V]) Put(key K, value V) error {
+	return m.ph.Put(m.encodeKey(key), m.encodeValue(value))
+}
+
+// Get returns the value for key and whether it was found.
+func (m *TypedMap[K, V]) Get(key K) (V, bool) {
+	raw, found := m.ph.Get(m.encodeKey(key))
+	if !found {
+		var zero V
+		return zero, false
+	}
+	return m.values.Decode(raw), true
+}
+
+// Delete removes key and reports whether it was present.
+func (m *TypedMap[K, V]) Delete(key K) bool {
+	return m.ph.Delete(m.encodeKey(key))
+}
+
+// Len returns the number of keys in the map.
+func (m *TypedMap[K, V]) Len() int {
+	return m.ph.Len()
+}
+
+// ForEach calls fn for every entry until fn returns false. As with
+// PersistentHash.ForEach, fn must not call back into the map.
+func (m *TypedMap[K, V]) ForEach(fn func(key K, value V) bool) error {
+	return m.ph.ForEach(func(key, value []byte) bool {
+		return fn(m.keys.Decode(key), m.values.Decode(value))
+	})
+}
+
+func (m *TypedMap[K, V]) encodeKey(key K) []byte {
+	buf := make([]byte, m.ph.userKeySize())
+	m.keys.Encode(buf, key)
+	return buf
+}
+
+func (m *TypedMap[K, V]) encodeValue(value V) []byte {
+	buf := make([]byte, m.ph.userValueSize())
+	m.values.Encode(buf, value)
+	return buf
+}
@@ -0,0 +1,317 @@
+package phash
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+)
+
+// In ValueLog mode the value field of each slot is a fixed pointer into an
+// append-only companion file, so values can have any length:
+//
+//   - Offset (8 bytes): Position of the value in the log
+//   - Length (4 bytes): Length of the value
+//
+// Overwritten and deleted values stay in the log until CompactValueLog
+// rewrites it. The log is named filePath + ".vlog." + generation, and the
+// generation in the table header says which one is live, so a compaction
+// commits with the same atomic rename as a resize.
+const valuePointerSize = 12
+
+// valueLog is the open companion file of a ValueLog table.
+type valueLog struct {
+	file *os.File
+	gen  uint32
+	size int64 // append offset
+	live int64 // bytes still referenced by a slot
+
+	codec *compressor // set when values are compressed
+}
+
+// valueLogPath returns the name of the log file for generation gen.
+func (ph *PersistentHash) valueLogPath(gen uint32) string {
+	return fmt.Sprintf("%s.vlog.%d", ph.filePath, gen)
+}
+
+// openValueLog opens the log named in the header of the mapped table.
+func (ph *PersistentHash) openValueLog() error {
+	gen := binary.BigEndian.Uint32(ph.data[56:60])
+	file, err := os.OpenFile(ph.valueLogPath(gen), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open value log: %w", err)
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat value log: %w", err)
+	}
+
+	ph.vlog = &valueLog{
+		file: file,
+		gen:  gen,
+		size: fi.Size(),
+		live: int64(binary.BigEndian.Uint64(ph.data[60:68])),
+	}
+	if ph.flags&flagCompressed != 0 {
+		if dictChecksum(ph.opts.CompressDict) != binary.BigEndian.Uint32(ph.data[92:96]) {
+			file.Close()
+			return errors.New("compression dictionary does not match the file")
+		}
+		if ph.vlog.codec, err = newCompressor(&ph.opts); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// append writes value at the end of the log, compressed if the log is,
+// and returns its slot pointer.
+func (l *valueLog) append(value []byte) ([]byte, error) {
+	if l.codec != nil {
+		rec, err := l.codec.encode(value)
+		if err != nil {
+			return nil, err
+		}
+		l.codec.count(value, rec, len(rec))
+		value = rec
+	}
+	return l.appendRecord(value)
+}
+
+// appendRecord writes rec at the end of the log as it is.
+func (l *valueLog) appendRecord(rec []byte) ([]byte, error) {
+	if _, err := l.file.WriteAt(rec, l.size); err != nil {
+		return nil, fmt.Errorf("failed to append to value log: %w", err)
+	}
+
+	ptr := make([]byte, valuePointerSize)
+	binary.BigEndian.PutUint64(ptr[0:8], uint64(l.size))
+	binary.BigEndian.PutUint32(ptr[8:12], uint32(len(rec)))
+	l.size += int64(len(rec))
+	return ptr, nil
+}
+
+// read returns a copy of the value a slot pointer refers to.
+func (l *valueLog) read(ptr []byte) ([]byte, error) {
+	rec, err := l.readRecord(ptr)
+	if err != nil || l.codec == nil {
+		return rec, err
+	}
+	return l.codec.decode(rec)
+}
+
+// readRecord returns a copy of the record a slot pointer refers to.
+func (l *valueLog) readRecord(ptr []byte) ([]byte, error) {
+	off := int64(binary.BigEndian.Uint64(ptr[0:8]))
+	val := make([]byte, binary.BigEndian.Uint32(ptr[8:12]))
+	if _, err := l.file.ReadAt(val, off); err != nil {
+		return nil, fmt.Errorf("failed to read value log: %w", err)
+	}
+	return val, nil
+}
+
+// closeLogs closes whichever companion logs the table has open.
+func (ph *PersistentHash) closeLogs() error {
+	var err error
+	for _, l := range []*valueLog{ph.vlog, ph.klog} {
+		if l == nil {
+			continue
+		}
+		if cerr := l.file.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// pointerLen returns the value length recorded in a slot pointer.
+func pointerLen(ptr []byte) int64 {
+	return int64(binary.BigEndian.Uint32(ptr[8:12]))
+}
+
+// setLogLive records the live byte count in memory and in the header of
+// the table being written. During a resize that is the new table: the old
+// header must keep matching the old slots, since Open replays the resize
+// log over them.
+func (ph *PersistentHash) setLogLive(live int64) {
+	ph.vlog.live = live
+	if ph.grow != nil {
+		binary.BigEndian.PutUint64(ph.grow.next.data[60:68], uint64(live))
+		return
+	}
+	binary.BigEndian.PutUint64(ph.data[60:68], uint64(live))
+}
+
+// loggedLen returns the length of the value log record currently stored
+// for key.
+func (ph *PersistentHash) loggedLen(key []byte) int64 {
+	t, idx, found := ph.lookup(key)
+	if !found {
+		return 0
+	}
+	slotStart := t.base + idx*ph.slotSize
+	return ph.loggedBytes(ph.valueField(t.data, slotStart))
+}
+
+// loggedBytes returns how many value log bytes a slot's value field refers
+// to.
+func (ph *PersistentHash) loggedBytes(field []byte) int64 {
+	if ph.flags&flagValueLog != 0 {
+		return pointerLen(field)
+	}
+	if binary.BigEndian.Uint32(field[0:4]) != spilledValue {
+		return 0
+	}
+	return pointerLen(field[4:])
+}
+
+// checkValue reports a value Put would refuse.
+func (ph *PersistentHash) checkValue(value []byte) error {
+	if ph.flags&flagValueLog != 0 {
+		if uint64(len(value)) > math.MaxUint32 {
+			return errors.New("value too large for value log")
+		}
+		return nil
+	}
+	if uint32(len(value)) != ph.userValueSize() {
+		return errors.New("invalid key/value size")
+	}
+	return nil
+}
+
+// storeValue returns the slot's value field for value: in ValueLog mode a
+// pointer to it, appended to the log, and in a table compressed into its
+// slots its record, spilled to the log if it does not fit.
+func (ph *PersistentHash) storeValue(value []byte) ([]byte, error) {
+	if ph.flags&flagValueLog != 0 {
+		return ph.vlog.append(value)
+	}
+	return ph.compressValue(value)
+}
+
+// loadValue returns a copy of the value whose field storeValue returned.
+func (ph *PersistentHash) loadValue(field []byte) ([]byte, error) {
+	if ph.flags&flagValueLog != 0 {
+		return ph.vlog.read(field)
+	}
+	return ph.decompressValue(field)
+}
+
+// putLogged is Put for a table with a value log. A value is appended
+// before the slot is written, so a crash in between only leaves garbage
+// in the log.
+func (ph *PersistentHash) putLogged(key, value []byte, expiry int64) error {
+	if err := ph.checkValue(value); err != nil {
+		return err
+	}
+	key, err := ph.storeKey(key)
+	if err != nil {
+		return err
+	}
+
+	oldLen := ph.loggedLen(key)
+	field, err := ph.storeValue(value)
+	if err != nil {
+		return err
+	}
+	if err := ph.putWithRetry(key, ph.appendExpiry(field, expiry), 0); err != nil {
+		return err
+	}
+	ph.setLogLive(ph.vlog.live + ph.loggedBytes(field) - oldLen)
+	return nil
+}
+
+// releaseLogged accounts for key's value becoming garbage.
+func (ph *PersistentHash) releaseLogged(key []byte) {
+	if n := ph.loggedLen(key); n > 0 {
+		ph.setLogLive(ph.vlog.live - n)
+	}
+}
+
+// ValueLogSize returns the size of the value log and how many of its bytes
+// are still referenced. The difference is what CompactValueLog reclaims.
+func (ph *PersistentHash) ValueLogSize() (total, live int64) {
+	ph.mu.RLock()
+	defer ph.mu.RUnlock()
+
+	if ph.vlog == nil {
+		return 0, 0
+	}
+	return ph.vlog.size, ph.vlog.live
+}
+
+// CompactValueLog rewrites the value log with only the values still
+// referenced, reclaiming the space of overwritten and deleted ones. The
+// table is rebuilt alongside it and both switch over with the table's
+// atomic rename, so a crash leaves either the old or the new pair intact.
+// It holds the write lock for the whole pass.
+func (ph *PersistentHash) CompactValueLog() error {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	if ph.vlog == nil {
+		return errors.New("table does not use a value log")
+	}
+	if ph.grow != nil {
+		if err := ph.migrate(ph.numSlots); err != nil {
+			return err
+		}
+	}
+
+	old := ph.vlog
+	newPath := ph.valueLogPath(old.gen + 1)
+	file, err := os.OpenFile(newPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create value log: %w", err)
+	}
+	ph.vlog = &valueLog{file: file, gen: old.gen + 1, live: old.live, codec: old.codec}
+
+	fail := func(err error) error {
+		if ph.grow != nil {
+			ph.abortResize(err)
+		}
+		file.Close()
+		os.Remove(newPath)
+		ph.vlog = old
+		return err
+	}
+
+	if err := ph.beginResize(ph.numSlots); err != nil {
+		return fail(err)
+	}
+	next := &ph.grow.next
+
+	for i := uint32(0); i < ph.numSlots; i++ {
+		if !ph.occupied(&ph.table, i) {
+			continue
+		}
+		slotStart := ph.base + i*ph.slotSize
+		key := ph.data[slotStart+1 : slotStart+1+ph.keySize]
+
+		field, err := ph.moveValue(old, ph.valueField(ph.data, slotStart))
+		if err != nil {
+			return fail(err)
+		}
+		idx, _ := ph.findSlot(next, key)
+		if err := ph.insert(next, idx, key, field); err != nil {
+			return fail(fmt.Errorf("failed to place key during compaction: %w", err))
+		}
+	}
+
+	if err := file.Sync(); err != nil {
+		return fail(fmt.Errorf("failed to sync value log: %w", err))
+	}
+	// Only the new header; the old one must stay valid until the rename
+	ph.vlog.live = ph.vlog.size
+	binary.BigEndian.PutUint64(next.data[60:68], uint64(ph.vlog.live))
+	if err := ph.finishResize(); err != nil {
+		return err
+	}
+
+	old.file.Close()
+	os.Remove(ph.valueLogPath(old.gen))
+	return nil
+}
@@ -0,0 +1,156 @@
+package phash
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+)
+
+// In VarKeys mode the key field of each slot is an encoded key:
+//
+//   - Length (4 bytes): Length of the full key
+//   - Hash (8 bytes): Hash of the full key, used for placement
+//   - Prefix (KeyPrefix bytes): First bytes of the key, zero padded
+//   - Overflow Offset (8 bytes): Position of the full key in the overflow
+//     file, for keys longer than the prefix
+//
+// Lookups build the same encoding from the caller's key, with the full key
+// appended past the fixed part when it does not fit inline. Length, hash
+// and prefix are compared first and the overflow is read only when they
+// all match. The overflow file, filePath + ".klog", is append-only; the
+// bytes of deleted long keys are not reclaimed.
+const varKeyHeaderSize = 4 + 8
+
+// openKeyLog opens the overflow file of a VarKeys table.
+func (ph *PersistentHash) openKeyLog() error {
+	file, err := os.OpenFile(ph.filePath+".klog", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open key overflow file: %w", err)
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat key overflow file: %w", err)
+	}
+	ph.klog = &valueLog{file: file, size: fi.Size()}
+	return nil
+}
+
+// encodeKey turns a caller's key into the form used for probing. Fixed
+// size tables use the key as is and only check its length.
+func (ph *PersistentHash) encodeKey(key []byte) ([]byte, bool) {
+	if ph.crypt != nil {
+		if uint32(len(key)) != ph.crypt.keySize {
+			return nil, false
+		}
+		return ph.crypt.slotKey(key), true
+	}
+	if ph.flags&flagVarKeys == 0 {
+		return key, uint32(len(key)) == ph.keySize
+	}
+	if uint64(len(key)) > math.MaxUint32 {
+		return nil, false
+	}
+
+	enc := make([]byte, ph.keySize, int(ph.keySize)+len(key))
+	binary.BigEndian.PutUint32(enc[0:4], uint32(len(key)))
+	binary.BigEndian.PutUint64(enc[4:12], ph.hashRaw(key))
+	copy(enc[varKeyHeaderSize:varKeyHeaderSize+ph.keyPrefix], key)
+	if uint32(len(key)) > ph.keyPrefix {
+		enc = append(enc, key...)
+	}
+	return enc, true
+}
+
+// storeKey is encodeKey for writes. A long key that is not in the table
+// yet is appended to the overflow file and its offset recorded.
+func (ph *PersistentHash) storeKey(key []byte) ([]byte, error) {
+	enc, ok := ph.encodeKey(key)
+	if !ok {
+		return nil, errors.New("invalid key/value size")
+	}
+	if !ph.longKey(key) {
+		return enc, nil
+	}
+	if t, idx, found := ph.lookup(enc); found {
+		ph.keepOverflow(enc, t, idx)
+		return enc, nil
+	}
+	if err := ph.spillKey(enc, key); err != nil {
+		return nil, err
+	}
+	return enc, nil
+}
+
+// longKey reports whether key is kept in the overflow file.
+func (ph *PersistentHash) longKey(key []byte) bool {
+	return ph.flags&flagVarKeys != 0 && uint32(len(key)) > ph.keyPrefix
+}
+
+// spillKey appends a long key about to be inserted to the overflow file
+// and records its offset in the encoded key enc.
+func (ph *PersistentHash) spillKey(enc, key []byte) error {
+	ptr, err := ph.klog.append(key)
+	if err != nil {
+		return err
+	}
+	copy(enc[ph.keySize-8:ph.keySize], ptr[0:8])
+	return nil
+}
+
+// keepOverflow copies the overflow offset of the long key stored in slot
+// idx of t into enc. A key still in the old table during a resize is
+// written to the new one with it, which would otherwise lose its full key.
+func (ph *PersistentHash) keepOverflow(enc []byte, t *table, idx uint32) {
+	slotStart := t.base + idx*ph.slotSize
+	copy(enc[ph.keySize-8:ph.keySize], t.data[slotStart+1+ph.keySize-8:slotStart+1+ph.keySize])
+}
+
+// keyEqual reports whether the slot key stored matches the probe key.
+func (ph *PersistentHash) keyEqual(stored, key []byte) bool {
+	if ph.flags&flagVarKeys == 0 {
+		return bytes.Equal(key, stored)
+	}
+
+	fixed := varKeyHeaderSize + ph.keyPrefix
+	if !bytes.Equal(key[:fixed], stored[:fixed]) {
+		return false
+	}
+	n := binary.BigEndian.Uint32(stored[0:4])
+	if n <= ph.keyPrefix {
+		return true
+	}
+
+	// Slot keys copied during a resize carry no full key and never match
+	full := key[ph.keySize:]
+	if uint32(len(full)) != n {
+		return false
+	}
+	overflow, err := ph.overflowKey(stored)
+	return err == nil && bytes.Equal(full, overflow)
+}
+
+// overflowKey reads the full key of a long encoded key.
+func (ph *PersistentHash) overflowKey(stored []byte) ([]byte, error) {
+	ptr := make([]byte, valuePointerSize)
+	copy(ptr[0:8], stored[ph.keySize-8:ph.keySize])
+	copy(ptr[8:12], stored[0:4])
+	return ph.klog.read(ptr)
+}
+
+// decodeKey returns the caller's key for a slot key.
+func (ph *PersistentHash) decodeKey(stored []byte) ([]byte, error) {
+	if ph.flags&flagVarKeys == 0 {
+		return stored, nil
+	}
+	n := binary.BigEndian.Uint32(stored[0:4])
+	if n > ph.keyPrefix {
+		return ph.overflowKey(stored)
+	}
+	key := make([]byte, n)
+	copy(key, stored[varKeyHeaderSize:])
+	return key, nil
+}